@@ -0,0 +1,275 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// callbackSignatureSize is the size of the truncated HMAC in callback data,
+// callback data is limited to 64 bytes by Telegram
+const callbackSignatureSize = 12
+
+const (
+	actionMute    = "m"
+	actionUnmute  = "u"
+	actionBlock   = "b"
+	actionSpam    = "s"
+	actionHeaders = "h"
+	actionDelete  = "d"
+	actionExpand  = "x"
+)
+
+// emailActions is what the buttons of a delivered email act on
+type emailActions struct {
+	address    string
+	sender     string
+	headers    string
+	messageIDs []int
+	tokens     []string
+}
+
+// newEmailActions remembers the email for its buttons and returns the ID used in callback data,
+// it returns zero if buttons are disabled, the Spam button trains on the hashed tokens of the spam text
+func (w *worker) newEmailActions(chatID int64, e *env, spamText string) int64 {
+	if w.cfg.ActionsExpirySeconds == 0 || len(e.recipients[chatID]) == 0 {
+		return 0
+	}
+	sender := e.from.Email()
+	if addresses, err := e.mime.AddressList("From"); err == nil && len(addresses) > 0 {
+		sender = addresses[0].Address
+	}
+	fields, _ := splitMessage(e.data)
+	var headers strings.Builder
+	for _, f := range fields {
+		headers.WriteString(strings.Replace(f.raw, "\r\n", "\n", -1))
+	}
+	tokens, err := json.Marshal(w.spamTokens(spamText))
+	checkErr(err)
+	result, err := w.db.Exec(
+		"insert into email_actions (chat_id, address, sender, headers, message_ids, tokens, created) values (?,?,?,?,?,?,?)",
+		chatID,
+		e.recipients[chatID][0],
+		strings.ToLower(sender),
+		headers.String(),
+		"[]",
+		string(tokens),
+		time.Now().Unix())
+	checkErr(err)
+	id, err := result.LastInsertId()
+	checkErr(err)
+	return id
+}
+
+// rememberActionMessages stores the messages of the email so that they can be deleted
+func (w *worker) rememberActionMessages(id int64, messageIDs []int) {
+	if id == 0 {
+		return
+	}
+	data, err := json.Marshal(messageIDs)
+	checkErr(err)
+	w.mustExec("update email_actions set message_ids=? where id=?", string(data), id)
+}
+
+func (w *worker) emailActions(chatID int64, id int64) *emailActions {
+	query, err := w.db.Query(
+		"select address, sender, headers, message_ids, tokens from email_actions where chat_id=? and id=? and created>=?",
+		chatID,
+		id,
+		time.Now().Unix()-int64(w.cfg.ActionsExpirySeconds))
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return nil
+	}
+	var a emailActions
+	var messageIDs, tokens string
+	checkErr(query.Scan(&a.address, &a.sender, &a.headers, &messageIDs, &tokens))
+	checkErr(json.Unmarshal([]byte(messageIDs), &a.messageIDs))
+	checkErr(json.Unmarshal([]byte(tokens), &a.tokens))
+	return &a
+}
+
+// emailActionsForMessage returns what the buttons of the email act on by any of its messages
+func (w *worker) emailActionsForMessage(chatID int64, messageID int) *emailActions {
+	query, err := w.db.Query(`
+		select id from email_actions
+		where chat_id=? and ','||trim(message_ids, '[]')||',' like ? and created>=?`,
+		chatID,
+		fmt.Sprintf("%%,%d,%%", messageID),
+		time.Now().Unix()-int64(w.cfg.ActionsExpirySeconds))
+	checkErr(err)
+	var id int64
+	found := query.Next()
+	if found {
+		checkErr(query.Scan(&id))
+	}
+	checkErr(query.Close())
+	if !found {
+		return nil
+	}
+	return w.emailActions(chatID, id)
+}
+
+// purgeEmailActions removes expired data of buttons
+func (w *worker) purgeEmailActions() {
+	w.mustExec("delete from email_actions where created<?", time.Now().Unix()-int64(w.cfg.ActionsExpirySeconds))
+}
+
+func (w *worker) callbackSignature(chatID int64, payload string) string {
+	key := sha256.Sum256([]byte("callback:" + w.cfg.BotToken))
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write([]byte(strconv.FormatInt(chatID, 10) + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:callbackSignatureSize])
+}
+
+// callbackData returns signed callback data in the format action:id:expires:signature
+func (w *worker) callbackData(chatID int64, action string, id int64, expires int64) string {
+	payload := action + ":" + strconv.FormatInt(id, 36) + ":" + strconv.FormatInt(expires, 36)
+	return payload + ":" + w.callbackSignature(chatID, payload)
+}
+
+// parseCallbackData verifies the signature and the expiry of callback data
+func (w *worker) parseCallbackData(chatID int64, data string) (action string, id int64, ok bool) {
+	idx := strings.LastIndexByte(data, ':')
+	if idx == -1 {
+		return "", 0, false
+	}
+	payload, signature := data[:idx], data[idx+1:]
+	if !hmac.Equal([]byte(signature), []byte(w.callbackSignature(chatID, payload))) {
+		return "", 0, false
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 {
+		return "", 0, false
+	}
+	id, err := strconv.ParseInt(parts[1], 36, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	expires, err := strconv.ParseInt(parts[2], 36, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", 0, false
+	}
+	return parts[0], id, true
+}
+
+func (w *worker) emailKeyboard(chatID int64, id int64, muted bool) tg.InlineKeyboardMarkup {
+	expires := time.Now().Unix() + int64(w.cfg.ActionsExpirySeconds)
+	mute := tg.NewInlineKeyboardButtonData("Mute address", w.callbackData(chatID, actionMute, id, expires))
+	if muted {
+		mute = tg.NewInlineKeyboardButtonData("Unmute address", w.callbackData(chatID, actionUnmute, id, expires))
+	}
+	return tg.NewInlineKeyboardMarkup(
+		tg.NewInlineKeyboardRow(
+			mute,
+			tg.NewInlineKeyboardButtonData("Block sender", w.callbackData(chatID, actionBlock, id, expires))),
+		tg.NewInlineKeyboardRow(
+			tg.NewInlineKeyboardButtonData("Spam", w.callbackData(chatID, actionSpam, id, expires)),
+			tg.NewInlineKeyboardButtonData("Headers", w.callbackData(chatID, actionHeaders, id, expires)),
+			tg.NewInlineKeyboardButtonData("Delete", w.callbackData(chatID, actionDelete, id, expires))))
+}
+
+func (w *worker) answerCallback(id string, text string) {
+	if _, err := w.bot.Request(tg.NewCallback(id, text)); err != nil {
+		lerr("cannot answer a callback query, %v", err)
+	}
+}
+
+// request waits for Telegram rate limits and makes the request
+func (w *worker) request(chatID int64, c tg.Chattable) error {
+	return w.sendWithRetries(chatID, priorityCommand, 1, func() error {
+		_, err := w.bot.Request(c)
+		return err
+	})
+}
+
+// processCallbackQuery handles the buttons of delivered emails
+func (w *worker) processCallbackQuery(q *tg.CallbackQuery) {
+	if q.Message == nil || q.Message.Chat == nil {
+		w.answerCallback(q.ID, "")
+		return
+	}
+	chatID := q.Message.Chat.ID
+	action, id, ok := w.parseCallbackData(chatID, q.Data)
+	if ok && action == actionExpand {
+		w.expandDigestEmail(q, id)
+		return
+	}
+	var a *emailActions
+	if ok {
+		a = w.emailActions(chatID, id)
+	}
+	if a == nil {
+		w.answerCallback(q.ID, "This button has expired")
+		return
+	}
+	linf("chat: %d, callback: %s %d", chatID, action, id)
+	switch action {
+	case actionMute, actionUnmute:
+		username, tag, host, ok := w.chatAddress(chatID, a.address)
+		if !ok {
+			w.answerCallback(q.ID, "Address not found")
+			return
+		}
+		muted := action == actionMute
+		w.setMuted(chatID, username, tag, host, muted)
+		keyboard := w.emailKeyboard(chatID, id, muted)
+		_ = w.request(chatID, tg.NewEditMessageReplyMarkup(chatID, q.Message.MessageID, keyboard))
+		if muted {
+			w.answerCallback(q.ID, "Muted "+a.address)
+		} else {
+			w.answerCallback(q.ID, "Unmuted "+a.address)
+		}
+	case actionBlock:
+		if a.sender == "" {
+			w.answerCallback(q.ID, "Sender is unknown")
+			return
+		}
+		w.setSenderRule(chatID, "", "", a.sender, false)
+		w.answerCallback(q.ID, "Blocked "+a.sender)
+	case actionSpam:
+		// the button is under the last message of the email, the first one identifies it as /spam does
+		messageID := q.Message.MessageID
+		if len(a.messageIDs) > 0 {
+			messageID = a.messageIDs[0]
+		}
+		w.answerCallback(q.ID, w.trainEmail(chatID, messageID, a.tokens, true))
+	case actionHeaders:
+		w.answerCallback(q.ID, "")
+		for _, c := range chunkHTML("<pre>"+html.EscapeString(a.headers)+"</pre>", w.cfg.MaxTextChunkSize) {
+			msg := textMessage(chatID, false, parseHTML, c)
+			msg.ReplyToMessageID = q.Message.MessageID
+			if w.send(msg) != nil {
+				return
+			}
+		}
+	case actionDelete:
+		messageIDs := a.messageIDs
+		if len(messageIDs) == 0 {
+			messageIDs = []int{q.Message.MessageID}
+		}
+		failed := 0
+		for _, m := range messageIDs {
+			if err := w.request(chatID, tg.NewDeleteMessage(chatID, m)); err != nil {
+				failed++
+			}
+		}
+		if failed > 0 {
+			w.answerCallback(q.ID, fmt.Sprintf("Cannot delete %d of %d messages", failed, len(messageIDs)))
+			return
+		}
+		w.mustExec("delete from email_actions where id=?", id)
+		w.answerCallback(q.ID, "Deleted")
+	default:
+		w.answerCallback(q.ID, "Unknown action")
+	}
+}
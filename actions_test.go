@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCallbackData(t *testing.T) {
+	w := &worker{cfg: &config{BotToken: testBotToken}}
+	expires := time.Now().Unix() + 3600
+	data := w.callbackData(1, actionBlock, 1<<40, 1<<40)
+	if len(data) > 64 {
+		t.Errorf("callback data is %d bytes, Telegram allows 64", len(data))
+	}
+	data = w.callbackData(1, actionBlock, 42, expires)
+	if action, id, ok := w.parseCallbackData(1, data); !ok || action != actionBlock || id != 42 {
+		t.Fatalf("expected the callback data to be parsed, got %s %d %v", action, id, ok)
+	}
+	parts := strings.Split(data, ":")
+	forge := func(action string, id int64, expires int64) string {
+		return strings.Join([]string{action, strconv.FormatInt(id, 36), strconv.FormatInt(expires, 36), parts[3]}, ":")
+	}
+	if forge(actionBlock, 42, expires) != data {
+		t.Fatal("expected forged data to differ only in the changed field")
+	}
+	other := &worker{cfg: &config{BotToken: "2:other"}}
+	for name, forged := range map[string]string{
+		"another chat":      "",
+		"another action":    forge(actionDelete, 42, expires),
+		"another id":        forge(actionBlock, 43, expires),
+		"later expiry":      forge(actionBlock, 42, expires+3600),
+		"another bot":       other.callbackData(1, actionBlock, 42, expires),
+		"missing signature": strings.Join(parts[:3], ":"),
+		"empty signature":   strings.Join(parts[:3], ":") + ":",
+		"garbage":           "garbage",
+		"empty":             "",
+	} {
+		chatID := int64(1)
+		if name == "another chat" {
+			chatID, forged = 2, data
+		}
+		if action, id, ok := w.parseCallbackData(chatID, forged); ok {
+			t.Errorf("%s: expected %q to be rejected, got %s %d", name, forged, action, id)
+		}
+	}
+	expired := w.callbackData(1, actionBlock, 42, time.Now().Unix()-1)
+	if _, _, ok := w.parseCallbackData(1, expired); ok {
+		t.Error("expected expired callback data to be rejected")
+	}
+}
+
+// TestCallbackQuerySignature checks that a button works only with the callback data the bot signed
+func TestCallbackQuerySignature(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.ActionsExpirySeconds = 3600
+	addTestAddresses(w, 1)
+	id := w.newEmailActions(1, testEnv(w, 1, 1), "")
+	if id == 0 {
+		t.Fatal("expected buttons to be enabled")
+	}
+	query := func(data string) string {
+		w.processCallbackQuery(&tg.CallbackQuery{
+			ID:      "query",
+			Message: &tg.Message{MessageID: 5, Chat: &tg.Chat{ID: 1}},
+			Data:    data,
+		})
+		answers := f.sent("answerCallbackQuery")
+		return answers[len(answers)-1].form.Get("text")
+	}
+	expires := time.Now().Unix() + 3600
+	valid := w.callbackData(1, actionBlock, id, expires)
+	forged := valid[:strings.LastIndexByte(valid, ':')+1] + strings.Repeat("A", 16)
+	if text := query(forged); text != "This button has expired" {
+		t.Errorf("expected forged callback data to be refused, got %q", text)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from sender_rules")); n != 0 {
+		t.Fatalf("expected forged callback data not to block the sender, got %d rules", n)
+	}
+	if text := query(w.callbackData(2, actionBlock, id, expires)); text != "This button has expired" {
+		t.Errorf("expected callback data of another chat to be refused, got %q", text)
+	}
+	if text := query(valid); text != "Blocked sender@example.com" {
+		t.Errorf("expected the sender to be blocked, got %q", text)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from sender_rules where chat_id=1 and sender='sender@example.com' and allow=0")); n != 1 {
+		t.Errorf("expected a block rule, got %d", n)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const (
+	spamActionOff     = "off"
+	spamActionMute    = "mute"
+	spamActionSummary = "summary"
+	spamActionDrop    = "drop"
+)
+
+// spamMinTrained is the number of spam and non-spam messages required to start filtering
+const spamMinTrained = 5
+
+// spamInterestingTokens is the number of the most significant tokens used for scoring
+const spamInterestingTokens = 15
+
+const spamMaxTokens = 1000
+
+// spamVerdict is a result of the spam filter for a chat
+type spamVerdict struct {
+	spam        bool
+	probability float64
+	action      string
+}
+
+// spamTokens returns unique hashed tokens of the text,
+// the hashes are keyed by the instance secret so that a dictionary cannot be hashed to read them
+func (w *worker) spamTokens(text string) []string {
+	key := secretKey(w.cfg.SpamSecret, "spam")
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '\'' && r != '-'
+	})
+	seen := make(map[string]bool)
+	var tokens []string
+	for _, word := range words {
+		if n := len([]rune(word)); n < 3 || n > 40 {
+			continue
+		}
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(word))
+		token := hex.EncodeToString(mac.Sum(nil)[:8])
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+			if len(tokens) == spamMaxTokens {
+				break
+			}
+		}
+	}
+	return tokens
+}
+
+func (w *worker) spamSettings(chatID int64) (action string, threshold float64, spamCount, hamCount int) {
+	query, err := w.db.Query("select spam_action, spam_threshold, spam_count, ham_count from users where chat_id=?", chatID)
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return spamActionOff, 1, 0, 0
+	}
+	checkErr(query.Scan(&action, &threshold, &spamCount, &hamCount))
+	return
+}
+
+// spamProbability returns the probability that the text is spam for the chat
+func (w *worker) spamProbability(chatID int64, text string, spamCount, hamCount int) float64 {
+	tokens := w.spamTokens(text)
+	if len(tokens) == 0 {
+		return 0.5
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?,", len(tokens)), ",")
+	args := []interface{}{chatID}
+	for _, t := range tokens {
+		args = append(args, t)
+	}
+	query, err := w.db.Query("select spam, ham from bayes_tokens where chat_id=? and token in ("+placeholders+")", args...)
+	checkErr(err)
+	defer query.Close()
+	var probabilities []float64
+	for query.Next() {
+		var spam, ham int
+		checkErr(query.Scan(&spam, &ham))
+		spamFreq := float64(spam) / float64(spamCount)
+		hamFreq := float64(ham) / float64(hamCount)
+		p := spamFreq / (spamFreq + hamFreq)
+		n := float64(spam + ham)
+		// Robinson's correction for rare tokens with the prior of 0.5
+		p = (0.5 + n*p) / (1 + n)
+		probabilities = append(probabilities, math.Min(math.Max(p, 0.01), 0.99))
+	}
+	sort.Slice(probabilities, func(i, j int) bool {
+		return math.Abs(probabilities[i]-0.5) > math.Abs(probabilities[j]-0.5)
+	})
+	if len(probabilities) > spamInterestingTokens {
+		probabilities = probabilities[:spamInterestingTokens]
+	}
+	var logRatio float64
+	for _, p := range probabilities {
+		logRatio += math.Log(1-p) - math.Log(p)
+	}
+	return 1 / (1 + math.Exp(logRatio))
+}
+
+// spamCheck classifies the email for the chat
+func (w *worker) spamCheck(chatID int64, text string) spamVerdict {
+	action, threshold, spamCount, hamCount := w.spamSettings(chatID)
+	if action == spamActionOff || spamCount < spamMinTrained || hamCount < spamMinTrained {
+		return spamVerdict{action: action}
+	}
+	p := w.spamProbability(chatID, text, spamCount, hamCount)
+	return spamVerdict{spam: p >= threshold, probability: p, action: action}
+}
+
+func (w *worker) trainTokens(chatID int64, tokens []string, spam, ham int) {
+	tx, err := w.db.Begin()
+	checkErr(err)
+	for _, t := range tokens {
+		_, err = tx.Exec("insert or ignore into bayes_tokens (chat_id, token) values (?,?)", chatID, t)
+		checkErr(err)
+		_, err = tx.Exec("update bayes_tokens set spam=spam+?, ham=ham+? where chat_id=? and token=?", spam, ham, chatID, t)
+		checkErr(err)
+	}
+	_, err = tx.Exec("delete from bayes_tokens where chat_id=? and spam=0 and ham=0", chatID)
+	checkErr(err)
+	checkErr(tx.Commit())
+}
+
+// trainSpam trains the filter of the chat with the delivered email the user replied to
+func (w *worker) trainSpam(chatID int64, replyTo *tg.Message, spam bool) {
+	if replyTo == nil || replyTo.From == nil || replyTo.From.ID != w.ourID() {
+		_ = w.sendText(chatID, false, parseRaw, "Reply to a delivered email with this command")
+		return
+	}
+	a := w.emailActionsForMessage(chatID, replyTo.MessageID)
+	if a == nil {
+		_ = w.sendText(chatID, false, parseRaw, "This email is too old to learn from")
+		return
+	}
+	_ = w.sendText(chatID, false, parseRaw, w.trainEmail(chatID, a.messageIDs[0], a.tokens, spam))
+}
+
+// trainEmail trains the filter of the chat with the tokens of the delivered email,
+// the first Telegram message of the email identifies it so that it is learned once,
+// the learned tokens are stored so that relearning reverts exactly them
+func (w *worker) trainEmail(chatID int64, messageID int, tokens []string, spam bool) string {
+	if len(tokens) == 0 {
+		return "Nothing to learn from"
+	}
+	query, err := w.db.Query("select spam, tokens from bayes_trained where chat_id=? and message_id=?", chatID, messageID)
+	checkErr(err)
+	trained, wasSpam, learned := query.Next(), false, ""
+	if trained {
+		checkErr(query.Scan(&wasSpam, &learned))
+	}
+	checkErr(query.Close())
+	if trained && wasSpam == spam {
+		return "Already learned"
+	}
+	if trained {
+		var learnedTokens []string
+		checkErr(json.Unmarshal([]byte(learned), &learnedTokens))
+		if wasSpam {
+			w.trainTokens(chatID, learnedTokens, -1, 0)
+			w.mustExec("update users set spam_count=spam_count-1 where chat_id=?", chatID)
+		} else {
+			w.trainTokens(chatID, learnedTokens, 0, -1)
+			w.mustExec("update users set ham_count=ham_count-1 where chat_id=?", chatID)
+		}
+	}
+	if spam {
+		w.trainTokens(chatID, tokens, 1, 0)
+		w.mustExec("update users set spam_count=spam_count+1 where chat_id=?", chatID)
+	} else {
+		w.trainTokens(chatID, tokens, 0, 1)
+		w.mustExec("update users set ham_count=ham_count+1 where chat_id=?", chatID)
+	}
+	data, err := json.Marshal(tokens)
+	checkErr(err)
+	w.mustExec("insert or replace into bayes_trained (chat_id, message_id, spam, tokens) values (?,?,?,?)", chatID, messageID, spam, string(data))
+	return "OK"
+}
+
+// spamFilter sets the spam filter action and threshold for the chat
+func (w *worker) spamFilter(chatID int64, arguments string) {
+	parts := strings.Fields(arguments)
+	if len(parts) == 0 {
+		action, threshold, spamCount, hamCount := w.spamSettings(chatID)
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf(
+			"Spam filter: %s, threshold: %g\nLearned %d spam and %d non-spam emails, filtering starts after %d of each\n\nCommand format: /spam_filter off|mute|summary|drop [threshold]",
+			action,
+			threshold,
+			spamCount,
+			hamCount,
+			spamMinTrained))
+		return
+	}
+	action := strings.ToLower(parts[0])
+	switch action {
+	case spamActionOff, spamActionMute, spamActionSummary, spamActionDrop:
+	default:
+		_ = w.sendText(chatID, false, parseRaw, "Command format: /spam_filter off|mute|summary|drop [threshold]")
+		return
+	}
+	if len(parts) > 1 {
+		threshold, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || threshold <= 0 || threshold > 1 {
+			_ = w.sendText(chatID, false, parseRaw, "Threshold should be a number between 0 and 1")
+			return
+		}
+		w.mustExec("update users set spam_threshold=? where chat_id=?", threshold, chatID)
+	}
+	w.mustExec("update users set spam_action=? where chat_id=?", action, chatID)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
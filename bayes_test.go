@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestSpamTokens(t *testing.T) {
+	w := &worker{cfg: &config{SpamSecret: "one"}}
+	tokens := w.spamTokens("Cheap cheap PILLS, no rx!")
+	if len(tokens) != 2 {
+		t.Fatalf("expected unique words of 3 or more letters, got %v", tokens)
+	}
+	sum := sha256.Sum256([]byte("cheap"))
+	if tokens[0] == hex.EncodeToString(sum[:8]) {
+		t.Error("expected words to be hashed with the secret")
+	}
+	other := &worker{cfg: &config{SpamSecret: "two"}}
+	if other.spamTokens("cheap")[0] == tokens[0] {
+		t.Error("expected another secret to hash words differently")
+	}
+}
+
+// addTestEmailActions remembers an email delivered as the Telegram messages
+func addTestEmailActions(w *worker, chatID int64, text string, messageIDs ...int) {
+	ids, err := json.Marshal(messageIDs)
+	checkErr(err)
+	tokens, err := json.Marshal(w.spamTokens(text))
+	checkErr(err)
+	w.mustExec(
+		"insert into email_actions (chat_id, address, sender, headers, message_ids, tokens, created) values (?,'','','',?,?,?)",
+		chatID,
+		string(ids),
+		string(tokens),
+		time.Now().Unix())
+}
+
+func (w *worker) tokenCounts(chatID int64, text string) (spam, ham int) {
+	for _, token := range w.spamTokens(text) {
+		query, err := w.db.Query("select spam, ham from bayes_tokens where chat_id=? and token=?", chatID, token)
+		checkErr(err)
+		if query.Next() {
+			var s, h int
+			checkErr(query.Scan(&s, &h))
+			spam, ham = spam+s, ham+h
+		}
+		checkErr(query.Close())
+	}
+	return
+}
+
+func TestTrainSpam(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.ActionsExpirySeconds = 3600
+	w.mustExec("insert into users (chat_id, external_id) values (1, 'x')")
+	addTestEmailActions(w, 1, "cheap pills offer", 11, 12)
+	reply := func(messageID int) *tg.Message {
+		return &tg.Message{MessageID: messageID, From: &tg.User{ID: 1}}
+	}
+	replies := func() (texts []string) {
+		for _, r := range f.sent("sendMessage") {
+			texts = append(texts, r.form.Get("text"))
+		}
+		return
+	}
+
+	// the command replying to any message of the email and the button learn the email once
+	w.trainSpam(1, reply(12), true)
+	if result := w.trainEmail(1, 11, w.spamTokens("cheap pills offer"), true); result != "Already learned" {
+		t.Errorf("expected the button to find the email learned, got %q", result)
+	}
+	if spam, ham := w.tokenCounts(1, "cheap pills offer"); spam != 3 || ham != 0 {
+		t.Errorf("expected every word learned once as spam, got spam=%d ham=%d", spam, ham)
+	}
+
+	// relearning reverts the tokens learned before rather than the ones stored now
+	w.mustExec("update email_actions set tokens=?", `["`+w.spamTokens("meeting")[0]+`"]`)
+	w.trainSpam(1, reply(11), false)
+	if spam, ham := w.tokenCounts(1, "cheap pills offer"); spam != 0 || ham != 0 {
+		t.Errorf("expected the learned words to be reverted, got spam=%d ham=%d", spam, ham)
+	}
+	if spam, ham := w.tokenCounts(1, "meeting"); spam != 0 || ham != 1 {
+		t.Errorf("expected the stored words learned as non-spam, got spam=%d ham=%d", spam, ham)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from bayes_tokens where spam<0 or ham<0")); n != 0 {
+		t.Errorf("expected no negative counts, got %d tokens", n)
+	}
+	_, _, spamCount, hamCount := w.spamSettings(1)
+	if spamCount != 0 || hamCount != 1 {
+		t.Errorf("expected 0 spam and 1 non-spam emails, got %d and %d", spamCount, hamCount)
+	}
+
+	w.trainSpam(1, reply(13), true)
+	expected := []string{"OK", "OK", "This email is too old to learn from"}
+	if texts := replies(); len(texts) != len(expected) || texts[0] != expected[0] || texts[1] != expected[1] || texts[2] != expected[2] {
+		t.Errorf("got replies %q, expected %q", texts, expected)
+	}
+}
+
+func TestSpamCheck(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.ActionsExpirySeconds = 3600
+	w.mustExec("insert into users (chat_id, external_id) values (1, 'x')")
+	for i := 0; i < spamMinTrained; i++ {
+		w.trainEmail(1, 2*i, w.spamTokens("cheap pills viagra casino"), true)
+		w.trainEmail(1, 2*i+1, w.spamTokens("meeting agenda minutes lunch"), false)
+	}
+	if v := w.spamCheck(1, "cheap casino"); !v.spam {
+		t.Errorf("expected spam, got %+v", v)
+	}
+	if v := w.spamCheck(1, "lunch meeting"); v.spam {
+		t.Errorf("expected non-spam, got %+v", v)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// downloadPath is the path of the attachment download handler
+const downloadPath = "/files/"
+
+func (w *worker) blobSignature(id string, expires int64) string {
+	mac := hmac.New(sha256.New, secretKey(w.cfg.DownloadSecret, "signature"))
+	mac.Write([]byte(id + ":" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *worker) blobCipher() cipher.AEAD {
+	return newAEAD(secretKey(w.cfg.DownloadSecret, "encryption"))
+}
+
+// storeBlob encrypts the file into the blob store and returns its signed download URL
+func (w *worker) storeBlob(f mediaFile) (string, error) {
+	idBytes := make([]byte, 16)
+	if _, err := crand.Read(idBytes); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(idBytes)
+	data, err := seal(w.blobCipher(), f.file.Bytes, []byte(id))
+	if err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(filepath.Join(w.cfg.BlobDir, id), data, 0600); err != nil {
+		return "", err
+	}
+	expires := time.Now().Unix() + int64(w.cfg.DownloadExpirySeconds)
+	w.mustExec(
+		"insert into blobs (id, file_name, size, expires) values (?,?,?,?)",
+		id,
+		f.file.Name,
+		len(f.file.Bytes),
+		expires)
+	return fmt.Sprintf("https://%s%s%s?e=%d&s=%s", w.cfg.Host, downloadPath, id, expires, w.blobSignature(id, expires)), nil
+}
+
+func (w *worker) loadBlob(id string) (fileName string, data []byte, err error) {
+	query, err := w.db.Query("select file_name from blobs where id=?", id)
+	checkErr(err)
+	found := query.Next()
+	if found {
+		checkErr(query.Scan(&fileName))
+	}
+	checkErr(query.Close())
+	if !found {
+		return "", nil, os.ErrNotExist
+	}
+	encrypted, err := ioutil.ReadFile(filepath.Join(w.cfg.BlobDir, id))
+	if err != nil {
+		return "", nil, err
+	}
+	data, err = unseal(w.blobCipher(), encrypted, []byte(id))
+	return fileName, data, err
+}
+
+// serveBlob serves a stored attachment if the link is valid and not expired
+func (w *worker) serveBlob(rw http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, downloadPath)
+	expires, err := strconv.ParseInt(r.URL.Query().Get("e"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(r.URL.Query().Get("s")), []byte(w.blobSignature(id, expires))) {
+		http.Error(rw, "invalid link", http.StatusForbidden)
+		return
+	}
+	if time.Now().Unix() > expires {
+		http.Error(rw, "link expired", http.StatusGone)
+		return
+	}
+	fileName, data, err := w.loadBlob(id)
+	if err != nil {
+		http.Error(rw, "file not found", http.StatusNotFound)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fileName}))
+	_, _ = rw.Write(data)
+}
+
+// purgeBlobs removes expired attachments
+func (w *worker) purgeBlobs() {
+	query, err := w.db.Query("select id from blobs where expires<?", time.Now().Unix())
+	checkErr(err)
+	var ids []string
+	for query.Next() {
+		var id string
+		checkErr(query.Scan(&id))
+		ids = append(ids, id)
+	}
+	checkErr(query.Close())
+	for _, id := range ids {
+		if err := os.Remove(filepath.Join(w.cfg.BlobDir, id)); err != nil && !os.IsNotExist(err) {
+			lerr("cannot remove blob %s, %v", id, err)
+			continue
+		}
+		w.mustExec("delete from blobs where id=?", id)
+	}
+}
+
+// oversizedMedia separates files that are too large to be uploaded to Telegram
+func (w *worker) oversizedMedia(files []mediaFile) (small []mediaFile, large []mediaFile) {
+	if w.cfg.AttachmentLinkThreshold == 0 {
+		return files, nil
+	}
+	for _, f := range files {
+		if len(f.file.Bytes) > w.cfg.AttachmentLinkThreshold {
+			large = append(large, f)
+		} else {
+			small = append(small, f)
+		}
+	}
+	return
+}
+
+// downloadLinks stores the files and returns the message listing their download links
+func (w *worker) downloadLinks(files []mediaFile) (string, error) {
+	expires := time.Now().Add(time.Second * time.Duration(w.cfg.DownloadExpirySeconds))
+	lines := []string{"Large attachments, available until " + expires.UTC().Format("2006-01-02 15:04 MST")}
+	for _, f := range files {
+		url, err := w.storeBlob(f)
+		if err != nil {
+			return "", err
+		}
+		lines = append(lines, fmt.Sprintf(
+			`<a href="%s">%s</a> (%.1f MB)`,
+			html.EscapeString(url),
+			html.EscapeString(f.file.Name),
+			float64(len(f.file.Bytes))/(1<<20)))
+	}
+	return strings.Join(lines, "\n"), nil
+}
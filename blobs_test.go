@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func newBlobTestWorker(t *testing.T) *worker {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.BlobDir = t.TempDir()
+	w.cfg.DownloadSecret = "download secret"
+	w.cfg.DownloadExpirySeconds = 3600
+	return w
+}
+
+// getBlob requests the link from the download handler
+func getBlob(w *worker, link string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	w.serveBlob(rec, httptest.NewRequest(http.MethodGet, link, nil))
+	return rec
+}
+
+func TestBlobLink(t *testing.T) {
+	w := newBlobTestWorker(t)
+	content := []byte("quarterly report")
+	link, err := w.storeBlob(mediaFile{mediaType: "document", file: tg.FileBytes{Name: "report.pdf", Bytes: content}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link, "https://"+testHost+downloadPath) {
+		t.Fatalf("unexpected link %s", link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.TrimPrefix(u.Path, downloadPath)
+	stored, err := ioutil.ReadFile(filepath.Join(w.cfg.BlobDir, id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, content) {
+		t.Error("expected the file to be stored encrypted")
+	}
+	rec := getBlob(w, link)
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Fatalf("expected the file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != `attachment; filename=report.pdf` {
+		t.Errorf("unexpected Content-Disposition %q", disposition)
+	}
+	query := u.Query()
+	expires, _ := strconv.ParseInt(query.Get("e"), 10, 64)
+	tampered := func(path string, e int64, s string) string {
+		return path + "?e=" + strconv.FormatInt(e, 10) + "&s=" + s
+	}
+	for name, l := range map[string]string{
+		"signature":         tampered(u.Path, expires, strings.Repeat("0", 64)),
+		"expiry":            tampered(u.Path, expires+3600, query.Get("s")),
+		"file":              tampered(downloadPath+strings.Repeat("0", 32), expires, query.Get("s")),
+		"missing expiry":    u.Path + "?s=" + query.Get("s"),
+		"another secret":    tampered(u.Path, expires, (&worker{cfg: &config{DownloadSecret: "other"}}).blobSignature(id, expires)),
+		"missing signature": tampered(u.Path, expires, ""),
+	} {
+		if rec := getBlob(w, l); rec.Code != http.StatusForbidden {
+			t.Errorf("tampered %s: expected %d, got %d", name, http.StatusForbidden, rec.Code)
+		}
+	}
+	past := time.Now().Unix() - 1
+	if rec := getBlob(w, tampered(u.Path, past, w.blobSignature(id, past))); rec.Code != http.StatusGone {
+		t.Errorf("expected an expired link to be refused with %d, got %d", http.StatusGone, rec.Code)
+	}
+}
+
+func TestPurgeBlobs(t *testing.T) {
+	w := newBlobTestWorker(t)
+	var ids []string
+	for _, name := range []string{"old.pdf", "new.pdf"} {
+		link, err := w.storeBlob(mediaFile{file: tg.FileBytes{Name: name, Bytes: []byte(name)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(link)
+		ids = append(ids, strings.TrimPrefix(u.Path, downloadPath))
+	}
+	w.mustExec("update blobs set expires=? where id=?", time.Now().Unix()-1, ids[0])
+	w.purgeBlobs()
+	if _, err := os.Stat(filepath.Join(w.cfg.BlobDir, ids[0])); !os.IsNotExist(err) {
+		t.Error("expected the expired file to be removed")
+	}
+	if _, _, err := w.loadBlob(ids[0]); err == nil {
+		t.Error("expected the expired blob to be forgotten")
+	}
+	if _, data, err := w.loadBlob(ids[1]); err != nil || string(data) != "new.pdf" {
+		t.Errorf("expected the other blob to be kept, got %v", err)
+	}
+}
+
+func TestOversizedMedia(t *testing.T) {
+	w := newBlobTestWorker(t)
+	files := []mediaFile{
+		{file: tg.FileBytes{Name: "small", Bytes: make([]byte, 10)}},
+		{file: tg.FileBytes{Name: "large", Bytes: make([]byte, 11)}},
+	}
+	if small, large := w.oversizedMedia(files); len(small) != 2 || len(large) != 0 {
+		t.Errorf("expected no links without a threshold, got %d large", len(large))
+	}
+	w.cfg.AttachmentLinkThreshold = 10
+	if small, large := w.oversizedMedia(files); len(small) != 1 || len(large) != 1 || large[0].file.Name != "large" {
+		t.Errorf("expected the file over the threshold to be linked, got %d small and %d large", len(small), len(large))
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	blockActionReject  = "reject"
+	blockActionDiscard = "discard"
+)
+
+var errorBlocked = errors.New("Sender is blocked")
+var errorDiscarded = errors.New("Email is discarded")
+
+type senderRule struct {
+	username string
+	host     string
+	sender   string
+	allow    bool
+}
+
+// matchSender returns true if the rule sender, an address or a domain, matches the address
+func matchSender(rule string, address string) bool {
+	address = strings.ToLower(address)
+	if strings.Contains(rule, "@") {
+		return rule == address
+	}
+	_, domain := splitAddress(address)
+	return domain == rule || strings.HasSuffix(domain, "."+rule)
+}
+
+// senderRules returns the rules of the chat for the address,
+// rules for the address without a tag also apply to all its tags
+func (w *worker) senderRules(chatID int64, address string) (rules []senderRule) {
+	localPart, host := splitAddress(address)
+	username, _ := splitSubaddress(localPart, w.cfg.SubaddressSeparator)
+	query, err := w.db.Query(`
+		select username, host, sender, allow from sender_rules
+		where chat_id=? and (username='' or (username in (?,?) and host=?))
+		order by username, allow, sender`,
+		chatID,
+		username,
+		localPart,
+		host)
+	checkErr(err)
+	defer query.Close()
+	for query.Next() {
+		var rule senderRule
+		checkErr(query.Scan(&rule.username, &rule.host, &rule.sender, &rule.allow))
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func (w *worker) blockAction(chatID int64) string {
+	query, err := w.db.Query("select block_action from users where chat_id=?", chatID)
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return blockActionReject
+	}
+	var action string
+	checkErr(query.Scan(&action))
+	return action
+}
+
+// senderAllowed checks sender rules of the address,
+// if there are allow rules then only matching senders are allowed
+func (w *worker) senderAllowed(chatID int64, address string, senders []string, checkAllowed bool) bool {
+	hasAllowRules := false
+	allowed := false
+	for _, rule := range w.senderRules(chatID, address) {
+		hasAllowRules = hasAllowRules || rule.allow
+		for _, s := range senders {
+			if s == "" || !matchSender(rule.sender, s) {
+				continue
+			}
+			if !rule.allow {
+				return false
+			}
+			allowed = true
+		}
+	}
+	return !checkAllowed || !hasAllowRules || allowed
+}
+
+// checkSender returns errorBlocked or errorDiscarded if the sender is blocked by the chat
+func (w *worker) checkSender(chatID int64, addresses []string, senders []string, checkAllowed bool) error {
+	for _, address := range addresses {
+		if w.senderAllowed(chatID, address, senders, checkAllowed) {
+			return nil
+		}
+	}
+	if w.blockAction(chatID) == blockActionDiscard {
+		return errorDiscarded
+	}
+	return errorBlocked
+}
+
+// parseRuleArguments parses "<sender-or-domain> [address]" arguments
+func (w *worker) parseRuleArguments(chatID int64, command string, arguments string) (sender string, localPart string, host string, ok bool) {
+	parts := strings.Fields(strings.ToLower(arguments))
+	if len(parts) == 0 || len(parts) > 2 {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Command format: /%s <sender-or-domain> [email@boxt.us]", command))
+		return "", "", "", false
+	}
+	sender = strings.TrimPrefix(parts[0], "@")
+	if strings.Contains(sender, "@") {
+		if local, domain := splitAddress(sender); local == "" || domain == "" {
+			_ = w.sendText(chatID, false, parseRaw, "Sender is invalid")
+			return "", "", "", false
+		}
+	} else if !validDomain(sender) {
+		_ = w.sendText(chatID, false, parseRaw, "Domain is invalid")
+		return "", "", "", false
+	}
+	if len(parts) == 2 {
+		if _, _, _, ok := w.chatAddress(chatID, parts[1]); !ok {
+			_ = w.sendText(chatID, false, parseRaw, "Address not found")
+			return "", "", "", false
+		}
+		localPart, host = splitAddress(parts[1])
+	}
+	return sender, localPart, host, true
+}
+
+func (w *worker) addSenderRule(chatID int64, command string, arguments string, allow bool) {
+	sender, username, host, ok := w.parseRuleArguments(chatID, command, arguments)
+	if !ok {
+		return
+	}
+	w.setSenderRule(chatID, username, host, sender, allow)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
+
+// setSenderRule replaces the rule for the sender and the address, empty username and host mean all addresses
+func (w *worker) setSenderRule(chatID int64, username string, host string, sender string, allow bool) {
+	w.mustExec("delete from sender_rules where chat_id=? and username=? and host=? and sender=?", chatID, username, host, sender)
+	w.mustExec(
+		"insert into sender_rules (chat_id, username, host, sender, allow) values (?,?,?,?,?)",
+		chatID,
+		username,
+		host,
+		sender,
+		allow)
+}
+
+func (w *worker) removeSenderRule(chatID int64, command string, arguments string, allow bool) {
+	sender, username, host, ok := w.parseRuleArguments(chatID, command, arguments)
+	if !ok {
+		return
+	}
+	exists := w.db.QueryRow(
+		"select count(*) from sender_rules where chat_id=? and username=? and host=? and sender=? and allow=?",
+		chatID,
+		username,
+		host,
+		sender,
+		allow)
+	if singleInt(exists) == 0 {
+		_ = w.sendText(chatID, false, parseRaw, "Rule not found")
+		return
+	}
+	w.mustExec(
+		"delete from sender_rules where chat_id=? and username=? and host=? and sender=? and allow=?",
+		chatID,
+		username,
+		host,
+		sender,
+		allow)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
+
+// blocklist lists sender rules or sets the action for blocked emails
+func (w *worker) blocklist(chatID int64, arguments string) {
+	switch action := strings.ToLower(strings.TrimSpace(arguments)); action {
+	case blockActionReject, blockActionDiscard:
+		w.mustExec("update users set block_action=? where chat_id=?", action, chatID)
+		_ = w.sendText(chatID, false, parseRaw, "OK")
+		return
+	case "":
+	default:
+		_ = w.sendText(chatID, false, parseRaw, "Command format: /blocklist [reject|discard]")
+		return
+	}
+	query, err := w.db.Query(
+		"select username, host, sender, allow from sender_rules where chat_id=? order by allow, host, username, sender",
+		chatID)
+	checkErr(err)
+	var blocked, allowed []string
+	for query.Next() {
+		var rule senderRule
+		checkErr(query.Scan(&rule.username, &rule.host, &rule.sender, &rule.allow))
+		line := rule.sender
+		if rule.username != "" {
+			line += " → " + rule.username + "@" + rule.host
+		}
+		if rule.allow {
+			allowed = append(allowed, line)
+		} else {
+			blocked = append(blocked, line)
+		}
+	}
+	checkErr(query.Close())
+	lines := []string{}
+	if len(blocked) > 0 {
+		lines = append(lines, "BLOCKED")
+		lines = append(lines, blocked...)
+		lines = append(lines, "")
+	}
+	if len(allowed) > 0 {
+		lines = append(lines, "ALLOWED ONLY")
+		lines = append(lines, allowed...)
+		lines = append(lines, "")
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "No rules", "")
+	}
+	lines = append(lines, fmt.Sprintf("Blocked emails are %sed", w.blockAction(chatID)))
+	_ = w.sendText(chatID, false, parseRaw, strings.Join(lines, "\n"))
+}
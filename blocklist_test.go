@@ -0,0 +1,90 @@
+package main
+
+import "testing"
+
+func TestMatchSender(t *testing.T) {
+	for _, c := range []struct {
+		rule    string
+		address string
+		match   bool
+	}{
+		{"alice@example.com", "Alice@Example.com", true},
+		{"alice@example.com", "bob@example.com", false},
+		{"example.com", "bob@example.com", true},
+		{"example.com", "bob@mail.example.com", true},
+		{"example.com", "bob@badexample.com", false},
+		{"mail.example.com", "bob@example.com", false},
+	} {
+		if match := matchSender(c.rule, c.address); match != c.match {
+			t.Errorf("%s for %s: got %v, expected %v", c.rule, c.address, match, c.match)
+		}
+	}
+}
+
+// TestSenderRulePrecedence checks that blocking wins over allowing
+// and that allow rules let through only matching senders
+func TestSenderRulePrecedence(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.SubaddressSeparator = "+"
+	addTestAddresses(w, 1)
+	address := testUsername(1) + "@" + testHost
+	tagged := testUsername(1) + "+news@" + testHost
+	w.setSenderRule(1, "", "", "example.com", true)
+	w.setSenderRule(1, "", "", "spammer@example.com", false)
+	w.setSenderRule(1, testUsername(1)+"+news", testHost, "newsletter.org", true)
+	for _, c := range []struct {
+		address string
+		sender  string
+		allowed bool
+	}{
+		{address, "alice@example.com", true},
+		{address, "alice@mail.example.com", true},
+		{address, "spammer@example.com", false},
+		{address, "bob@other.org", false},
+		{address, "digest@newsletter.org", false},
+		// rules of the address without a tag apply to its tags
+		{tagged, "alice@example.com", true},
+		{tagged, "spammer@example.com", false},
+		{tagged, "digest@newsletter.org", true},
+		{tagged, "bob@other.org", false},
+	} {
+		if allowed := w.senderAllowed(1, c.address, []string{c.sender}, true); allowed != c.allowed {
+			t.Errorf("%s to %s: got %v, expected %v", c.sender, c.address, allowed, c.allowed)
+		}
+	}
+	if !w.senderAllowed(1, address, []string{"bob@other.org"}, false) {
+		t.Error("expected allow rules to be ignored when not checked")
+	}
+	if w.senderAllowed(1, address, []string{"spammer@example.com"}, false) {
+		t.Error("expected block rules to apply when allow rules are not checked")
+	}
+	// the envelope sender and the header sender are both checked
+	if w.senderAllowed(1, address, []string{"alice@example.com", "spammer@example.com"}, true) {
+		t.Error("expected a blocked header sender to win over an allowed envelope sender")
+	}
+	w.setSenderRule(1, "", "", "spammer@example.com", true)
+	if !w.senderAllowed(1, address, []string{"spammer@example.com"}, true) {
+		t.Error("expected a rule for the same sender to be replaced")
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	addTestAddresses(w, 2)
+	w.mustExec("insert into users (chat_id) values (1)")
+	first := testUsername(1) + "@" + testHost
+	w.setSenderRule(1, testUsername(1), testHost, "spammer@example.com", false)
+	if err := w.checkSender(1, []string{first}, []string{"spammer@example.com"}, true); err != errorBlocked {
+		t.Errorf("expected the sender to be blocked, got %v", err)
+	}
+	if err := w.checkSender(1, []string{first, "other@" + testHost}, []string{"spammer@example.com"}, true); err != nil {
+		t.Errorf("expected the email to pass for an address without rules, got %v", err)
+	}
+	if err := w.checkSender(2, []string{testUsername(2) + "@" + testHost}, []string{"spammer@example.com"}, true); err != nil {
+		t.Errorf("expected rules to be per chat, got %v", err)
+	}
+	w.blocklist(1, "discard")
+	if err := w.checkSender(1, []string{first}, []string{"spammer@example.com"}, true); err != errorDiscarded {
+		t.Errorf("expected the email to be discarded, got %v", err)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Chunk boundaries in the order of preference
+const (
+	breakParagraph = iota
+	breakLine
+	breakSentence
+	breakWord
+	breakCount
+)
+
+// htmlUnit is a tag, an entity or a character of Telegram HTML
+type htmlUnit struct {
+	s       string
+	tag     string
+	closing bool
+	length  int
+}
+
+// utf16Length returns the length of the text in UTF-16 code units as Telegram counts it
+func utf16Length(s string) (n int) {
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return
+}
+
+// htmlUnits splits Telegram HTML into units, tags do not count towards the message length
+func htmlUnits(s string) (units []htmlUnit) {
+	for len(s) > 0 {
+		switch s[0] {
+		case '<':
+			end := strings.IndexByte(s, '>')
+			if end == -1 {
+				end = len(s) - 1
+			}
+			raw := s[:end+1]
+			name := strings.TrimPrefix(strings.Trim(raw, "<>"), "/")
+			if idx := strings.IndexAny(name, " \t\n"); idx != -1 {
+				name = name[:idx]
+			}
+			units = append(units, htmlUnit{s: raw, tag: name, closing: strings.HasPrefix(raw, "</")})
+			s = s[end+1:]
+		case '&':
+			end := strings.IndexByte(s, ';')
+			if end == -1 || end > 10 {
+				end = 0
+			}
+			units = append(units, htmlUnit{s: s[:end+1], length: utf16Length(html.UnescapeString(s[:end+1]))})
+			s = s[end+1:]
+		default:
+			_, size := utf8.DecodeRuneInString(s)
+			units = append(units, htmlUnit{s: s[:size], length: utf16Length(s[:size])})
+			s = s[size:]
+		}
+	}
+	return
+}
+
+// breakAfter returns the kind of the chunk boundary after the unit or -1
+func breakAfter(units []htmlUnit, i int) int {
+	switch units[i].s {
+	case "\n":
+		for j := i - 1; j >= 0; j-- {
+			if units[j].tag == "" {
+				if units[j].s == "\n" {
+					return breakParagraph
+				}
+				break
+			}
+		}
+		return breakLine
+	case " ":
+		for j := i - 1; j >= 0; j-- {
+			if units[j].tag == "" {
+				if s := units[j].s; s == "." || s == "!" || s == "?" || s == "…" {
+					return breakSentence
+				}
+				break
+			}
+		}
+		return breakWord
+	}
+	return -1
+}
+
+func closingTags(stack []htmlUnit) string {
+	var b strings.Builder
+	for i := len(stack) - 1; i >= 0; i-- {
+		b.WriteString("</" + stack[i].tag + ">")
+	}
+	return b.String()
+}
+
+func openingTags(stack []htmlUnit) string {
+	var b strings.Builder
+	for _, t := range stack {
+		b.WriteString(t.s)
+	}
+	return b.String()
+}
+
+type chunkBoundary struct {
+	end    int
+	length int
+	stack  []htmlUnit
+}
+
+// chunkHTML splits Telegram HTML into chunks of at most chunkSize UTF-16 code units of text,
+// it prefers paragraph, then line, then sentence, then word boundaries,
+// tags open at a boundary are closed and re-opened in the next chunk
+func chunkHTML(s string, chunkSize int) (chunks []string) {
+	units := htmlUnits(s)
+	var stack []htmlUnit
+	for start := 0; start < len(units); {
+		current := stack
+		length := 0
+		end := start
+		var boundaries [breakCount]chunkBoundary
+		for end < len(units) {
+			u := units[end]
+			if end > start && length+u.length > chunkSize {
+				break
+			}
+			if u.tag != "" && u.closing && len(current) > 0 {
+				current = current[:len(current)-1]
+			} else if u.tag != "" && !u.closing {
+				current = append(current[:len(current):len(current)], u)
+			}
+			length += u.length
+			end++
+			if kind := breakAfter(units, end-1); kind != -1 {
+				boundaries[kind] = chunkBoundary{end: end, length: length, stack: current}
+			}
+		}
+		if end < len(units) {
+			found := false
+			for _, minLength := range []int{chunkSize / 2, 1} {
+				for _, b := range boundaries {
+					if !found && b.end > start && b.length >= minLength {
+						end, current, found = b.end, b.stack, true
+					}
+				}
+			}
+		}
+		var b strings.Builder
+		b.WriteString(openingTags(stack))
+		visible := false
+		for _, u := range units[start:end] {
+			b.WriteString(u.s)
+			visible = visible || u.tag == "" && strings.TrimSpace(u.s) != ""
+		}
+		b.WriteString(closingTags(current))
+		if visible {
+			chunks = append(chunks, strings.TrimSpace(b.String()))
+		}
+		stack, start = current, end
+	}
+	return
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChunkHTML(t *testing.T) {
+	cases := []struct {
+		name   string
+		text   string
+		size   int
+		chunks []string
+	}{
+		{"fits", "Hello, <b>world</b>!", 100, []string{"Hello, <b>world</b>!"}},
+		{"empty", "", 10, nil},
+		{"whitespace only", "  \n\n  ", 3, nil},
+		{"paragraph", "aaaa\n\nbbbb cccc", 10, []string{"aaaa", "bbbb cccc"}},
+		{"line", "line one\nline two\nline three", 12, []string{"line one", "line two", "line three"}},
+		{"sentence", "One two. Three four", 12, []string{"One two.", "Three four"}},
+		{"word", "alpha beta gamma", 11, []string{"alpha beta", "gamma"}},
+		{"hard cut", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"surrogate pairs", "😀😀😀", 4, []string{"😀😀", "😀"}},
+		{"surrogate pair is not split", "a😀b", 2, []string{"a", "😀", "b"}},
+		{"entities count as one", "&amp;&amp;&amp;", 2, []string{"&amp;&amp;", "&amp;"}},
+		{"tags do not count", "<b>ab</b><i>cd</i>", 4, []string{"<b>ab</b><i>cd</i>"}},
+		{"nested tags re-opened", "<b>aaa <i>bbb ccc</i></b>", 8, []string{"<b>aaa <i>bbb </i></b>", "<b><i>ccc</i></b>"}},
+		{
+			"link re-opened with attributes",
+			`<a href="https://example.com">aaaa bbbb</a>`,
+			5,
+			[]string{`<a href="https://example.com">aaaa </a>`, `<a href="https://example.com">bbbb</a>`},
+		},
+		{"pre hard cut", "<pre>code code</pre>", 4, []string{"<pre>code</pre>", "<pre>code</pre>"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			chunks := chunkHTML(c.text, c.size)
+			if !reflect.DeepEqual(chunks, c.chunks) {
+				t.Errorf("got %q, expected %q", chunks, c.chunks)
+			}
+			checkChunks(t, c.text, c.size, chunks)
+		})
+	}
+}
+
+// visibleText returns the text of Telegram HTML as Telegram shows it
+func visibleText(s string) string {
+	var b strings.Builder
+	for _, u := range htmlUnits(s) {
+		if u.tag == "" {
+			b.WriteString(html.UnescapeString(u.s))
+		}
+	}
+	return b.String()
+}
+
+func withoutSpaces(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// checkChunks checks chunk lengths, tag balance and that no text is lost
+func checkChunks(t *testing.T, text string, size int, chunks []string) {
+	t.Helper()
+	var all strings.Builder
+	for _, c := range chunks {
+		if n := utf16Length(visibleText(c)); n > size {
+			t.Errorf("chunk %q has %d UTF-16 code units, the limit is %d", c, n, size)
+		}
+		var stack []string
+		for _, u := range htmlUnits(c) {
+			switch {
+			case u.tag == "":
+			case !u.closing:
+				stack = append(stack, u.tag)
+			case len(stack) == 0 || stack[len(stack)-1] != u.tag:
+				t.Fatalf("chunk %q closes %s unexpectedly", c, u.tag)
+			default:
+				stack = stack[:len(stack)-1]
+			}
+		}
+		if len(stack) > 0 {
+			t.Errorf("chunk %q leaves %v open", c, stack)
+		}
+		if strings.TrimSpace(visibleText(c)) == "" {
+			t.Errorf("chunk %q has no visible text", c)
+		}
+		all.WriteString(visibleText(c))
+	}
+	if withoutSpaces(all.String()) != withoutSpaces(visibleText(text)) {
+		t.Errorf("text is lost, chunks %q of %q", chunks, text)
+	}
+}
+
+func FuzzChunkHTML(f *testing.F) {
+	f.Add("aaaa\n\nbbbb cccc", uint16(10))
+	f.Add("<p>One two. Three <b>four <i>five</i></b></p>", uint16(6))
+	f.Add("😀😀😀 &amp; <a href=\"https://example.com\">link text</a>", uint16(3))
+	f.Add("<ul><li>one</li><li>two <code>x &lt; y</code></li></ul><pre>a\nb</pre>", uint16(4))
+	f.Fuzz(func(t *testing.T, src string, n uint16) {
+		// telegramHTML turns arbitrary input into the well-formed HTML chunkHTML receives,
+		// a surrogate pair needs at least two code units
+		text := telegramHTML(src)
+		size := int(n%500) + 2
+		checkChunks(t, text, size, chunkHTML(text, size))
+	})
+}
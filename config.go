@@ -6,30 +6,67 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 type config struct {
-	BotName               string `json:"bot_name"`                // the name of the bot
-	MailAddress           string `json:"mail_address"`            // the address to listen to incoming mail
-	MaxSize               int    `json:"max_size"`                // the maximum email size in bytes
-	MaxTextChunkSize      int    `json:"max_text_chunk_size"`     // the maximum text chunk size
-	ListenPath            string `json:"listen_path"`             // the path excluding domain to listen to, the good choice is "/your-telegram-bot-token"
-	ListenAddress         string `json:"listen_address"`          // the address to listen to incoming telegram messages
-	Host                  string `json:"host"`                    // the host name for the email addresses and the webhook
-	BotToken              string `json:"bot_token"`               // your telegram bot token
-	FreeEmails            int    `json:"free_emails"`             // number of free emails on first start
-	ReferralBonus         int    `json:"referral_bonus"`          // number of emails for a referrer
-	FollowerBonus         int    `json:"follower_bonus"`          // number of emails for a new user registered by a referral link
-	TimeoutSeconds        int    `json:"timeout_seconds"`         // HTTP timeout
-	AdminID               int64  `json:"admin_id"`                // admin telegram ID
-	DBPath                string `json:"db_path"`                 // path to the database
-	Debug                 bool   `json:"debug"`                   // debug mode
-	StatPassword          string `json:"stat_password"`           // password for statistics
-	Certificate           string `json:"certificate"`             // certificate path for STARTTLS
-	CertificateKey        string `json:"certificate_key"`         // certificate key path for STARTTLS
-	LimitIntervalSeconds  int    `json:"limit_interval_seconds"`  // the limit interval
-	LimitWindowSeconds    int    `json:"limit_window_seconds"`    // the limit window
-	BlockedBackoffSeconds int    `json:"blocked_backoff_seconds"` // a backoff if user blocked the bot
+	BotName                  string            `json:"bot_name"`                   // the name of the bot
+	MailAddress              string            `json:"mail_address"`               // the address to listen to incoming mail
+	MaxSize                  int               `json:"max_size"`                   // the maximum email size in bytes
+	MaxTextChunkSize         int               `json:"max_text_chunk_size"`        // the maximum text chunk size
+	ListenPath               string            `json:"listen_path"`                // the path excluding domain to listen to, the good choice is "/your-telegram-bot-token"
+	ListenAddress            string            `json:"listen_address"`             // the address to listen to incoming telegram messages
+	Host                     string            `json:"host"`                       // the host name for the email addresses and the webhook
+	Hosts                    []string          `json:"hosts"`                      // additional host names for the email addresses
+	BotToken                 string            `json:"bot_token"`                  // your telegram bot token
+	BotAPIEndpoint           string            `json:"bot_api_endpoint"`           // the Bot API URL format with the token and the method placeholders, the official one if empty
+	FreeEmails               int               `json:"free_emails"`                // number of free emails on first start
+	ReferralBonus            int               `json:"referral_bonus"`             // number of emails for a referrer
+	FollowerBonus            int               `json:"follower_bonus"`             // number of emails for a new user registered by a referral link
+	VanityAllowance          int               `json:"vanity_allowance"`           // number of addresses with chosen names for a new user, choosing names is disabled if zero
+	VanityReferralBonus      int               `json:"vanity_referral_bonus"`      // number of addresses with chosen names for a referrer
+	TimeoutSeconds           int               `json:"timeout_seconds"`            // HTTP timeout
+	AdminID                  int64             `json:"admin_id"`                   // admin telegram ID
+	DBPath                   string            `json:"db_path"`                    // path to the database
+	Debug                    bool              `json:"debug"`                      // debug mode
+	StatPassword             string            `json:"stat_password"`              // password for statistics
+	Certificate              string            `json:"certificate"`                // certificate path for STARTTLS
+	CertificateKey           string            `json:"certificate_key"`            // certificate key path for STARTTLS
+	HostCertificates         []hostCertificate `json:"host_certificates"`          // certificates for additional hosts selected by SNI
+	DKIMKeys                 []dkimKey         `json:"dkim_keys"`                  // keys signing outgoing emails
+	LimitIntervalSeconds     int               `json:"limit_interval_seconds"`     // the limit interval
+	LimitWindowSeconds       int               `json:"limit_window_seconds"`       // the limit window
+	BlockedBackoffSeconds    int               `json:"blocked_backoff_seconds"`    // a backoff if user blocked the bot
+	SpoolRetrySeconds        int               `json:"spool_retry_seconds"`        // the initial delay before retrying a failed delivery, it doubles with every attempt
+	SpoolExpirySeconds       int               `json:"spool_expiry_seconds"`       // how long undelivered emails are kept in the spool
+	SpoolHoldSeconds         int               `json:"spool_hold_seconds"`         // how long an undelivered email holds later emails of the chat, they are delivered out of order after that
+	SpoolSecret              string            `json:"spool_secret"`               // the secret encrypting emails in the spool
+	DeliveryWorkers          int               `json:"delivery_workers"`           // the number of chats delivered to concurrently
+	SMTPRelay                string            `json:"smtp_relay"`                 // the host:port of the SMTP server sending replies, replies are disabled if empty
+	SMTPRelayUsername        string            `json:"smtp_relay_username"`        // the username for the SMTP server
+	SMTPRelayPassword        string            `json:"smtp_relay_password"`        // the password for the SMTP server
+	SMTPRelayAllowPlaintext  bool              `json:"smtp_relay_allow_plaintext"` // send emails even if the SMTP server does not offer STARTTLS
+	ReplyRetentionSeconds    int               `json:"reply_retention_seconds"`    // how long delivered emails can be replied to
+	ThreadRetentionSeconds   int               `json:"thread_retention_seconds"`   // how long emails are remembered for threading, threading is disabled if zero
+	ActionsExpirySeconds     int               `json:"actions_expiry_seconds"`     // how long buttons of delivered emails work and emails can be marked as spam, both are disabled if zero
+	SpamSecret               string            `json:"spam_secret"`                // the secret hashing words for the spam filter, changing it resets what the filter learned
+	DigestSecret             string            `json:"digest_secret"`              // the secret encrypting emails waiting for digests, digests are disabled if empty
+	DigestRetentionSeconds   int               `json:"digest_retention_seconds"`   // how long emails of a sent digest can be expanded
+	AttachmentLinkThreshold  int               `json:"attachment_link_threshold"`  // attachments larger than this size in bytes are delivered as download links, disabled if zero
+	BlobDir                  string            `json:"blob_dir"`                   // the directory for encrypted attachments served by download links
+	DownloadSecret           string            `json:"download_secret"`            // the secret signing download links and encrypting attachments
+	DownloadExpirySeconds    int               `json:"download_expiry_seconds"`    // how long download links work
+	DNSServer                string            `json:"dns_server"`                 // the DNS server address, the system resolver is used if empty
+	SPFPolicy                string            `json:"spf_policy"`                 // "annotate", "tag" or "reject", SPF is not checked if empty
+	VerifyDKIM               bool              `json:"verify_dkim"`                // verify DKIM signatures and show the signing domain
+	DNSBLZones               []dnsblZone       `json:"dnsbl_zones"`                // DNS blocklist zones to query for the client IP
+	DNSBLRejectScore         int               `json:"dnsbl_reject_score"`         // reject clients with this total DNSBL score or higher, never reject if zero
+	DNSBLCacheSeconds        int               `json:"dnsbl_cache_seconds"`        // how long DNSBL results are cached
+	GreylistDelaySeconds     int               `json:"greylist_delay_seconds"`     // the delay before a retry is accepted, greylisting is disabled if zero
+	GreylistExpirySeconds    int               `json:"greylist_expiry_seconds"`    // how long an unconfirmed triplet is kept
+	GreylistWhitelistSeconds int               `json:"greylist_whitelist_seconds"` // how long confirmed triplets and learned whitelist entries are kept
+	SubaddressSeparator      string            `json:"subaddress_separator"`       // "+" or "-" to accept tagged addresses like username+tag@host, disabled if empty
+	DMARCPolicy              string            `json:"dmarc_policy"`               // "record" to apply published policies, "none", "quarantine" or "reject" to override them, DMARC is not checked if empty
 }
 
 func readConfig(path string) *config {
@@ -71,6 +108,9 @@ func checkConfig(cfg *config) error {
 	if cfg.BotToken == "" {
 		return errors.New("configure bot_token")
 	}
+	if cfg.BotAPIEndpoint != "" && strings.Count(cfg.BotAPIEndpoint, "%s") != 2 {
+		return errors.New("bot_api_endpoint should contain %s for the token and %s for the method")
+	}
 	if cfg.TimeoutSeconds == 0 {
 		return errors.New("configure timeout_seconds")
 	}
@@ -92,12 +132,46 @@ func checkConfig(cfg *config) error {
 	if cfg.FollowerBonus == 0 {
 		return errors.New("configure follower_bonus")
 	}
+	if cfg.SpamSecret == "" {
+		return errors.New("configure spam_secret")
+	}
 	if cfg.Certificate == "" {
 		return errors.New("configure certificate")
 	}
 	if cfg.CertificateKey == "" {
 		return errors.New("configure certificate_key")
 	}
+	hosts := map[string]bool{cfg.Host: true}
+	for _, h := range cfg.Hosts {
+		if h == "" || hosts[h] || h != strings.ToLower(h) {
+			return errors.New("hosts should be lowercase and distinct from host and each other")
+		}
+		hosts[h] = true
+	}
+	certificateHosts := make(map[string]bool)
+	for _, h := range cfg.HostCertificates {
+		if h.Host == "" || h.Certificate == "" || h.CertificateKey == "" {
+			return errors.New("configure host, certificate and certificate_key for every host_certificates entry")
+		}
+		if !hosts[h.Host] || h.Host == cfg.Host || certificateHosts[h.Host] {
+			return errors.New("every host_certificates entry should be for a distinct host from hosts")
+		}
+		certificateHosts[h.Host] = true
+	}
+	if cfg.SMTPRelay != "" && cfg.ReplyRetentionSeconds == 0 {
+		return errors.New("configure reply_retention_seconds")
+	}
+	if cfg.DigestSecret != "" && cfg.DigestRetentionSeconds == 0 {
+		return errors.New("configure digest_retention_seconds")
+	}
+	if cfg.AttachmentLinkThreshold > 0 && (cfg.BlobDir == "" || cfg.DownloadSecret == "" || cfg.DownloadExpirySeconds == 0) {
+		return errors.New("configure blob_dir, download_secret and download_expiry_seconds")
+	}
+	for _, k := range cfg.DKIMKeys {
+		if k.Domain == "" || k.Selector == "" || k.PrivateKey == "" {
+			return errors.New("configure domain, selector and private_key for every dkim_keys entry")
+		}
+	}
 	if cfg.LimitIntervalSeconds == 0 {
 		return errors.New("configure limit_interval_seconds")
 	}
@@ -107,5 +181,49 @@ func checkConfig(cfg *config) error {
 	if cfg.BlockedBackoffSeconds == 0 {
 		return errors.New("configure blocked_backoff_seconds")
 	}
+	if cfg.SpoolRetrySeconds == 0 {
+		return errors.New("configure spool_retry_seconds")
+	}
+	if cfg.SpoolExpirySeconds == 0 {
+		return errors.New("configure spool_expiry_seconds")
+	}
+	if cfg.SpoolHoldSeconds == 0 {
+		return errors.New("configure spool_hold_seconds")
+	}
+	if cfg.SpoolSecret == "" {
+		return errors.New("configure spool_secret")
+	}
+	if cfg.DeliveryWorkers <= 0 {
+		return errors.New("configure delivery_workers")
+	}
+	switch cfg.SPFPolicy {
+	case "", spfPolicyAnnotate, spfPolicyTag, spfPolicyReject:
+	default:
+		return errors.New("spf_policy should be annotate, tag or reject")
+	}
+	for _, z := range cfg.DNSBLZones {
+		if z.Zone == "" || z.Score <= 0 {
+			return errors.New("configure zone and positive score for every dnsbl_zones entry")
+		}
+	}
+	if len(cfg.DNSBLZones) > 0 && cfg.DNSBLCacheSeconds == 0 {
+		return errors.New("configure dnsbl_cache_seconds")
+	}
+	if cfg.GreylistDelaySeconds > 0 && cfg.GreylistExpirySeconds == 0 {
+		return errors.New("configure greylist_expiry_seconds")
+	}
+	if cfg.GreylistDelaySeconds > 0 && cfg.GreylistWhitelistSeconds == 0 {
+		return errors.New("configure greylist_whitelist_seconds")
+	}
+	switch cfg.SubaddressSeparator {
+	case "", "+", "-":
+	default:
+		return errors.New("subaddress_separator should be + or -")
+	}
+	switch cfg.DMARCPolicy {
+	case "", dmarcPolicyRecord, dmarcPolicyNone, dmarcPolicyQuarantine, dmarcPolicyReject:
+	default:
+		return errors.New("dmarc_policy should be record, none, quarantine or reject")
+	}
 	return nil
 }
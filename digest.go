@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// digestPageSize is the number of emails listed in one digest message
+const digestPageSize = 10
+
+// digestFieldSize is the maximum length of the subject and the sender in a digest
+const digestFieldSize = 100
+
+const (
+	digestOff    = "off"
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+)
+
+// digestedEmail is what is needed to restore a digested email, it is stored encrypted
+type digestedEmail struct {
+	Data        []byte             `json:"data"`
+	From        string             `json:"from"`
+	IP          string             `json:"ip"`
+	Recipients  map[int64][]string `json:"recipients"`
+	AuthLines   []string           `json:"auth_lines"`
+	DMARCAction string             `json:"dmarc_action"`
+}
+
+func (w *worker) digestCipher() cipher.AEAD {
+	return newAEAD(secretKey(w.cfg.DigestSecret, "digest"))
+}
+
+// nextDigestTime returns the start of the next hour or the next day in the time zone
+func nextDigestTime(schedule string, now time.Time, location *time.Location) int64 {
+	t := now.In(location)
+	if schedule == digestDaily {
+		return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, location).Unix()
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, location).Unix()
+}
+
+// digestAddress returns the address collecting the email into a digest,
+// the email is delivered immediately if any of its addresses has no digest
+func (w *worker) digestAddress(chatID int64, addresses []string) (username string, host string, ok bool) {
+	if w.cfg.DigestSecret == "" || len(addresses) == 0 {
+		return "", "", false
+	}
+	for _, a := range addresses {
+		u, _, h, found := w.chatAddress(chatID, a)
+		if !found {
+			return "", "", false
+		}
+		query := w.db.QueryRow("select count(*) from addresses where username=? and host=? and digest<>''", u, h)
+		if singleInt(query) == 0 {
+			return "", "", false
+		}
+		if username == "" {
+			username, host = u, h
+		}
+	}
+	return username, host, true
+}
+
+// addToDigest stores the email encrypted until the digest of the address is sent
+func (w *worker) addToDigest(chatID int64, username string, host string, messageID string, e *env) error {
+	ip := ""
+	if e.ip != nil {
+		ip = e.ip.String()
+	}
+	data, err := json.Marshal(digestedEmail{
+		Data:        e.data,
+		From:        e.from.Email(),
+		IP:          ip,
+		Recipients:  map[int64][]string{chatID: e.recipients[chatID]},
+		AuthLines:   e.authLines,
+		DMARCAction: e.dmarcAction,
+	})
+	checkErr(err)
+	sealed, err := seal(w.digestCipher(), data, []byte(strconv.FormatInt(chatID, 10)))
+	if err != nil {
+		return err
+	}
+	w.mustExec(
+		"insert into digest_emails (chat_id, username, host, data, created, sent) values (?,?,?,?,?,0)",
+		chatID,
+		username,
+		host,
+		sealed,
+		time.Now().Unix())
+	w.mustExec("insert into delivered_ids (chat_id, message_id) values (?,?)", chatID, messageID)
+	return nil
+}
+
+// digestedEnv decrypts and restores the digested email
+func (w *worker) digestedEnv(chatID int64, sealed []byte) (*env, error) {
+	data, err := unseal(w.digestCipher(), sealed, []byte(strconv.FormatInt(chatID, 10)))
+	if err != nil {
+		return nil, err
+	}
+	var d digestedEmail
+	if err := json.Unmarshal(data, &d); err != nil {
+		return nil, err
+	}
+	recipients, err := json.Marshal(d.Recipients)
+	checkErr(err)
+	authLines, err := json.Marshal(d.AuthLines)
+	checkErr(err)
+	return w.restoreEnvelope(spooledEmail{
+		data:        d.Data,
+		from:        d.From,
+		ip:          d.IP,
+		recipients:  string(recipients),
+		authLines:   string(authLines),
+		dmarcAction: d.DMARCAction,
+	})
+}
+
+func truncateField(s string) string {
+	if r := []rune(s); len(r) > digestFieldSize {
+		return string(r[:digestFieldSize-1]) + "…"
+	}
+	return s
+}
+
+type digestEntry struct {
+	id      int64
+	subject string
+	sender  string
+}
+
+// sendDigest sends pending emails of the address as digest messages with buttons to expand them
+func (w *worker) sendDigest(chatID int64, username string, host string) bool {
+	query, err := w.db.Query(
+		"select id, data from digest_emails where chat_id=? and username=? and host=? and sent=0 order by id",
+		chatID,
+		username,
+		host)
+	checkErr(err)
+	var entries []digestEntry
+	var broken []int64
+	for query.Next() {
+		var id int64
+		var data []byte
+		checkErr(query.Scan(&id, &data))
+		e, err := w.digestedEnv(chatID, data)
+		if err != nil {
+			lerr("cannot restore digested email %d, %v", id, err)
+			broken = append(broken, id)
+			continue
+		}
+		entries = append(entries, digestEntry{
+			id:      id,
+			subject: e.mime.GetHeader("Subject"),
+			sender:  e.mime.GetHeader("From"),
+		})
+	}
+	checkErr(query.Close())
+	for _, id := range broken {
+		w.mustExec("delete from digest_emails where id=?", id)
+	}
+	expires := time.Now().Unix() + int64(w.cfg.DigestRetentionSeconds)
+	for page := 0; page*digestPageSize < len(entries); page++ {
+		pageEntries := entries[page*digestPageSize:]
+		if len(pageEntries) > digestPageSize {
+			pageEntries = pageEntries[:digestPageSize]
+		}
+		lines := []string{fmt.Sprintf("<b>Digest for %s@%s</b>\nEmails: %d", html.EscapeString(username), html.EscapeString(host), len(entries))}
+		var rows [][]tg.InlineKeyboardButton
+		var row []tg.InlineKeyboardButton
+		for i, entry := range pageEntries {
+			n := page*digestPageSize + i + 1
+			lines = append(lines, fmt.Sprintf(
+				"\n%d. <b>%s</b>\n%s",
+				n,
+				html.EscapeString(truncateField(entry.subject)),
+				html.EscapeString(truncateField(entry.sender))))
+			row = append(row, tg.NewInlineKeyboardButtonData(strconv.Itoa(n), w.callbackData(chatID, actionExpand, entry.id, expires)))
+			if len(row) == 5 {
+				rows = append(rows, row)
+				row = nil
+			}
+		}
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+		msg := textMessage(chatID, page == 0 && !w.isQuiet(chatID, time.Now()), parseHTML, strings.Join(lines, "\n"))
+		msg.ReplyMarkup = tg.NewInlineKeyboardMarkup(rows...)
+		if _, err := w.sendMessage(msg, priorityDelivery); err != nil {
+			return false
+		}
+		for _, entry := range pageEntries {
+			w.mustExec("update digest_emails set sent=? where id=?", time.Now().Unix(), entry.id)
+		}
+	}
+	return true
+}
+
+// sendDigests sends due digests, pending emails of addresses with digests turned off are sent at once
+func (w *worker) sendDigests() {
+	now := time.Now()
+	query, err := w.db.Query(`
+		select chat_id, username, host, digest from addresses
+		where (digest<>'' and next_digest<=?)
+		or (digest='' and exists (
+			select 1 from digest_emails
+			where digest_emails.username=addresses.username and digest_emails.host=addresses.host and sent=0))`,
+		now.Unix())
+	checkErr(err)
+	var due []address
+	var schedules []string
+	for query.Next() {
+		var a address
+		var schedule string
+		checkErr(query.Scan(&a.chatID, &a.username, &a.host, &schedule))
+		due = append(due, a)
+		schedules = append(schedules, schedule)
+	}
+	checkErr(query.Close())
+	for i, a := range due {
+		if !w.sendDigest(a.chatID, a.username, a.host) {
+			continue
+		}
+		if schedules[i] != "" {
+			w.mustExec(
+				"update addresses set next_digest=? where username=? and host=?",
+				nextDigestTime(schedules[i], now, w.chatLocation(a.chatID)),
+				a.username,
+				a.host)
+		}
+	}
+}
+
+// rescheduleDigests moves next digests of the chat to the time zone
+func (w *worker) rescheduleDigests(chatID int64, location *time.Location) {
+	now := time.Now()
+	for _, schedule := range []string{digestHourly, digestDaily} {
+		w.mustExec(
+			"update addresses set next_digest=? where chat_id=? and digest=?",
+			nextDigestTime(schedule, now, location),
+			chatID,
+			schedule)
+	}
+}
+
+// purgeDigests removes digested emails that cannot be expanded anymore
+func (w *worker) purgeDigests() {
+	w.mustExec(
+		"delete from digest_emails where sent>0 and sent<?",
+		time.Now().Unix()-int64(w.cfg.DigestRetentionSeconds))
+	w.mustExec(`
+		delete from digest_emails where not exists (
+			select 1 from addresses
+			where addresses.chat_id=digest_emails.chat_id
+			and addresses.username=digest_emails.username
+			and addresses.host=digest_emails.host)`)
+}
+
+// expandDigestEmail sends the full digested email, spam checks apply as on delivery
+func (w *worker) expandDigestEmail(q *tg.CallbackQuery, id int64) {
+	chatID := q.Message.Chat.ID
+	query, err := w.db.Query("select data from digest_emails where chat_id=? and id=?", chatID, id)
+	checkErr(err)
+	var data []byte
+	found := query.Next()
+	if found {
+		checkErr(query.Scan(&data))
+	}
+	checkErr(query.Close())
+	if !found {
+		w.answerCallback(q.ID, "This button has expired")
+		return
+	}
+	e, err := w.digestedEnv(chatID, data)
+	if err != nil {
+		lerr("cannot restore digested email %d, %v", id, err)
+		w.answerCallback(q.ID, "Cannot restore the email")
+		return
+	}
+	w.answerCallback(q.ID, "")
+	// the email was recorded as delivered when it was digested
+	if err := w.forwardToChat(chatID, e.mime.GetHeader("Message-ID"), emailHeader(e), e); err != nil {
+		lerr("cannot expand digested email %d, %v", id, err)
+	}
+}
+
+// digest sets the digest schedule of the address
+func (w *worker) digest(chatID int64, arguments string) {
+	if w.cfg.DigestSecret == "" {
+		_ = w.sendText(chatID, false, parseRaw, "Digests are disabled")
+		return
+	}
+	parts := strings.Fields(strings.ToLower(arguments))
+	if len(parts) != 2 {
+		_ = w.sendText(chatID, false, parseRaw, "Command format: /digest <email@boxt.us> hourly|daily|off")
+		return
+	}
+	username, _, host, ok := w.chatAddress(chatID, parts[0])
+	if !ok {
+		_ = w.sendText(chatID, false, parseRaw, "Address not found")
+		return
+	}
+	switch schedule := parts[1]; schedule {
+	case digestHourly, digestDaily:
+		// an address of a catch-all domain is stored once the user changes it
+		w.insertAddress(chatID, username, host)
+		w.mustExec(
+			"update addresses set digest=?, next_digest=? where username=? and host=?",
+			schedule,
+			nextDigestTime(schedule, time.Now(), w.chatLocation(chatID)),
+			username,
+			host)
+	case digestOff:
+		w.mustExec("update addresses set digest='', next_digest=0 where username=? and host=?", username, host)
+	default:
+		_ = w.sendText(chatID, false, parseRaw, "Command format: /digest <email@boxt.us> hourly|daily|off")
+		return
+	}
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
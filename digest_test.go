@@ -0,0 +1,105 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNextDigestTime(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kolkata, err := time.LoadLocation("Asia/Kolkata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		schedule string
+		now      string
+		location *time.Location
+		next     string
+	}{
+		{digestDaily, "2024-05-10T21:30:00Z", time.UTC, "2024-05-11T00:00:00Z"},
+		{digestDaily, "2024-05-10T21:30:00Z", berlin, "2024-05-10T22:00:00Z"},
+		{digestDaily, "2024-05-10T22:30:00Z", berlin, "2024-05-11T22:00:00Z"},
+		// the day clocks go forward is 23 hours long
+		{digestDaily, "2024-03-30T23:30:00Z", berlin, "2024-03-31T22:00:00Z"},
+		{digestHourly, "2024-05-10T21:10:00Z", time.UTC, "2024-05-10T22:00:00Z"},
+		{digestHourly, "2024-05-10T21:10:00Z", kolkata, "2024-05-10T21:30:00Z"},
+		{digestDaily, "2024-05-10T21:10:00Z", kolkata, "2024-05-11T18:30:00Z"},
+	}
+	for _, c := range cases {
+		now, _ := time.Parse(time.RFC3339, c.now)
+		next, _ := time.Parse(time.RFC3339, c.next)
+		if n := nextDigestTime(c.schedule, now, c.location); n != next.Unix() {
+			t.Errorf("%s digest at %s in %s: got %s, expected %s", c.schedule, c.now, c.location, time.Unix(n, 0).UTC().Format(time.RFC3339), c.next)
+		}
+	}
+}
+
+// TestDigestTimeZone checks that daily digests follow the time zone set with /quiet
+func TestDigestTimeZone(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.DigestSecret = "digest secret"
+	w.cfg.DigestRetentionSeconds = 3600
+	addTestAddresses(w, 2)
+	nextDigest := func(chatID int) int64 {
+		return int64(singleInt(w.db.QueryRow("select next_digest from addresses where chat_id=?", chatID)))
+	}
+	w.processIncomingCommand(1, "digest", testUsername(1)+"@"+testHost+" daily", nil)
+	if next := nextDigest(1); next != nextDigestTime(digestDaily, time.Now(), time.UTC) {
+		t.Errorf("expected a digest at midnight UTC without a time zone, got %v", time.Unix(next, 0).UTC())
+	}
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.processIncomingCommand(1, "quiet", "23:00-08:00 Asia/Tokyo", nil)
+	if next := time.Unix(nextDigest(1), 0).In(tokyo); next.Hour() != 0 || next.Minute() != 0 || !next.After(time.Now()) {
+		t.Errorf("expected the digest to move to midnight in Tokyo, got %v", next)
+	}
+	w.processIncomingCommand(2, "quiet", "23:00-08:00 Asia/Tokyo", nil)
+	w.processIncomingCommand(2, "quiet", "off", nil)
+	w.processIncomingCommand(2, "digest", testUsername(2)+"@"+testHost+" daily", nil)
+	if next := time.Unix(nextDigest(2), 0).In(tokyo); next.Hour() != 0 || next.Minute() != 0 {
+		t.Errorf("expected the time zone to be kept after quiet hours are off, got %v", next)
+	}
+}
+
+func TestSendDigest(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.DigestSecret = "digest secret"
+	w.cfg.DigestRetentionSeconds = 3600
+	addTestAddresses(w, 1)
+	w.processIncomingCommand(1, "digest", testUsername(1)+"@"+testHost+" hourly", nil)
+	addr := serveTestMail(t, w)
+	sendTestEmail(t, addr, 1, 1)
+	sendTestEmail(t, addr, 1, 2)
+	waitFor(t, 5*time.Second, func() bool { return w.spoolSize() == 0 })
+	if n := singleInt(w.db.QueryRow("select count(*) from digest_emails where sent=0")); n != 2 {
+		t.Fatalf("expected both emails to wait for the digest, got %d", n)
+	}
+	w.sendDigests()
+	if n := len(f.sent("sendMessage")); n != 1 {
+		t.Fatalf("expected no digest before it is due, got %d messages", n)
+	}
+	w.mustExec("update addresses set next_digest=0")
+	w.sendDigests()
+	sent := f.sent("sendMessage")
+	if len(sent) != 2 {
+		t.Fatalf("expected a digest, got %d messages", len(sent))
+	}
+	text := sent[1].form.Get("text")
+	if !strings.Contains(text, "Emails: 2") || !strings.Contains(text, "Test 1") || !strings.Contains(text, "Test 2") {
+		t.Errorf("expected both emails in the digest, got %q", text)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from digest_emails where sent=0")); n != 0 {
+		t.Errorf("expected the emails to be marked as sent, %d left", n)
+	}
+	if next := int64(singleInt(w.db.QueryRow("select next_digest from addresses"))); next <= time.Now().Unix() {
+		t.Error("expected the next digest to be scheduled")
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dkimStatus is a result of a DKIM signature verification as defined in RFC 6376
+type dkimStatus int
+
+const (
+	dkimPass dkimStatus = iota
+	dkimFail
+	dkimTempError
+	dkimPermError
+)
+
+func (s dkimStatus) String() string {
+	switch s {
+	case dkimPass:
+		return "pass"
+	case dkimFail:
+		return "fail"
+	case dkimTempError:
+		return "temperror"
+	case dkimPermError:
+		return "permerror"
+	}
+	return "unknown"
+}
+
+// dkimResult is a result of a single DKIM signature verification
+type dkimResult struct {
+	domain   string
+	selector string
+	status   dkimStatus
+	err      error
+}
+
+const dkimMaxSignatures = 5
+
+var errorDKIMBodyHash = errors.New("body hash did not verify")
+var errorDKIMSignature = errors.New("signature did not verify")
+var errorDKIMExpired = errors.New("signature expired")
+var errorDKIMKeyRevoked = errors.New("key revoked")
+var errorDKIMNoKey = errors.New("no key for signature")
+var errorDKIMKeyUnavailable = errors.New("key unavailable")
+var errorDKIMMalformed = errors.New("malformed signature")
+var errorDKIMUnsupported = errors.New("unsupported algorithm")
+var errorDKIMWeakKey = errors.New("key is too short")
+
+// dkimMinRSABits is the minimum RSA key size verifiers accept as required by RFC 8301
+const dkimMinRSABits = 1024
+
+var dkimWSP = regexp.MustCompile(`[ \t]+`)
+
+// headerField is a raw header field including the trailing CRLF
+type headerField struct {
+	name string
+	raw  string
+}
+
+// splitMessage splits a raw message into header fields and body
+func splitMessage(data []byte) ([]headerField, []byte) {
+	data = normalizeCRLF(data)
+	var headerBytes, body []byte
+	if idx := bytes.Index(data, []byte("\r\n\r\n")); idx != -1 {
+		headerBytes = data[:idx+2]
+		body = data[idx+4:]
+	} else {
+		headerBytes = data
+	}
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(headerBytes), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		idx := strings.IndexByte(line, ':')
+		if idx == -1 {
+			continue
+		}
+		fields = append(fields, headerField{name: strings.TrimSpace(line[:idx]), raw: line})
+	}
+	return fields, body
+}
+
+// normalizeCRLF converts bare LFs into CRLFs
+func normalizeCRLF(data []byte) []byte {
+	if bytes.Count(data, []byte("\n")) == bytes.Count(data, []byte("\r\n")) {
+		return data
+	}
+	result := make([]byte, 0, len(data)+len(data)/40)
+	for i, b := range data {
+		if b == '\n' && (i == 0 || data[i-1] != '\r') {
+			result = append(result, '\r')
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+// parseTagList parses a tag=value list used by DKIM signatures and key records
+func parseTagList(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		idx := strings.IndexByte(part, '=')
+		if idx == -1 {
+			return nil, errorDKIMMalformed
+		}
+		name := strings.TrimSpace(part[:idx])
+		if _, ok := tags[name]; ok {
+			return nil, errorDKIMMalformed
+		}
+		tags[name] = strings.TrimSpace(part[idx+1:])
+	}
+	return tags, nil
+}
+
+func removeFWS(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+func canonicalHeaderRelaxed(f headerField) string {
+	value := f.raw[strings.IndexByte(f.raw, ':')+1:]
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = dkimWSP.ReplaceAllString(value, " ")
+	return strings.ToLower(f.name) + ":" + strings.TrimSpace(value) + "\r\n"
+}
+
+func canonicalHeader(f headerField, relaxed bool) string {
+	if relaxed {
+		return canonicalHeaderRelaxed(f)
+	}
+	return f.raw
+}
+
+func canonicalBody(body []byte, relaxed bool) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+	var b strings.Builder
+	for _, line := range lines {
+		if relaxed {
+			content := strings.TrimSuffix(line, "\r\n")
+			content = dkimWSP.ReplaceAllString(content, " ")
+			content = strings.TrimRight(content, " ")
+			if strings.HasSuffix(line, "\r\n") {
+				content += "\r\n"
+			}
+			line = content
+		}
+		b.WriteString(line)
+	}
+	result := b.String()
+	for strings.HasSuffix(result, "\r\n\r\n") {
+		result = result[:len(result)-2]
+	}
+	if result != "" && !strings.HasSuffix(result, "\r\n") {
+		result += "\r\n"
+	}
+	if result == "\r\n" && relaxed {
+		result = ""
+	}
+	if result == "" && !relaxed {
+		result = "\r\n"
+	}
+	return []byte(result)
+}
+
+// verifyDKIM verifies all DKIM signatures of a raw message
+func verifyDKIM(ctx context.Context, r resolver, data []byte, now time.Time) (results []dkimResult) {
+	fields, body := splitMessage(data)
+	for i, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+		if len(results) == dkimMaxSignatures {
+			break
+		}
+		results = append(results, verifySignature(ctx, r, fields[:i], fields[i], fields[i+1:], body, now))
+	}
+	return
+}
+
+func verifySignature(
+	ctx context.Context,
+	r resolver,
+	before []headerField,
+	signature headerField,
+	after []headerField,
+	body []byte,
+	now time.Time,
+) dkimResult {
+	tags, err := parseTagList(signature.raw[strings.IndexByte(signature.raw, ':')+1:])
+	if err != nil {
+		return dkimResult{status: dkimPermError, err: err}
+	}
+	result := dkimResult{domain: strings.ToLower(tags["d"]), selector: tags["s"]}
+	perm := func(err error) dkimResult {
+		result.status = dkimPermError
+		result.err = err
+		return result
+	}
+	for _, t := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[t]; !ok {
+			return perm(errorDKIMMalformed)
+		}
+	}
+	if tags["v"] != "1" {
+		return perm(errorDKIMMalformed)
+	}
+	if i, ok := tags["i"]; ok {
+		_, idomain := splitAddress(i)
+		if idomain != result.domain && !strings.HasSuffix(idomain, "."+result.domain) {
+			return perm(errorDKIMMalformed)
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		expiration, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return perm(errorDKIMMalformed)
+		}
+		if now.Unix() > expiration {
+			return perm(errorDKIMExpired)
+		}
+	}
+	signedHeaders := strings.Split(removeFWS(tags["h"]), ":")
+	fromSigned := false
+	for _, h := range signedHeaders {
+		if strings.EqualFold(h, "From") {
+			fromSigned = true
+		}
+	}
+	if !fromSigned {
+		return perm(errorDKIMMalformed)
+	}
+
+	var keyType string
+	var hashFunc crypto.Hash
+	var hashName string
+	switch strings.ToLower(tags["a"]) {
+	case "rsa-sha256":
+		keyType, hashFunc, hashName = "rsa", crypto.SHA256, "sha256"
+	case "ed25519-sha256":
+		keyType, hashFunc, hashName = "ed25519", crypto.SHA256, "sha256"
+	default:
+		return perm(errorDKIMUnsupported)
+	}
+
+	headerRelaxed, bodyRelaxed := false, false
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerRelaxed = parts[0] == "relaxed"
+		bodyRelaxed = len(parts) == 2 && parts[1] == "relaxed"
+	}
+
+	canonical := canonicalBody(body, bodyRelaxed)
+	if l, ok := tags["l"]; ok {
+		length, err := strconv.Atoi(l)
+		if err != nil || length < 0 || length > len(canonical) {
+			return perm(errorDKIMMalformed)
+		}
+		canonical = canonical[:length]
+	}
+	bh := hashFunc.New()
+	bh.Write(canonical)
+	if base64.StdEncoding.EncodeToString(bh.Sum(nil)) != removeFWS(tags["bh"]) {
+		result.status = dkimFail
+		result.err = errorDKIMBodyHash
+		return result
+	}
+
+	key, status, err := lookupDKIMKey(ctx, r, result.selector, result.domain, keyType, hashName)
+	if err != nil {
+		result.status = status
+		result.err = err
+		return result
+	}
+
+	// a fresh slice, appending to before would overwrite the fields the caller is iterating over
+	others := make([]headerField, 0, len(before)+len(after))
+	others = append(append(others, before...), after...)
+	h := hashFunc.New()
+	writeSignedHeaders(h, others, signedHeaders, headerRelaxed)
+	h.Write([]byte(strings.TrimSuffix(canonicalHeader(stripSignature(signature), headerRelaxed), "\r\n")))
+	hashed := h.Sum(nil)
+
+	sig, err := base64.StdEncoding.DecodeString(removeFWS(tags["b"]))
+	if err != nil {
+		return perm(errorDKIMMalformed)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, hashFunc, hashed, sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, hashed, sig) {
+			err = errorDKIMSignature
+		}
+	}
+	if err != nil {
+		result.status = dkimFail
+		result.err = errorDKIMSignature
+		return result
+	}
+	result.status = dkimPass
+	return result
+}
+
+// writeSignedHeaders writes canonicalized header fields listed in the h= tag
+// picking instances from the bottom up
+func writeSignedHeaders(h hash.Hash, fields []headerField, names []string, relaxed bool) {
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				h.Write([]byte(canonicalHeader(fields[i], relaxed)))
+				break
+			}
+		}
+	}
+}
+
+var dkimSignatureValue = regexp.MustCompile(`(^|;)([ \t\r\n]*b[ \t\r\n]*=)[^;]*`)
+
+// stripSignature removes the value of the b= tag
+func stripSignature(f headerField) headerField {
+	idx := strings.IndexByte(f.raw, ':') + 1
+	value := dkimSignatureValue.ReplaceAllString(f.raw[idx:], "$1$2")
+	return headerField{name: f.name, raw: f.raw[:idx] + value}
+}
+
+func lookupDKIMKey(ctx context.Context, r resolver, selector, domain, keyType, hashName string) (interface{}, dkimStatus, error) {
+	txts, err := r.LookupTXT(ctx, selector+"._domainkey."+domain)
+	if isNotFound(err) || (err == nil && len(txts) == 0) {
+		return nil, dkimPermError, errorDKIMNoKey
+	}
+	if err != nil {
+		return nil, dkimTempError, errorDKIMKeyUnavailable
+	}
+	tags, err := parseTagList(strings.Join(txts, ""))
+	if err != nil {
+		return nil, dkimPermError, errorDKIMNoKey
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, dkimPermError, errorDKIMNoKey
+	}
+	if k, ok := tags["k"]; ok && k != keyType || !ok && keyType != "rsa" {
+		return nil, dkimPermError, errorDKIMUnsupported
+	}
+	if hs, ok := tags["h"]; ok && !strings.Contains(":"+removeFWS(hs)+":", ":"+hashName+":") {
+		return nil, dkimPermError, errorDKIMUnsupported
+	}
+	p := removeFWS(tags["p"])
+	if p == "" {
+		return nil, dkimPermError, errorDKIMKeyRevoked
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, dkimPermError, errorDKIMNoKey
+	}
+	if keyType == "ed25519" {
+		if len(der) != ed25519.PublicKeySize {
+			return nil, dkimPermError, errorDKIMNoKey
+		}
+		return ed25519.PublicKey(der), dkimPass, nil
+	}
+	var rsaKey *rsa.PublicKey
+	if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+		var ok bool
+		if rsaKey, ok = key.(*rsa.PublicKey); !ok {
+			return nil, dkimPermError, errorDKIMNoKey
+		}
+	} else if rsaKey, err = x509.ParsePKCS1PublicKey(der); err != nil {
+		return nil, dkimPermError, errorDKIMNoKey
+	}
+	if rsaKey.N.BitLen() < dkimMinRSABits {
+		return nil, dkimPermError, errorDKIMWeakKey
+	}
+	return rsaKey, dkimPass, nil
+}
+
+// dkimLines returns the lines describing DKIM signatures for the forwarded email
+func (e *env) dkimLines() []string {
+	if !e.cfg.VerifyDKIM {
+		return nil
+	}
+	if len(e.dkim) == 0 {
+		return []string{"DKIM: none", "WARNING: the email is not signed, the sender may be forged"}
+	}
+	var lines []string
+	signed := false
+	for _, d := range e.dkim {
+		if d.status == dkimPass {
+			lines = append(lines, fmt.Sprintf("DKIM: pass, signed by %s", d.domain))
+			signed = true
+		} else if d.domain != "" {
+			lines = append(lines, fmt.Sprintf("DKIM: %v (%s: %v)", d.status, d.domain, d.err))
+		} else {
+			lines = append(lines, fmt.Sprintf("DKIM: %v (%v)", d.status, d.err))
+		}
+	}
+	if !signed {
+		lines = append(lines, "WARNING: the email signature is invalid, the sender may be forged")
+	}
+	return lines
+}
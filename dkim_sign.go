@@ -0,0 +1,213 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// dkimKeyBits is the size of generated RSA keys
+const dkimKeyBits = 2048
+
+// dkimSignedHeaders lists header fields signed if present
+var dkimSignedHeaders = []string{
+	"From",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+}
+
+type dkimKey struct {
+	Domain     string `json:"domain"`      // the signing domain
+	Selector   string `json:"selector"`    // the selector of the DNS record
+	PrivateKey string `json:"private_key"` // private key path
+}
+
+type dkimSigner struct {
+	domain   string
+	selector string
+	key      crypto.Signer
+}
+
+// loadDKIMSigners reads private keys and returns signers by domain
+func loadDKIMSigners(keys []dkimKey) (map[string]*dkimSigner, error) {
+	signers := make(map[string]*dkimSigner)
+	for _, k := range keys {
+		data, err := ioutil.ReadFile(k.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("cannot decode DKIM key %s", k.PrivateKey)
+		}
+		var key interface{}
+		if key, err = x509.ParsePKCS8PrivateKey(block.Bytes); err != nil {
+			if key, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+				return nil, fmt.Errorf("cannot parse DKIM key %s, %v", k.PrivateKey, err)
+			}
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			signers[strings.ToLower(k.Domain)] = &dkimSigner{domain: strings.ToLower(k.Domain), selector: k.Selector, key: key}
+		case ed25519.PrivateKey:
+			signers[strings.ToLower(k.Domain)] = &dkimSigner{domain: strings.ToLower(k.Domain), selector: k.Selector, key: key}
+		default:
+			return nil, fmt.Errorf("unsupported DKIM key type in %s", k.PrivateKey)
+		}
+	}
+	return signers, nil
+}
+
+// dkimSignerFor returns the signer of the domain or of its closest parent domain
+func (w *worker) dkimSignerFor(domain string) *dkimSigner {
+	for domain != "" {
+		if s := w.dkim[domain]; s != nil {
+			return s
+		}
+		idx := strings.IndexByte(domain, '.')
+		if idx == -1 {
+			break
+		}
+		domain = domain[idx+1:]
+	}
+	return nil
+}
+
+// signDKIM prepends a DKIM signature if there is a key for the sender domain
+func (w *worker) signDKIM(from string, data []byte) ([]byte, error) {
+	_, domain := splitAddress(from)
+	s := w.dkimSignerFor(domain)
+	if s == nil {
+		return data, nil
+	}
+	return s.sign(data, time.Now())
+}
+
+// sign signs the message with relaxed/relaxed canonicalization
+func (s *dkimSigner) sign(data []byte, now time.Time) ([]byte, error) {
+	data = normalizeCRLF(data)
+	fields, body := splitMessage(data)
+	var names []string
+	for _, name := range dkimSignedHeaders {
+		for _, f := range fields {
+			if strings.EqualFold(f.name, name) {
+				names = append(names, strings.ToLower(name))
+				break
+			}
+		}
+	}
+	if len(names) == 0 || names[0] != "from" {
+		return nil, errors.New("From header is required for DKIM signing")
+	}
+
+	algorithm := "rsa-sha256"
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		algorithm = "ed25519-sha256"
+	}
+	bodyHash := sha256.Sum256(canonicalBody(body, true))
+	value := fmt.Sprintf(
+		" v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n t=%d; h=%s;\r\n bh=%s;\r\n b=",
+		algorithm,
+		s.domain,
+		s.selector,
+		now.Unix(),
+		strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signature := headerField{name: "DKIM-Signature", raw: "DKIM-Signature:" + value + "\r\n"}
+
+	h := sha256.New()
+	writeSignedHeaders(h, fields, names, true)
+	h.Write([]byte(strings.TrimSuffix(canonicalHeaderRelaxed(signature), "\r\n")))
+	hashed := h.Sum(nil)
+
+	var sig []byte
+	var err error
+	if _, ok := s.key.(ed25519.PrivateKey); ok {
+		sig, err = s.key.Sign(rand.Reader, hashed, crypto.Hash(0))
+	} else {
+		sig, err = s.key.Sign(rand.Reader, hashed, crypto.SHA256)
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(sig)
+	var folded []string
+	for len(encoded) > 72 {
+		folded = append(folded, encoded[:72])
+		encoded = encoded[72:]
+	}
+	folded = append(folded, encoded)
+	header := "DKIM-Signature:" + value + strings.Join(folded, "\r\n ") + "\r\n"
+	return append([]byte(header), data...), nil
+}
+
+// generateDKIMKey generates a DKIM key pair and returns the private key in PEM and the DNS TXT record value
+func generateDKIMKey(keyType string) (keyPEM []byte, record string, err error) {
+	var private interface{}
+	var public []byte
+	switch keyType {
+	case "rsa":
+		key, err := rsa.GenerateKey(rand.Reader, dkimKeyBits)
+		if err != nil {
+			return nil, "", err
+		}
+		private = key
+		if public, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+			return nil, "", err
+		}
+	case "ed25519":
+		pub, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		private = key
+		public = pub
+	default:
+		return nil, "", errors.New("key type should be rsa or ed25519")
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, "", err
+	}
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return keyPEM, fmt.Sprintf("v=DKIM1; k=%s; p=%s", keyType, base64.StdEncoding.EncodeToString(public)), nil
+}
+
+// dkimKeygen generates a DKIM key pair, saves the private key and prints the DNS record
+func dkimKeygen(args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		fmt.Fprintln(os.Stderr, "usage: boxt dkim-keygen <domain> <selector> <private-key-file> [rsa|ed25519]")
+		os.Exit(1)
+	}
+	domain, selector, keyFile := strings.ToLower(args[0]), args[1], args[2]
+	keyType := "rsa"
+	if len(args) == 4 {
+		keyType = args[3]
+	}
+	keyPEM, record, err := generateDKIMKey(keyType)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	checkErr(ioutil.WriteFile(keyFile, keyPEM, 0600))
+	fmt.Printf("%s._domainkey.%s TXT \"%s\"\n", selector, domain, record)
+}
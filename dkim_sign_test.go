@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMSignRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, keyType := range []string{"rsa", "ed25519"} {
+		t.Run(keyType, func(t *testing.T) {
+			keyPEM, record, err := generateDKIMKey(keyType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keyFile := filepath.Join(dir, keyType+".pem")
+			if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+				t.Fatal(err)
+			}
+			signers, err := loadDKIMSigners([]dkimKey{{Domain: "Example.com", Selector: "s1", PrivateKey: keyFile}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := &worker{dkim: signers}
+			signer := w.dkimSignerFor("mail.example.com")
+			if signer == nil {
+				t.Fatal("no signer for a subdomain")
+			}
+			now := time.Now()
+			data, err := signer.sign([]byte(strings.Replace(testMessage, "\r\n", "\n", -1)), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newStubResolver()
+			r.txt["s1._domainkey.example.com"] = []string{record}
+			results := verifyDKIM(context.Background(), r, data, now)
+			if len(results) != 1 || results[0].status != dkimPass || results[0].domain != "example.com" {
+				t.Fatalf("unexpected results %+v", results)
+			}
+
+			tampered := []byte(strings.Replace(string(data), "Hello, Bob!", "Hello, Eve!", 1))
+			results = verifyDKIM(context.Background(), r, tampered, now)
+			if len(results) != 1 || results[0].status != dkimFail {
+				t.Fatalf("tampered body passed: %+v", results)
+			}
+		})
+	}
+}
+
+func TestSignDKIMWithoutKey(t *testing.T) {
+	w := &worker{dkim: map[string]*dkimSigner{}}
+	data, err := w.signDKIM("alice@example.org", []byte(testMessage))
+	if err != nil || string(data) != testMessage {
+		t.Fatalf("message without a key should be left as is, %v", err)
+	}
+}
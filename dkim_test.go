@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"testing"
+	"time"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob@boxt.us\r\n" +
+	"Subject: Hello\r\n" +
+	"Date: Sat, 17 Oct 2026 10:00:00 +0000\r\n" +
+	"Message-ID: <1@example.com>\r\n" +
+	"\r\n" +
+	"Hello, Bob!\r\n"
+
+func testRSASigner(t testing.TB, r *stubResolver, domain, selector string) *dkimSigner {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.txt[selector+"._domainkey."+domain] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(public)}
+	return &dkimSigner{domain: domain, selector: selector, key: key}
+}
+
+func testEd25519Signer(t testing.TB, r *stubResolver, domain, selector string) *dkimSigner {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.txt[selector+"._domainkey."+domain] = []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(public)}
+	return &dkimSigner{domain: domain, selector: selector, key: key}
+}
+
+func TestVerifyDKIMMultipleSignatures(t *testing.T) {
+	r := newStubResolver()
+	author := testRSASigner(t, r, "example.com", "author")
+	esp := testEd25519Signer(t, r, "esp.example.net", "esp")
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		message func() []byte
+	}{
+		{"adjacent", func() []byte {
+			data, err := author.sign([]byte(testMessage), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err = esp.sign(data, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}},
+		{"separated", func() []byte {
+			data, err := author.sign([]byte(testMessage), now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data = append([]byte("Received: from relay.example.net\r\n"), data...)
+			data, err = esp.sign(data, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return data
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			results := verifyDKIM(context.Background(), r, c.message(), now)
+			if len(results) != 2 {
+				t.Fatalf("expected 2 results, got %d", len(results))
+			}
+			domains := map[string]bool{}
+			for _, result := range results {
+				if result.status != dkimPass {
+					t.Errorf("signature of %s: %v, %v", result.domain, result.status, result.err)
+				}
+				domains[result.domain] = true
+			}
+			if !domains["example.com"] || !domains["esp.example.net"] {
+				t.Errorf("unexpected domains %v", domains)
+			}
+		})
+	}
+}
+
+func TestVerifyDKIMTamperedHeader(t *testing.T) {
+	r := newStubResolver()
+	signer := testEd25519Signer(t, r, "example.com", "s1")
+	data, err := signer.sign([]byte(testMessage), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := []byte(string(data[:len(data)-len(testMessage)]) + "From: Mallory <alice@example.com>" + testMessage[len("From: Alice <alice@example.com>"):])
+	results := verifyDKIM(context.Background(), r, tampered, time.Now())
+	if len(results) != 1 || results[0].status != dkimFail {
+		t.Fatalf("expected a failed signature, got %+v", results)
+	}
+}
+
+// TestVerifyDKIMWeakSignatures checks that rsa-sha1 and short RSA keys are rejected as RFC 8301 requires
+func TestVerifyDKIMWeakSignatures(t *testing.T) {
+	r := newStubResolver()
+	signer := testRSASigner(t, r, "example.com", "s1")
+	now := time.Now()
+	data, err := signer.sign([]byte(testMessage), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha1 := bytes.Replace(data, []byte("a=rsa-sha256"), []byte("a=rsa-sha1"), 1)
+	results := verifyDKIM(context.Background(), r, sha1, now)
+	if len(results) != 1 || results[0].status != dkimPermError || results[0].err != errorDKIMUnsupported {
+		t.Errorf("expected rsa-sha1 to be unsupported, got %+v", results)
+	}
+
+	short := &rsa.PublicKey{N: new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), dkimMinRSABits-2), big.NewInt(1)), E: 65537}
+	r.txt["s1._domainkey.example.com"] = []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(short))}
+	results = verifyDKIM(context.Background(), r, data, now)
+	if len(results) != 1 || results[0].status != dkimPermError || results[0].err != errorDKIMWeakKey {
+		t.Errorf("expected a short key to be rejected, got %+v", results)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	dmarcPolicyNone       = "none"
+	dmarcPolicyQuarantine = "quarantine"
+	dmarcPolicyReject     = "reject"
+	dmarcPolicyRecord     = "record"
+)
+
+// dmarcResult is a result of the DMARC check as defined in RFC 7489
+type dmarcResult struct {
+	domain string
+	found  bool
+	pass   bool
+	policy string
+	action string
+}
+
+type dmarcRecord struct {
+	policy          string
+	subdomainPolicy string
+	strictDKIM      bool
+	strictSPF       bool
+	percent         int
+}
+
+// parseDMARCRecord parses a DMARC record, the second result is false if the record is not valid
+func parseDMARCRecord(txt string) (dmarcRecord, bool) {
+	if !strings.HasPrefix(txt, "v=DMARC1") {
+		return dmarcRecord{}, false
+	}
+	tags, err := parseTagList(txt)
+	if err != nil || tags["v"] != "DMARC1" {
+		return dmarcRecord{}, false
+	}
+	record := dmarcRecord{
+		policy:     strings.ToLower(tags["p"]),
+		strictDKIM: strings.ToLower(tags["adkim"]) == "s",
+		strictSPF:  strings.ToLower(tags["aspf"]) == "s",
+		percent:    100,
+	}
+	switch record.policy {
+	case dmarcPolicyNone, dmarcPolicyQuarantine, dmarcPolicyReject:
+	default:
+		record.policy = dmarcPolicyNone
+	}
+	record.subdomainPolicy = record.policy
+	switch sp := strings.ToLower(tags["sp"]); sp {
+	case dmarcPolicyNone, dmarcPolicyQuarantine, dmarcPolicyReject:
+		record.subdomainPolicy = sp
+	}
+	if pct, ok := tags["pct"]; ok {
+		if n, err := strconv.Atoi(pct); err == nil && n >= 0 && n <= 100 {
+			record.percent = n
+		}
+	}
+	return record, true
+}
+
+func lookupDMARCRecord(ctx context.Context, r resolver, domain string) (dmarcRecord, bool, error) {
+	txts, err := r.LookupTXT(ctx, "_dmarc."+domain)
+	if isNotFound(err) {
+		return dmarcRecord{}, false, nil
+	}
+	if err != nil {
+		return dmarcRecord{}, false, err
+	}
+	var records []dmarcRecord
+	for _, txt := range txts {
+		if record, ok := parseDMARCRecord(txt); ok {
+			records = append(records, record)
+		}
+	}
+	if len(records) != 1 {
+		return dmarcRecord{}, false, nil
+	}
+	return records[0], true, nil
+}
+
+// organizationalDomain returns the registered domain according to the public suffix list
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+func aligned(domain, fromDomain string, strict bool) bool {
+	if strict {
+		return domain == fromDomain
+	}
+	return organizationalDomain(domain) == organizationalDomain(fromDomain)
+}
+
+// checkDMARC evaluates the DMARC policy of the From domain using SPF and DKIM results
+func checkDMARC(
+	ctx context.Context,
+	r resolver,
+	fromDomain string,
+	mailFromDomain string,
+	spf spfResult,
+	dkim []dkimResult,
+) (dmarcResult, error) {
+	result := dmarcResult{domain: fromDomain, action: dmarcPolicyNone}
+	record, found, err := lookupDMARCRecord(ctx, r, fromDomain)
+	if err != nil {
+		return result, err
+	}
+	subdomain := false
+	if !found {
+		org := organizationalDomain(fromDomain)
+		if org != fromDomain {
+			record, found, err = lookupDMARCRecord(ctx, r, org)
+			if err != nil {
+				return result, err
+			}
+			subdomain = true
+		}
+	}
+	if !found {
+		return result, nil
+	}
+	result.found = true
+	result.policy = record.policy
+	if subdomain {
+		result.policy = record.subdomainPolicy
+	}
+	if spf == spfPass && aligned(mailFromDomain, fromDomain, record.strictSPF) {
+		result.pass = true
+	}
+	for _, d := range dkim {
+		if d.status == dkimPass && aligned(d.domain, fromDomain, record.strictDKIM) {
+			result.pass = true
+		}
+	}
+	if result.pass {
+		return result, nil
+	}
+	result.action = result.policy
+	if record.percent < 100 && rand.Intn(100) >= record.percent {
+		switch result.action {
+		case dmarcPolicyReject:
+			result.action = dmarcPolicyQuarantine
+		case dmarcPolicyQuarantine:
+			result.action = dmarcPolicyNone
+		}
+	}
+	return result, nil
+}
+
+// dmarcAction applies the configured override to the action requested by the domain
+func dmarcAction(override string, result dmarcResult) string {
+	if result.pass || !result.found || override == dmarcPolicyRecord {
+		return result.action
+	}
+	return override
+}
+
+// dmarcLines returns the lines describing the DMARC check result for the forwarded email
+func (e *env) dmarcLines() []string {
+	if e.cfg.DMARCPolicy == "" {
+		return nil
+	}
+	if !e.dmarc.found {
+		return []string{"DMARC: none"}
+	}
+	if e.dmarc.pass {
+		return []string{fmt.Sprintf("DMARC: pass (%s)", e.dmarc.domain)}
+	}
+	lines := []string{fmt.Sprintf("DMARC: fail (%s, policy %s)", e.dmarc.domain, e.dmarc.policy)}
+	if e.dmarcAction == dmarcPolicyQuarantine {
+		lines = append(lines, "WARNING: the email failed DMARC checks and was quarantined")
+	}
+	return lines
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCheckDMARC(t *testing.T) {
+	cases := []struct {
+		name           string
+		txt            map[string][]string
+		fromDomain     string
+		mailFromDomain string
+		spf            spfResult
+		dkim           []dkimResult
+		found          bool
+		pass           bool
+		action         string
+	}{
+		{
+			name:           "no record",
+			fromDomain:     "example.com",
+			mailFromDomain: "example.com",
+			spf:            spfFail,
+			action:         dmarcPolicyNone,
+		},
+		{
+			name:           "relaxed SPF alignment",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "bounces.example.com",
+			spf:            spfPass,
+			found:          true,
+			pass:           true,
+			action:         dmarcPolicyNone,
+		},
+		{
+			name:           "strict SPF alignment",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; aspf=s"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "bounces.example.com",
+			spf:            spfPass,
+			found:          true,
+			action:         dmarcPolicyReject,
+		},
+		{
+			name:           "SPF of another organization",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=quarantine"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.net",
+			spf:            spfPass,
+			found:          true,
+			action:         dmarcPolicyQuarantine,
+		},
+		{
+			name:           "relaxed DKIM alignment",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.net",
+			spf:            spfFail,
+			dkim:           []dkimResult{{domain: "example.net", status: dkimPass}, {domain: "mail.example.com", status: dkimPass}},
+			found:          true,
+			pass:           true,
+			action:         dmarcPolicyNone,
+		},
+		{
+			name:           "strict DKIM alignment",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; adkim=s"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.net",
+			spf:            spfFail,
+			dkim:           []dkimResult{{domain: "mail.example.com", status: dkimPass}},
+			found:          true,
+			action:         dmarcPolicyReject,
+		},
+		{
+			name:           "failed DKIM signature",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.com",
+			spf:            spfSoftFail,
+			dkim:           []dkimResult{{domain: "example.com", status: dkimFail}},
+			found:          true,
+			action:         dmarcPolicyReject,
+		},
+		{
+			name:           "subdomain policy of the organizational domain",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"}},
+			fromDomain:     "news.example.com",
+			mailFromDomain: "example.net",
+			spf:            spfPass,
+			found:          true,
+			action:         dmarcPolicyQuarantine,
+		},
+		{
+			name:           "organizational domain under a public suffix",
+			txt:            map[string][]string{"_dmarc.example.co.uk": {"v=DMARC1; p=reject"}},
+			fromDomain:     "mail.example.co.uk",
+			mailFromDomain: "example.co.uk",
+			spf:            spfPass,
+			found:          true,
+			pass:           true,
+			action:         dmarcPolicyNone,
+		},
+		{
+			name:           "zero percent",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject; pct=0"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.net",
+			spf:            spfPass,
+			found:          true,
+			action:         dmarcPolicyQuarantine,
+		},
+		{
+			name:           "multiple records",
+			txt:            map[string][]string{"_dmarc.example.com": {"v=DMARC1; p=reject", "v=DMARC1; p=none"}},
+			fromDomain:     "example.com",
+			mailFromDomain: "example.net",
+			spf:            spfPass,
+			action:         dmarcPolicyNone,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := newStubResolver()
+			for name, records := range c.txt {
+				r.txt[name] = records
+			}
+			result, err := checkDMARC(context.Background(), r, c.fromDomain, c.mailFromDomain, c.spf, c.dkim)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.found != c.found || result.pass != c.pass || result.action != c.action {
+				t.Errorf("got found %v, pass %v, action %s, expected found %v, pass %v, action %s",
+					result.found, result.pass, result.action, c.found, c.pass, c.action)
+			}
+		})
+	}
+}
+
+func TestCheckDMARCTempError(t *testing.T) {
+	r := newStubResolver()
+	r.fail["_dmarc.example.com"] = true
+	if _, err := checkDMARC(context.Background(), r, "example.com", "example.com", spfPass, nil); err == nil {
+		t.Error("expected a DNS failure to be reported")
+	}
+}
+
+func TestDMARCAction(t *testing.T) {
+	failed := dmarcResult{found: true, policy: dmarcPolicyReject, action: dmarcPolicyReject}
+	for _, c := range []struct {
+		override string
+		result   dmarcResult
+		action   string
+	}{
+		{dmarcPolicyRecord, failed, dmarcPolicyReject},
+		{dmarcPolicyQuarantine, failed, dmarcPolicyQuarantine},
+		{dmarcPolicyNone, failed, dmarcPolicyNone},
+		{dmarcPolicyReject, dmarcResult{found: true, pass: true, action: dmarcPolicyNone}, dmarcPolicyNone},
+		{dmarcPolicyReject, dmarcResult{action: dmarcPolicyNone}, dmarcPolicyNone},
+	} {
+		if action := dmarcAction(c.override, c.result); action != c.action {
+			t.Errorf("override %s of %+v: got %s, expected %s", c.override, c.result, action, c.action)
+		}
+	}
+}
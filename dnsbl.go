@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsblZone is a DNS blocklist zone and the score added if the client is listed there
+type dnsblZone struct {
+	Zone  string `json:"zone"`  // the zone to query, e.g. "zen.spamhaus.org"
+	Score int    `json:"score"` // the score added if the client is listed
+}
+
+type dnsblCacheEntry struct {
+	listed  bool
+	expires time.Time
+}
+
+// dnsblChecker queries DNS blocklists and caches the results
+type dnsblChecker struct {
+	resolver resolver
+	zones    []dnsblZone
+	ttl      time.Duration
+	timeout  time.Duration
+	mu       sync.Mutex
+	cache    map[string]dnsblCacheEntry
+}
+
+// dnsblResult is a result of the DNS blocklist check
+type dnsblResult struct {
+	score int
+	zones []string
+}
+
+func newDNSBLChecker(r resolver, zones []dnsblZone, ttl time.Duration, timeout time.Duration) *dnsblChecker {
+	return &dnsblChecker{
+		resolver: r,
+		zones:    zones,
+		ttl:      ttl,
+		timeout:  timeout,
+		cache:    make(map[string]dnsblCacheEntry),
+	}
+}
+
+// reversedIP returns the IP address in the form used in DNS blocklist queries
+func reversedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", ip4[3], ip4[2], ip4[1], ip4[0])
+	}
+	nibbles := strings.Split(dottedIP(ip), ".")
+	for i, j := 0, len(nibbles)-1; i < j; i, j = i+1, j-1 {
+		nibbles[i], nibbles[j] = nibbles[j], nibbles[i]
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// check queries all configured zones for the IP address
+func (c *dnsblChecker) check(ip net.IP) (result dnsblResult) {
+	if ip == nil || ip.IsLoopback() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+	reversed := reversedIP(ip)
+	for _, z := range c.zones {
+		if c.listed(ctx, reversed+"."+z.Zone) {
+			result.score += z.Score
+			result.zones = append(result.zones, z.Zone)
+		}
+	}
+	return
+}
+
+func (c *dnsblChecker) listed(ctx context.Context, query string) bool {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.cache[query]
+	c.mu.Unlock()
+	if ok && entry.expires.After(now) {
+		return entry.listed
+	}
+	addrs, err := c.resolver.LookupIPAddr(ctx, query)
+	if err != nil && !isNotFound(err) {
+		lerr("cannot query DNSBL %s, %v", query, err)
+		return false
+	}
+	listed := false
+	for _, a := range addrs {
+		if ip4 := a.IP.To4(); ip4 != nil && ip4[0] == 127 {
+			listed = true
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, v := range c.cache {
+		if !v.expires.After(now) {
+			delete(c.cache, k)
+		}
+	}
+	c.cache[query] = dnsblCacheEntry{listed: listed, expires: now.Add(c.ttl)}
+	return listed
+}
+
+// dnsblLines returns the lines describing the DNS blocklist check for the forwarded email
+func (e *env) dnsblLines() []string {
+	if e.dnsbl.score == 0 {
+		return nil
+	}
+	return []string{fmt.Sprintf("DNSBL: listed in %s (score %d)", strings.Join(e.dnsbl.zones, ", "), e.dnsbl.score)}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testZones = []dnsblZone{{Zone: "a.example.net", Score: 2}, {Zone: "b.example.net", Score: 3}, {Zone: "c.example.net", Score: 5}}
+
+func TestReversedIP(t *testing.T) {
+	for ip, reversed := range map[string]string{
+		"192.0.2.1":   "1.2.0.192",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2",
+	} {
+		if r := reversedIP(net.ParseIP(ip)); r != reversed {
+			t.Errorf("%s reversed to %s, expected %s", ip, r, reversed)
+		}
+	}
+}
+
+func TestDNSBLScore(t *testing.T) {
+	r := newStubResolver()
+	r.ip["1.2.0.192.a.example.net"] = []string{"127.0.0.2"}
+	r.ip["1.2.0.192.b.example.net"] = []string{"127.0.0.4", "127.0.0.10"}
+	// an answer outside 127.0.0.0/8 is an error of the zone rather than a listing
+	r.ip["1.2.0.192.c.example.net"] = []string{"192.0.2.99"}
+	c := newDNSBLChecker(r, testZones, time.Hour, time.Second)
+	result := c.check(net.ParseIP("192.0.2.1"))
+	expected := dnsblResult{score: 5, zones: []string{"a.example.net", "b.example.net"}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("got %+v, expected %+v", result, expected)
+	}
+	if result := c.check(net.ParseIP("198.51.100.1")); result.score != 0 || result.zones != nil {
+		t.Errorf("expected an unlisted client, got %+v", result)
+	}
+}
+
+func TestDNSBLSkipsLoopback(t *testing.T) {
+	r := newStubResolver()
+	c := newDNSBLChecker(r, testZones, time.Hour, time.Second)
+	c.check(net.ParseIP("127.0.0.1"))
+	c.check(nil)
+	if len(r.queries) != 0 {
+		t.Errorf("expected no queries, got %v", r.queries)
+	}
+}
+
+func TestDNSBLCache(t *testing.T) {
+	r := newStubResolver()
+	r.ip["1.2.0.192.a.example.net"] = []string{"127.0.0.2"}
+	c := newDNSBLChecker(r, testZones[:2], time.Hour, time.Second)
+	ip := net.ParseIP("192.0.2.1")
+	for i := 0; i < 3; i++ {
+		if result := c.check(ip); result.score != 2 {
+			t.Fatalf("expected score 2, got %d", result.score)
+		}
+	}
+	for _, name := range []string{"1.2.0.192.a.example.net", "1.2.0.192.b.example.net"} {
+		if n := r.count(name); n != 1 {
+			t.Errorf("expected a listed and an unlisted result to be cached, %s queried %d times", name, n)
+		}
+	}
+	c = newDNSBLChecker(r, testZones[:1], 0, time.Second)
+	c.check(ip)
+	c.check(ip)
+	if n := r.count("1.2.0.192.a.example.net"); n != 3 {
+		t.Errorf("expected expired results to be queried again, queried %d times", n)
+	}
+}
+
+func TestDNSBLTemporaryFailure(t *testing.T) {
+	r := newStubResolver()
+	r.fail["1.2.0.192.a.example.net"] = true
+	c := newDNSBLChecker(r, testZones[:1], time.Hour, time.Second)
+	ip := net.ParseIP("192.0.2.1")
+	if result := c.check(ip); result.score != 0 {
+		t.Errorf("expected a failed query not to list the client, got %+v", result)
+	}
+	delete(r.fail, "1.2.0.192.a.example.net")
+	r.ip["1.2.0.192.a.example.net"] = []string{"127.0.0.2"}
+	if result := c.check(ip); result.score != 2 {
+		t.Errorf("expected a failed query not to be cached, got %+v", result)
+	}
+}
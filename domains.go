@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// domainVerificationPrefix prefixes the TXT record proving domain ownership
+const domainVerificationPrefix = "boxt-verification="
+
+type customDomain struct {
+	domain       string
+	chatID       int64
+	token        string
+	verified     bool
+	catchAll     bool
+	nextDelivery int64
+}
+
+func (w *worker) customDomain(domain string) *customDomain {
+	query, err := w.db.Query("select chat_id, token, verified, catch_all, next_delivery from domains where domain=?", domain)
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return nil
+	}
+	d := customDomain{domain: domain}
+	checkErr(query.Scan(&d.chatID, &d.token, &d.verified, &d.catchAll, &d.nextDelivery))
+	return &d
+}
+
+func (w *worker) domainsForChat(chatID int64) (domains []customDomain) {
+	query, err := w.db.Query("select domain, token, verified, catch_all from domains where chat_id=? order by domain", chatID)
+	checkErr(err)
+	defer query.Close()
+	for query.Next() {
+		d := customDomain{chatID: chatID}
+		checkErr(query.Scan(&d.domain, &d.token, &d.verified, &d.catchAll))
+		domains = append(domains, d)
+	}
+	return
+}
+
+// addressForRecipient returns the address for the recipient possibly containing a tag,
+// addresses of catch-all domains are resolved without being stored and share the rate limit of the domain,
+// the address is reported muted if the tag is muted
+func (w *worker) addressForRecipient(localPart, host string) *address {
+	username, tag := splitSubaddress(localPart, w.cfg.SubaddressSeparator)
+	if username == "" {
+		return nil
+	}
+	var address *address
+	if w.isOurHost(host) {
+		address = w.addressForUsername(username, host)
+	} else if d := w.customDomain(host); d != nil && d.verified {
+		address = w.addressForUsername(username, host)
+		if address == nil && d.catchAll {
+			address = catchAllAddress(d, username)
+		}
+	}
+	if address != nil && tag != "" {
+		muted := w.db.QueryRow("select count(*) from muted_tags where username=? and host=? and tag=?", username, host, tag)
+		address.muted = address.muted || singleInt(muted) > 0
+	}
+	return address
+}
+
+func catchAllAddress(d *customDomain, username string) *address {
+	return &address{chatID: d.chatID, username: username, host: d.domain, nextDelivery: d.nextDelivery, catchAll: true}
+}
+
+// chatAddress parses the address specified by the user and checks that the chat owns it,
+// any address of a catch-all domain of the chat is owned
+func (w *worker) chatAddress(chatID int64, a string) (username, tag, host string, ok bool) {
+	localPart, host := splitAddress(a)
+	username, tag = splitSubaddress(localPart, w.cfg.SubaddressSeparator)
+	if username == "" {
+		return "", "", "", false
+	}
+	if !w.isOurHost(host) {
+		d := w.customDomain(host)
+		if d == nil || d.chatID != chatID || !d.verified {
+			return "", "", "", false
+		}
+		if d.catchAll {
+			return username, tag, host, true
+		}
+	}
+	exists := w.db.QueryRow("select count(*) from addresses where chat_id=? and username=? and host=?", chatID, username, host)
+	if singleInt(exists) == 0 {
+		return "", "", "", false
+	}
+	return username, tag, host, true
+}
+
+// isSystemDomain returns true if the domain is a system host or its subdomain
+func (w *worker) isSystemDomain(domain string) bool {
+	for _, h := range w.systemHosts() {
+		if domain == h || strings.HasSuffix(domain, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyDomain checks the ownership TXT record and the MX record of the domain
+func (w *worker) verifyDomain(d *customDomain) error {
+	if w.isSystemDomain(d.domain) {
+		return fmt.Errorf("%s belongs to this service", d.domain)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(w.cfg.TimeoutSeconds))
+	defer cancel()
+	txts, err := w.resolver.LookupTXT(ctx, "_boxt."+d.domain)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("cannot query TXT record, %v", err)
+	}
+	found := false
+	for _, txt := range txts {
+		if strings.TrimSpace(txt) == domainVerificationPrefix+d.token {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("TXT record _boxt.%s with value %s%s is not found", d.domain, domainVerificationPrefix, d.token)
+	}
+	mxs, err := w.resolver.LookupMX(ctx, d.domain)
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("cannot query MX record, %v", err)
+	}
+	for _, mx := range mxs {
+		if w.isOurHost(strings.ToLower(strings.TrimSuffix(mx.Host, "."))) {
+			return nil
+		}
+	}
+	return fmt.Errorf("MX record of %s should point to %s", d.domain, w.cfg.Host)
+}
+
+func (w *worker) domainInstructions(d customDomain) string {
+	return fmt.Sprintf("Add these DNS records to %s and send /domain verify %s\nTXT _boxt.%s %s%s\nMX %s",
+		d.domain,
+		d.domain,
+		d.domain,
+		domainVerificationPrefix,
+		d.token,
+		w.cfg.Host)
+}
+
+const domainUsage = `Command format:
+/domain — list your domains
+/domain add <domain> — register your domain
+/domain verify <domain> — verify DNS records
+/domain catchall <domain> on|off — forward mail for any address on the domain
+/domain address <email@your-domain> — create an address on the domain
+/domain remove <domain> — remove the domain and its addresses`
+
+// domain processes /domain subcommands
+func (w *worker) domain(chatID int64, arguments string) {
+	parts := strings.Fields(strings.ToLower(arguments))
+	if len(parts) == 0 {
+		w.listDomains(chatID)
+		return
+	}
+	if len(parts) < 2 {
+		_ = w.sendText(chatID, false, parseRaw, domainUsage)
+		return
+	}
+	name := strings.TrimSuffix(parts[1], ".")
+	switch parts[0] {
+	case "add":
+		w.addDomain(chatID, name)
+	case "verify":
+		d := w.customDomain(name)
+		if d == nil || d.chatID != chatID {
+			_ = w.sendText(chatID, false, parseRaw, "Domain not found")
+			return
+		}
+		if err := w.verifyDomain(d); err != nil {
+			_ = w.sendText(chatID, false, parseRaw, "Verification failed: "+err.Error())
+			return
+		}
+		w.mustExec("update domains set verified=1 where domain=?", name)
+		_ = w.sendText(chatID, false, parseRaw, "Domain is verified")
+	case "catchall":
+		d := w.customDomain(name)
+		if d == nil || d.chatID != chatID {
+			_ = w.sendText(chatID, false, parseRaw, "Domain not found")
+			return
+		}
+		if len(parts) != 3 || (parts[2] != "on" && parts[2] != "off") {
+			_ = w.sendText(chatID, false, parseRaw, domainUsage)
+			return
+		}
+		w.mustExec("update domains set catch_all=? where domain=?", parts[2] == "on", name)
+		_ = w.sendText(chatID, false, parseRaw, "OK")
+	case "address":
+		w.addDomainAddress(chatID, parts[1])
+	case "remove":
+		d := w.customDomain(name)
+		if d == nil || d.chatID != chatID {
+			_ = w.sendText(chatID, false, parseRaw, "Domain not found")
+			return
+		}
+		w.removeDomain(name)
+		_ = w.sendText(chatID, false, parseRaw, "OK")
+	default:
+		_ = w.sendText(chatID, false, parseRaw, domainUsage)
+	}
+}
+
+func (w *worker) listDomains(chatID int64) {
+	domains := w.domainsForChat(chatID)
+	if len(domains) == 0 {
+		_ = w.sendText(chatID, false, parseRaw, "You have no domains\n\n"+domainUsage)
+		return
+	}
+	var lines []string
+	for _, d := range domains {
+		status := "not verified"
+		if d.verified && d.catchAll {
+			status = "verified, catch-all"
+		} else if d.verified {
+			status = "verified"
+		}
+		lines = append(lines, fmt.Sprintf("%s — %s", d.domain, status))
+	}
+	_ = w.sendText(chatID, false, parseRaw, strings.Join(lines, "\n"))
+}
+
+func (w *worker) addDomain(chatID int64, name string) {
+	if !validDomain(name) || w.isSystemDomain(name) {
+		_ = w.sendText(chatID, false, parseRaw, "Domain is invalid")
+		return
+	}
+	d := w.customDomain(name)
+	if d != nil && (d.verified || d.chatID == chatID) {
+		if d.chatID != chatID {
+			_ = w.sendText(chatID, false, parseRaw, "Domain is already registered")
+			return
+		}
+		_ = w.sendText(chatID, false, parseRaw, w.domainInstructions(*d))
+		return
+	}
+	token := randString(32)
+	w.mustExec("insert or replace into domains (domain, chat_id, token) values (?,?,?)", name, chatID, token)
+	_ = w.sendText(chatID, false, parseRaw, w.domainInstructions(customDomain{domain: name, token: token}))
+}
+
+func (w *worker) addDomainAddress(chatID int64, a string) {
+	username, host := splitAddress(a)
+	d := w.customDomain(host)
+	if d == nil || d.chatID != chatID || !d.verified {
+		_ = w.sendText(chatID, false, parseRaw, "Domain not found or not verified")
+		return
+	}
+	if username == "" {
+		_ = w.sendText(chatID, false, parseRaw, "Address is invalid")
+		return
+	}
+	if w.cfg.SubaddressSeparator != "" && strings.Contains(username, w.cfg.SubaddressSeparator) {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Address cannot contain %s, it separates tags", w.cfg.SubaddressSeparator))
+		return
+	}
+	if !w.insertAddress(chatID, username, host) {
+		_ = w.sendText(chatID, false, parseRaw, "Address already exists")
+		return
+	}
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
+
+func (w *worker) removeDomain(name string) {
+	w.mustExec("delete from muted_tags where host=?", name)
+	w.mustExec("delete from sender_rules where host=?", name)
+	w.mustExec("delete from digest_emails where host=?", name)
+	w.mustExec("delete from forwarded_emails where address like ?", "%@"+name)
+	w.mustExec("delete from email_actions where address like ?", "%@"+name)
+	w.mustExec("delete from addresses where host=?", name)
+	w.mustExec("delete from domains where domain=?", name)
+}
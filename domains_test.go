@@ -0,0 +1,122 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// addTestDomain registers the verified domain for the chat
+func addTestDomain(w *worker, chatID int64, domain string, catchAll bool) {
+	w.mustExec("insert into domains (domain, chat_id, token, verified, catch_all) values (?,?,'token',1,?)", domain, chatID, catchAll)
+}
+
+func TestVerifyDomain(t *testing.T) {
+	cases := []struct {
+		name   string
+		domain string
+		txt    []string
+		mx     []string
+		fail   bool
+		err    string
+	}{
+		{name: "verified", domain: "example.com", txt: []string{"v=spf1 -all", " boxt-verification=token "}, mx: []string{"mx.example.net.", "BOXT.US."}},
+		{name: "no TXT record", domain: "example.com", mx: []string{"boxt.us."}, err: "is not found"},
+		{name: "wrong token", domain: "example.com", txt: []string{"boxt-verification=other"}, mx: []string{"boxt.us."}, err: "is not found"},
+		{name: "no MX record", domain: "example.com", txt: []string{"boxt-verification=token"}, err: "should point to"},
+		{name: "foreign MX", domain: "example.com", txt: []string{"boxt-verification=token"}, mx: []string{"mx.example.net."}, err: "should point to"},
+		{name: "temporary failure", domain: "example.com", fail: true, err: "cannot query TXT record"},
+		{name: "system subdomain", domain: "mail.boxt.us", txt: []string{"boxt-verification=token"}, mx: []string{"boxt.us."}, err: "belongs to this service"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := newTestWorker(t, newFakeTelegram(t))
+			w.cfg.TimeoutSeconds = 10
+			r := w.resolver.(*stubResolver)
+			if c.txt != nil {
+				r.txt["_boxt."+c.domain] = c.txt
+			}
+			for _, mx := range c.mx {
+				r.mx[c.domain] = append(r.mx[c.domain], &net.MX{Host: mx})
+			}
+			r.fail["_boxt."+c.domain] = c.fail
+			err := w.verifyDomain(&customDomain{domain: c.domain, token: "token"})
+			if c.err == "" && err != nil || c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+				t.Errorf("got %v, expected %q", err, c.err)
+			}
+		})
+	}
+}
+
+func TestAddDomainRejectsSystemHosts(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.Hosts = []string{"boxt.me"}
+	for i, domain := range []string{"boxt.us", "mail.boxt.us", "a.b.boxt.me", "localhost"} {
+		w.addDomain(int64(i+1), domain)
+	}
+	w.addDomain(5, "notboxt.us")
+	sent := f.sent("sendMessage")
+	for _, r := range sent[:4] {
+		if r.form.Get("text") != "Domain is invalid" {
+			t.Errorf("expected a system domain to be rejected, got %q", r.form.Get("text"))
+		}
+	}
+	if d := w.customDomain("notboxt.us"); d == nil {
+		t.Error("expected a domain only ending like a system host to be registered")
+	}
+}
+
+func TestCatchAll(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.LimitIntervalSeconds = 60
+	w.cfg.LimitWindowSeconds = 120
+	addTestDomain(w, 1, "example.com", true)
+	addTestDomain(w, 2, "example.org", false)
+	if a := w.addressForRecipient("random", "example.org"); a != nil {
+		t.Errorf("expected no address without catch-all, got %+v", a)
+	}
+	// the window lets through as many emails as fit in it and one more
+	for i := 0; i < 4; i++ {
+		chatID, err := w.chatForUsername(chatForUsernameArgs{username: "random" + strings.Repeat("x", i), host: "example.com"})
+		if err != nil || chatID != 1 {
+			t.Fatalf("expected any address to reach chat 1, got %d, %v", chatID, err)
+		}
+	}
+	if _, err := w.chatForUsername(chatForUsernameArgs{username: "other", host: "example.com"}); err != errorTooManyEmails {
+		t.Errorf("expected addresses of the domain to share the rate limit, got %v", err)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from addresses")); n != 0 {
+		t.Errorf("expected no addresses to be stored, got %d", n)
+	}
+	if _, _, _, ok := w.chatAddress(2, "random@example.com"); ok {
+		t.Error("expected another chat not to own the address")
+	}
+	w.mute(1, "random@example.com")
+	if a := w.addressForRecipient("random", "example.com"); a == nil || !a.muted {
+		t.Errorf("expected the muted address to be stored, got %+v", a)
+	}
+}
+
+func TestRemoveDomain(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	for i, domain := range []string{"example.com", "example.org"} {
+		addTestDomain(w, 1, domain, false)
+		w.mustExec("insert into addresses (chat_id, username, host) values (1,'alice',?)", domain)
+		w.mustExec("insert into muted_tags (username, host, tag) values ('alice',?,'news')", domain)
+		w.mustExec("insert into sender_rules (chat_id, username, host, sender) values (1,'alice',?,'spam@example.net')", domain)
+		w.mustExec("insert into digest_emails (chat_id, username, host, data, created, sent) values (1,'alice',?,'',0,0)", domain)
+		w.mustExec(`
+			insert into forwarded_emails (chat_id, telegram_message_id, message_id, sender, address, subject, refs, created)
+			values (1,?,'','',?,'','',0)`, i, "alice@"+domain)
+		w.mustExec(`
+			insert into email_actions (chat_id, address, sender, headers, message_ids, created)
+			values (1,?,'','','[]',0)`, "alice@"+domain)
+	}
+	w.removeDomain("example.com")
+	for _, table := range []string{"domains", "addresses", "muted_tags", "sender_rules", "digest_emails", "forwarded_emails", "email_actions"} {
+		if n := singleInt(w.db.QueryRow("select count(*) from " + table)); n != 1 {
+			t.Errorf("expected only rows of the other domain in %s, got %d", table, n)
+		}
+	}
+}
@@ -2,6 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"html"
+	"net"
+	"strings"
+	"time"
 
 	"github.com/igrmk/go-smtpd/smtpd"
 	"github.com/jhillyerd/enmime"
@@ -12,11 +17,22 @@ type env struct {
 	from              smtpd.MailAddress
 	data              []byte
 	mime              *enmime.Envelope
-	host              string
-	chatIDs           map[int64]bool
+	cfg               *config
+	resolver          resolver
+	ip                net.IP
+	helo              string
+	dnsbl             dnsblResult
+	spf               spfResult
+	spfChecked        bool
+	dkim              []dkimResult
+	dmarc             dmarcResult
+	dmarcAction       string
+	authLines         []string
+	recipients        map[int64][]string
+	discarded         bool
 	chatForUsernameCh chan<- chatForUsernameArgs
-	deliverCh         chan<- deliverArgs
-	maxSize           int
+	greylistCh        chan<- greylistArgs
+	spoolCh           chan<- spoolArgs
 }
 
 type chatForUsernameResult struct {
@@ -27,33 +43,58 @@ type chatForUsernameResult struct {
 type chatForUsernameArgs struct {
 	result   chan chatForUsernameResult
 	username string
-}
-
-type deliverArgs struct {
-	result chan error
-	env    *env
+	host     string
+	sender   string
 }
 
 // Close implements smtpd.Envelope.Close
 func (e *env) Close() error {
-	if len(e.chatIDs) == 0 {
+	if len(e.recipients) == 0 && e.discarded {
+		return nil
+	}
+	if len(e.recipients) == 0 {
 		return smtpd.SMTPError("550 bad recipient")
 	}
+	if err := e.parse(); err != nil {
+		return err
+	}
+	if err := e.authenticate(); err != nil {
+		return err
+	}
+	e.authLines = e.authenticationLines()
+	return e.spool()
+}
+
+func (e *env) parse() error {
 	mime, err := enmime.ReadEnvelope(bytes.NewReader(e.data))
 	if err != nil {
 		return err
 	}
 	e.mime = mime
-	if err := e.deliver(); err != nil {
-		return err
-	}
 	return nil
 }
 
+// formattedBody returns the body of the email in Telegram HTML
+func (e *env) formattedBody() string {
+	if e.mime.HTML != "" {
+		return telegramHTML(e.mime.HTML)
+	}
+	return html.EscapeString(e.mime.Text)
+}
+
+// authenticationLines returns the lines describing sender checks for the forwarded email
+func (e *env) authenticationLines() (lines []string) {
+	lines = append(lines, e.dnsblLines()...)
+	lines = append(lines, e.spfLines()...)
+	lines = append(lines, e.dkimLines()...)
+	lines = append(lines, e.dmarcLines()...)
+	return
+}
+
 // Write implements smtpd.Envelope.Write
 func (e *env) Write(line []byte) error {
 	e.data = append(e.data, line...)
-	if len(e.data) > e.maxSize {
+	if len(e.data) > e.cfg.MaxSize {
 		return smtpd.SMTPError("552 5.3.4 message too big")
 	}
 	return nil
@@ -61,32 +102,92 @@ func (e *env) Write(line []byte) error {
 
 // AddRecipient implements smtpd.Envelope.AddRecipient
 func (e *env) AddRecipient(rcpt smtpd.MailAddress) error {
-	username, host := splitAddress(rcpt.Email())
-	if host != e.host {
+	recipient := strings.ToLower(rcpt.Email())
+	username, host := splitAddress(recipient)
+	if username == "" || host == "" {
 		return smtpd.SMTPError("550 bad recipient")
 	}
-	chatID, err := e.chatForUsername(username)
+	if e.cfg.DNSBLRejectScore > 0 && e.dnsbl.score >= e.cfg.DNSBLRejectScore {
+		return smtpd.SMTPError("554 5.7.1 client host is blocklisted")
+	}
+	if err := e.checkSPF(); err != nil {
+		return err
+	}
+	if err := e.greylist(recipient); err != nil {
+		return err
+	}
+	chatID, err := e.chatForUsername(username, host)
 	if err == errorMuted {
 		return smtpd.SMTPError("550 bad recipient")
 	}
 	if err == errorTooManyEmails {
 		return smtpd.SMTPError("452 too many emails")
 	}
-	e.chatIDs[chatID] = true
+	if err == errorBlocked {
+		return smtpd.SMTPError("550 5.7.1 sender is blocked")
+	}
+	if err == errorDiscarded {
+		e.discarded = true
+		return e.BasicEnvelope.AddRecipient(rcpt)
+	}
+	e.recipients[chatID] = append(e.recipients[chatID], recipient)
 	return e.BasicEnvelope.AddRecipient(rcpt)
 }
 
-func (e *env) deliver() error {
-	result := make(chan error)
-	defer close(result)
-	e.deliverCh <- deliverArgs{result: result, env: e}
-	return <-result
-}
-
-func (e *env) chatForUsername(username string) (int64, error) {
+func (e *env) chatForUsername(username string, host string) (int64, error) {
 	resultCh := make(chan chatForUsernameResult)
 	defer close(resultCh)
-	e.chatForUsernameCh <- chatForUsernameArgs{result: resultCh, username: username}
+	e.chatForUsernameCh <- chatForUsernameArgs{result: resultCh, username: username, host: host, sender: e.from.Email()}
 	result := <-resultCh
 	return result.chatID, result.err
 }
+
+// checkSPF checks SPF once per envelope and rejects the email if configured so
+func (e *env) checkSPF() error {
+	if e.cfg.SPFPolicy == "" && e.cfg.DMARCPolicy == "" {
+		return nil
+	}
+	if !e.spfChecked {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(e.cfg.TimeoutSeconds))
+		defer cancel()
+		e.spf = checkSPF(ctx, e.resolver, e.ip, e.from.Email(), e.helo)
+		e.spfChecked = true
+	}
+	if e.cfg.SPFPolicy == spfPolicyReject && e.spf == spfFail {
+		return smtpd.SMTPError("550 5.7.23 SPF validation failed")
+	}
+	return nil
+}
+
+// authenticate verifies DKIM signatures and applies DMARC policy
+func (e *env) authenticate() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(e.cfg.TimeoutSeconds))
+	defer cancel()
+	if e.cfg.VerifyDKIM || e.cfg.DMARCPolicy != "" {
+		e.dkim = verifyDKIM(ctx, e.resolver, e.data, time.Now())
+	}
+	if e.cfg.DMARCPolicy == "" {
+		return nil
+	}
+	from, err := e.mime.AddressList("From")
+	if err != nil || len(from) != 1 {
+		return nil
+	}
+	_, fromDomain := splitAddress(from[0].Address)
+	_, mailFromDomain := splitAddress(spfSender(e.from.Email(), e.helo))
+	e.dmarc, err = checkDMARC(ctx, e.resolver, fromDomain, mailFromDomain, e.spf, e.dkim)
+	if err != nil {
+		linf("cannot check DMARC for %s: %v", fromDomain, err)
+		return nil
+	}
+	e.dmarcAction = dmarcAction(e.cfg.DMARCPolicy, e.dmarc)
+	if e.dmarcAction == dmarcPolicyReject {
+		return smtpd.SMTPError("550 5.7.1 rejected due to DMARC policy")
+	}
+	return nil
+}
+
+// notify returns true if the email should be delivered with a notification
+func (e *env) notify() bool {
+	return e.dmarcAction != dmarcPolicyQuarantine
+}
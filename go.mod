@@ -7,4 +7,5 @@ require (
 	github.com/igrmk/go-smtpd v0.0.0-20200226134452-549db983e4e7
 	github.com/jhillyerd/enmime v0.7.0
 	github.com/mattn/go-sqlite3 v1.14.11
+	golang.org/x/net v0.0.0-20190724013045-ca1201d0de80
 )
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/igrmk/go-smtpd/smtpd"
+)
+
+var errorGreylisted = errors.New("Greylisted")
+
+type greylistArgs struct {
+	result    chan error
+	ip        net.IP
+	sender    string
+	recipient string
+}
+
+// greylistNetwork returns the /24 network for IPv4 and /64 network for IPv6 addresses
+func greylistNetwork(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+func senderDomain(sender string) string {
+	_, domain := splitAddress(sender)
+	return domain
+}
+
+// greylist checks the (network, sender, recipient) triplet
+func (w *worker) greylist(g greylistArgs) error {
+	address := w.addressForRecipient(splitAddress(g.recipient))
+	if address == nil || address.muted {
+		return errorMuted
+	}
+	network := greylistNetwork(g.ip)
+	now := time.Now().Unix()
+	whitelisted := w.db.QueryRow(
+		"select count(*) from greylist_whitelist where network=? and sender_domain=?",
+		network,
+		senderDomain(g.sender))
+	if singleInt(whitelisted) > 0 {
+		return nil
+	}
+	query, err := w.db.Query(
+		"select first_seen from greylist where network=? and sender=? and recipient=?",
+		network,
+		g.sender,
+		g.recipient)
+	checkErr(err)
+	var firstSeen int64
+	found := query.Next()
+	if found {
+		checkErr(query.Scan(&firstSeen))
+	}
+	checkErr(query.Close())
+	if !found {
+		w.mustExec(
+			"insert into greylist (network, sender, recipient, first_seen, last_seen) values (?,?,?,?,?)",
+			network,
+			g.sender,
+			g.recipient,
+			now,
+			now)
+		return errorGreylisted
+	}
+	w.mustExec(
+		"update greylist set last_seen=? where network=? and sender=? and recipient=?",
+		now,
+		network,
+		g.sender,
+		g.recipient)
+	if now-firstSeen < int64(w.cfg.GreylistDelaySeconds) {
+		return errorGreylisted
+	}
+	w.mustExec(
+		"update greylist set passed=1 where network=? and sender=? and recipient=?",
+		network,
+		g.sender,
+		g.recipient)
+	return nil
+}
+
+// learnGreylistWhitelist whitelists the network and the sender domain of a delivered email
+func (w *worker) learnGreylistWhitelist(e *env) {
+	if w.cfg.GreylistDelaySeconds == 0 || e.ip == nil {
+		return
+	}
+	w.mustExec(
+		"insert or replace into greylist_whitelist (network, sender_domain, last_seen) values (?,?,?)",
+		greylistNetwork(e.ip),
+		senderDomain(e.from.Email()),
+		time.Now().Unix())
+}
+
+// purgeGreylist removes expired triplets and whitelist entries
+func (w *worker) purgeGreylist() {
+	now := time.Now().Unix()
+	w.mustExec("delete from greylist where passed=0 and last_seen<?", now-int64(w.cfg.GreylistExpirySeconds))
+	w.mustExec("delete from greylist where passed=1 and last_seen<?", now-int64(w.cfg.GreylistWhitelistSeconds))
+	w.mustExec("delete from greylist_whitelist where last_seen<?", now-int64(w.cfg.GreylistWhitelistSeconds))
+}
+
+// greylist asks the main loop to check the triplet for the recipient
+func (e *env) greylist(rcpt string) error {
+	if e.cfg.GreylistDelaySeconds == 0 || e.ip == nil {
+		return nil
+	}
+	resultCh := make(chan error)
+	defer close(resultCh)
+	e.greylistCh <- greylistArgs{
+		result:    resultCh,
+		ip:        e.ip,
+		sender:    e.from.Email(),
+		recipient: rcpt,
+	}
+	switch <-resultCh {
+	case errorMuted:
+		return smtpd.SMTPError("550 bad recipient")
+	case errorGreylisted:
+		return smtpd.SMTPError("451 4.7.1 greylisted, please try again later")
+	}
+	return nil
+}
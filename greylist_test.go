@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newGreylistTestWorker(t *testing.T) *worker {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.GreylistDelaySeconds = 300
+	w.cfg.GreylistExpirySeconds = 3600
+	w.cfg.GreylistWhitelistSeconds = 86400
+	addTestAddresses(w, 2)
+	return w
+}
+
+func greylistTestArgs(ip string, sender string, chatID int) greylistArgs {
+	return greylistArgs{ip: net.ParseIP(ip), sender: sender, recipient: testUsername(chatID) + "@" + testHost}
+}
+
+func TestGreylist(t *testing.T) {
+	w := newGreylistTestWorker(t)
+	g := greylistTestArgs("192.0.2.1", "alice@example.com", 1)
+	if err := w.greylist(g); err != errorGreylisted {
+		t.Fatalf("expected the first attempt to be greylisted, got %v", err)
+	}
+	if err := w.greylist(g); err != errorGreylisted {
+		t.Fatalf("expected a retry within the delay to be greylisted, got %v", err)
+	}
+	w.mustExec("update greylist set first_seen=first_seen-300")
+	if err := w.greylist(g); err != nil {
+		t.Fatalf("expected a retry after the delay to pass, got %v", err)
+	}
+	if err := w.greylist(greylistTestArgs("192.0.2.200", "alice@example.com", 1)); err != nil {
+		t.Errorf("expected a retry from the same network to pass, got %v", err)
+	}
+	for _, other := range []greylistArgs{
+		greylistTestArgs("198.51.100.1", "alice@example.com", 1),
+		greylistTestArgs("192.0.2.1", "bob@example.com", 1),
+		greylistTestArgs("192.0.2.1", "alice@example.com", 2),
+	} {
+		if err := w.greylist(other); err != errorGreylisted {
+			t.Errorf("expected another triplet %v to be greylisted, got %v", other, err)
+		}
+	}
+	if err := w.greylist(greylistArgs{ip: net.ParseIP("192.0.2.1"), sender: "alice@example.com", recipient: "nobody@" + testHost}); err != errorMuted {
+		t.Errorf("expected an unknown recipient to be rejected, got %v", err)
+	}
+}
+
+func TestGreylistWhitelist(t *testing.T) {
+	w := newGreylistTestWorker(t)
+	e := testEnv(w, 1, 1)
+	e.ip = net.ParseIP("192.0.2.1")
+	w.learnGreylistWhitelist(e)
+	if err := w.greylist(greylistTestArgs("192.0.2.7", "someone@example.com", 2)); err != nil {
+		t.Errorf("expected the domain to be whitelisted for the network, got %v", err)
+	}
+	if err := w.greylist(greylistTestArgs("198.51.100.1", "someone@example.com", 2)); err != errorGreylisted {
+		t.Errorf("expected the domain to be greylisted for another network, got %v", err)
+	}
+}
+
+func TestGreylistExpiry(t *testing.T) {
+	w := newGreylistTestWorker(t)
+	passed := greylistTestArgs("192.0.2.1", "alice@example.com", 1)
+	unconfirmed := greylistTestArgs("192.0.2.1", "bob@example.com", 1)
+	_ = w.greylist(passed)
+	w.mustExec("update greylist set first_seen=first_seen-300")
+	if err := w.greylist(passed); err != nil {
+		t.Fatal(err)
+	}
+	_ = w.greylist(unconfirmed)
+	now := time.Now().Unix()
+	w.mustExec("update greylist set last_seen=?", now-int64(w.cfg.GreylistExpirySeconds)-1)
+	w.purgeGreylist()
+	if err := w.greylist(unconfirmed); err != errorGreylisted {
+		t.Fatalf("expected the expired triplet to start over, got %v", err)
+	}
+	w.mustExec("update greylist set first_seen=first_seen-300 where sender='bob@example.com'")
+	if err := w.greylist(unconfirmed); err != nil {
+		t.Errorf("expected a restarted triplet to pass after the delay, got %v", err)
+	}
+	if err := w.greylist(passed); err != nil {
+		t.Errorf("expected the confirmed triplet to be kept, got %v", err)
+	}
+	w.mustExec("update greylist set last_seen=? where sender='alice@example.com'", now-int64(w.cfg.GreylistWhitelistSeconds)-1)
+	w.purgeGreylist()
+	if err := w.greylist(passed); err != errorGreylisted {
+		t.Errorf("expected the confirmed triplet to expire, got %v", err)
+	}
+}
+
+func TestGreylistNetwork(t *testing.T) {
+	for ip, network := range map[string]string{
+		"192.0.2.77":           "192.0.2.0",
+		"2001:db8:1:2:3:4:5:6": "2001:db8:1:2::",
+	} {
+		if n := greylistNetwork(net.ParseIP(ip)); n != network {
+			t.Errorf("%s: got %s, expected %s", ip, n, network)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"strings"
+)
+
+// hostCertificate is a certificate for an additional system host
+type hostCertificate struct {
+	Host           string `json:"host"`            // the host name
+	Certificate    string `json:"certificate"`     // certificate path
+	CertificateKey string `json:"certificate_key"` // certificate key path
+}
+
+// systemHosts returns all hosts served by the instance, the primary one first
+func (w *worker) systemHosts() []string {
+	return append([]string{w.cfg.Host}, w.cfg.Hosts...)
+}
+
+// isOurHost returns true if the host is one of the system hosts
+func (w *worker) isOurHost(host string) bool {
+	for _, h := range w.systemHosts() {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
+
+// newAddressHost returns the host for a new address of the chat,
+// it is either chosen by the user or a random system host
+func (w *worker) newAddressHost(chatID int64) string {
+	query, err := w.db.Query("select preferred_host from users where chat_id=?", chatID)
+	checkErr(err)
+	defer query.Close()
+	if query.Next() {
+		var host string
+		checkErr(query.Scan(&host))
+		if w.isOurHost(host) {
+			return host
+		}
+	}
+	hosts := w.systemHosts()
+	return hosts[rand.Intn(len(hosts))]
+}
+
+// host shows available hosts or sets the preferred host for new addresses
+func (w *worker) host(chatID int64, arguments string) {
+	host := strings.ToLower(strings.TrimSpace(arguments))
+	if host == "" {
+		lines := []string{"New addresses are created on one of these hosts:"}
+		lines = append(lines, w.systemHosts()...)
+		lines = append(lines, "", "Command format: /host <host> or /host any")
+		_ = w.sendText(chatID, false, parseRaw, strings.Join(lines, "\n"))
+		return
+	}
+	if host == "any" {
+		w.mustExec("update users set preferred_host='' where chat_id=?", chatID)
+		_ = w.sendText(chatID, false, parseRaw, "OK")
+		return
+	}
+	if !w.isOurHost(host) {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Unknown host, available hosts are %s", strings.Join(w.systemHosts(), ", ")))
+		return
+	}
+	w.mustExec("update users set preferred_host=? where chat_id=?", host, chatID)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
+
+// loadTLS loads the primary certificate and certificates for additional hosts selected by SNI,
+// the primary certificate is used for other server names
+func loadTLS(certFile string, keyFile string, hosts []hostCertificate) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	byHost := make(map[string]*tls.Certificate)
+	for _, h := range hosts {
+		hostCert, err := tls.LoadX509KeyPair(h.Certificate, h.CertificateKey)
+		if err != nil {
+			return nil, err
+		}
+		leaf, err := x509.ParseCertificate(hostCert.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		if err := leaf.VerifyHostname(h.Host); err != nil {
+			return nil, err
+		}
+		byHost[h.Host] = &hostCert
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if c := byHost[strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))]; c != nil {
+				return c, nil
+			}
+			return &cert, nil
+		},
+	}, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate writes a self-signed certificate for the host and returns the paths of the certificate and the key
+func writeTestCertificate(t *testing.T, host string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	checkErr(ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	checkErr(ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func certificateHost(t *testing.T, c *tls.Certificate) string {
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestLoadTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t, "boxt.us")
+	meCert, meKey := writeTestCertificate(t, "boxt.me")
+	cfg, err := loadTLS(certFile, keyFile, []hostCertificate{{Host: "boxt.me", Certificate: meCert, CertificateKey: meKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for serverName, host := range map[string]string{"boxt.me": "boxt.me", "BOXT.ME.": "boxt.me", "boxt.us": "boxt.us", "": "boxt.us"} {
+		c, err := cfg.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h := certificateHost(t, c); h != host {
+			t.Errorf("server name %q got the certificate of %s, expected %s", serverName, h, host)
+		}
+	}
+	if _, err := loadTLS(certFile, keyFile, []hostCertificate{{Host: "boxt.io", Certificate: meCert, CertificateKey: meKey}}); err == nil {
+		t.Error("expected a certificate not covering its host to be rejected")
+	}
+}
+
+func testConfig() *config {
+	return &config{
+		BotName:               "boxt_bot",
+		MailAddress:           ":25",
+		MaxSize:               1 << 20,
+		MaxTextChunkSize:      4096,
+		ListenAddress:         ":8080",
+		ListenPath:            "/bot",
+		Host:                  testHost,
+		BotToken:              testBotToken,
+		TimeoutSeconds:        10,
+		AdminID:               1,
+		DBPath:                "boxt.sqlite",
+		StatPassword:          "password",
+		FreeEmails:            1,
+		ReferralBonus:         1,
+		FollowerBonus:         1,
+		SpamSecret:            "spam secret",
+		Certificate:           "cert.pem",
+		CertificateKey:        "key.pem",
+		LimitIntervalSeconds:  60,
+		LimitWindowSeconds:    600,
+		BlockedBackoffSeconds: 60,
+		SpoolRetrySeconds:     60,
+		SpoolExpirySeconds:    3600,
+		SpoolHoldSeconds:      600,
+		SpoolSecret:           "spool secret",
+		DeliveryWorkers:       1,
+	}
+}
+
+func TestCheckConfigHosts(t *testing.T) {
+	cert := func(host string) hostCertificate {
+		return hostCertificate{Host: host, Certificate: "cert.pem", CertificateKey: "key.pem"}
+	}
+	cases := []struct {
+		name  string
+		hosts []string
+		certs []hostCertificate
+		ok    bool
+	}{
+		{name: "hosts with certificates", hosts: []string{"boxt.me", "boxt.io"}, certs: []hostCertificate{cert("boxt.me"), cert("boxt.io")}, ok: true},
+		{name: "host without certificate", hosts: []string{"boxt.me"}, ok: true},
+		{name: "primary host repeated", hosts: []string{testHost}},
+		{name: "duplicate host", hosts: []string{"boxt.me", "boxt.me"}},
+		{name: "uppercase host", hosts: []string{"BOXT.ME"}},
+		{name: "certificate for unknown host", hosts: []string{"boxt.me"}, certs: []hostCertificate{cert("boxt.io")}},
+		{name: "certificate for primary host", certs: []hostCertificate{cert(testHost)}},
+		{name: "duplicate certificate", hosts: []string{"boxt.me"}, certs: []hostCertificate{cert("boxt.me"), cert("boxt.me")}},
+	}
+	for _, c := range cases {
+		cfg := testConfig()
+		cfg.Hosts, cfg.HostCertificates = c.hosts, c.certs
+		if err := checkConfig(cfg); (err == nil) != c.ok {
+			t.Errorf("%s: got %v", c.name, err)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"html"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	xhtml "golang.org/x/net/html"
+)
+
+// telegramTags maps HTML elements to formatting tags supported by Telegram
+var telegramTags = map[string]string{
+	"b":          "b",
+	"strong":     "b",
+	"h1":         "b",
+	"h2":         "b",
+	"h3":         "b",
+	"h4":         "b",
+	"h5":         "b",
+	"h6":         "b",
+	"i":          "i",
+	"em":         "i",
+	"cite":       "i",
+	"u":          "u",
+	"ins":        "u",
+	"s":          "s",
+	"strike":     "s",
+	"del":        "s",
+	"code":       "code",
+	"kbd":        "code",
+	"samp":       "code",
+	"tt":         "code",
+	"pre":        "pre",
+	"blockquote": "blockquote",
+}
+
+// blockElements start on a new line
+var blockElements = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "center": true, "dd": true,
+	"div": true, "dl": true, "dt": true, "fieldset": true, "figure": true, "footer": true,
+	"form": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true, "p": true,
+	"pre": true, "section": true, "table": true, "tr": true, "ul": true,
+}
+
+// paragraphElements are separated by an empty line
+var paragraphElements = map[string]bool{
+	"blockquote": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"hr": true, "ol": true, "p": true, "pre": true, "table": true, "ul": true,
+}
+
+// skippedElements are not rendered at all
+var skippedElements = map[string]bool{
+	"head": true, "noscript": true, "object": true, "script": true, "style": true,
+	"svg": true, "template": true, "title": true,
+}
+
+type htmlList struct {
+	ordered bool
+	n       int
+}
+
+// htmlRenderer renders an HTML document into Telegram HTML
+type htmlRenderer struct {
+	b        strings.Builder
+	newlines int
+	hasText  bool
+	space    bool
+	pre      int
+	code     int
+	link     int
+	lists    []htmlList
+}
+
+// telegramHTML converts an HTML email into the subset of HTML supported by Telegram,
+// all other markup is dropped
+func telegramHTML(src string) string {
+	doc, err := xhtml.Parse(strings.NewReader(src))
+	if err != nil {
+		return html.EscapeString(src)
+	}
+	r := &htmlRenderer{}
+	r.render(doc)
+	return r.b.String()
+}
+
+func (r *htmlRenderer) newline(n int) {
+	if n > r.newlines {
+		r.newlines = n
+	}
+	r.space = false
+}
+
+func (r *htmlRenderer) flush() {
+	if r.hasText && r.newlines > 0 {
+		r.b.WriteString(strings.Repeat("\n", r.newlines))
+	} else if r.hasText && r.space {
+		r.b.WriteString(" ")
+	}
+	r.newlines = 0
+	r.space = false
+}
+
+func (r *htmlRenderer) writeText(s string) {
+	if s == "" {
+		return
+	}
+	r.flush()
+	r.b.WriteString(html.EscapeString(s))
+	r.hasText = true
+}
+
+func (r *htmlRenderer) text(s string) {
+	if r.pre > 0 {
+		r.writeText(s)
+		return
+	}
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			r.space = r.space || r.newlines == 0
+		}
+		return
+	}
+	if startsWithSpace(s) && r.newlines == 0 {
+		r.space = true
+	}
+	r.writeText(strings.Join(words, " "))
+	if endsWithSpace(s) {
+		r.space = true
+	}
+}
+
+func startsWithSpace(s string) bool {
+	c, _ := utf8.DecodeRuneInString(s)
+	return strings.ContainsRune(" \t\r\n\f ", c)
+}
+
+func endsWithSpace(s string) bool {
+	c, _ := utf8.DecodeLastRuneInString(s)
+	return strings.ContainsRune(" \t\r\n\f ", c)
+}
+
+// openTag writes a formatting tag, formatting inside code is not allowed by Telegram
+func (r *htmlRenderer) openTag(tag string, attributes string) bool {
+	if r.code > 0 {
+		return false
+	}
+	r.flush()
+	r.b.WriteString("<" + tag + attributes + ">")
+	return true
+}
+
+func linkTarget(n *xhtml.Node) string {
+	for _, a := range n.Attr {
+		if strings.ToLower(a.Key) != "href" {
+			continue
+		}
+		href := strings.TrimSpace(a.Val)
+		lower := strings.ToLower(href)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") || strings.HasPrefix(lower, "mailto:") {
+			return href
+		}
+	}
+	return ""
+}
+
+func (r *htmlRenderer) render(n *xhtml.Node) {
+	switch n.Type {
+	case xhtml.TextNode:
+		r.text(n.Data)
+		return
+	case xhtml.ElementNode:
+	default:
+		r.renderChildren(n)
+		return
+	}
+	name := strings.ToLower(n.Data)
+	if skippedElements[name] {
+		return
+	}
+	paragraph := paragraphElements[name] && len(r.lists) == 0
+	switch name {
+	case "br":
+		r.newlines++
+		r.space = false
+		return
+	case "img":
+		return
+	case "td", "th":
+		r.space = true
+		r.renderChildren(n)
+		r.space = true
+		return
+	case "ul", "ol":
+		r.lists = append(r.lists, htmlList{ordered: name == "ol"})
+		defer func() { r.lists = r.lists[:len(r.lists)-1] }()
+	case "li":
+		r.newline(1)
+		marker := "• "
+		if len(r.lists) > 0 {
+			l := &r.lists[len(r.lists)-1]
+			if l.ordered {
+				l.n++
+				marker = strconv.Itoa(l.n) + ". "
+			}
+		}
+		indent := 0
+		if len(r.lists) > 1 {
+			indent = len(r.lists) - 1
+		}
+		r.writeText(strings.Repeat("  ", indent) + marker)
+		r.renderChildren(n)
+		r.newline(1)
+		return
+	}
+	if paragraph {
+		r.newline(2)
+	} else if blockElements[name] {
+		r.newline(1)
+	}
+
+	tag, attributes := telegramTags[name], ""
+	if name == "a" {
+		if href := linkTarget(n); href != "" && r.link == 0 {
+			tag, attributes = "a", ` href="`+html.EscapeString(href)+`"`
+		}
+	}
+	opened := tag != "" && r.openTag(tag, attributes)
+	switch tag {
+	case "pre":
+		r.pre++
+		r.code++
+		defer func() { r.pre--; r.code-- }()
+	case "code":
+		r.code++
+		defer func() { r.code-- }()
+	case "a":
+		r.link++
+		defer func() { r.link-- }()
+	}
+	r.renderChildren(n)
+	if opened {
+		r.b.WriteString("</" + tag + ">")
+	}
+
+	if paragraph {
+		r.newline(2)
+	} else if blockElements[name] {
+		r.newline(1)
+	}
+}
+
+func (r *htmlRenderer) renderChildren(n *xhtml.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		r.render(c)
+	}
+}
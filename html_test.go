@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestTelegramHTML(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		html     string
+		expected string
+	}{
+		{
+			name:     "formatting and paragraphs",
+			html:     `<html><head><title>T</title><style>p{}</style></head><body><p>Hello <b>bold</b> and <strong>strong</strong></p><p>Second</p></body></html>`,
+			expected: "Hello <b>bold</b> and <b>strong</b>\n\nSecond",
+		},
+		{
+			name:     "escaping",
+			html:     `<p>a &lt; b &amp; c</p>`,
+			expected: "a &lt; b &amp; c",
+		},
+		{
+			name:     "scripts",
+			html:     `<script>alert(1)</script><p>text</p>`,
+			expected: "text",
+		},
+		{
+			name:     "links",
+			html:     `<a href="https://example.com/?a=1&amp;b=2">link</a> <a href="javascript:alert(1)">bad</a>`,
+			expected: `<a href="https://example.com/?a=1&amp;b=2">link</a> bad`,
+		},
+		{
+			name:     "lists",
+			html:     `<ul><li>one</li><li>two<ol><li>sub</li></ol></li></ul>`,
+			expected: "• one\n• two\n  1. sub",
+		},
+		{
+			name:     "preformatted",
+			html:     "<pre>  keep\n  spaces <b>no</b></pre>",
+			expected: "<pre>  keep\n  spaces no</pre>",
+		},
+		{
+			name:     "formatting inside code",
+			html:     `<code><i>x</i></code>`,
+			expected: "<code>x</code>",
+		},
+		{
+			name:     "line breaks",
+			html:     `line<br>break<br><br>two`,
+			expected: "line\nbreak\n\ntwo",
+		},
+		{
+			name:     "tables",
+			html:     `<table><tr><td>a</td><td>b</td></tr><tr><td>c</td><td>d</td></tr></table>`,
+			expected: "a b\nc d",
+		},
+		{
+			name:     "whitespace and images",
+			html:     "<div>  many    spaces\n here </div><img src=\"x.png\">",
+			expected: "many spaces here",
+		},
+		{
+			name:     "headings and quotes",
+			html:     `<h1>Title</h1><blockquote>quote</blockquote><span class="x">plain</span>`,
+			expected: "<b>Title</b>\n\n<blockquote>quote</blockquote>\n\nplain",
+		},
+	} {
+		if result := telegramHTML(c.html); result != c.expected {
+			t.Errorf("%s: got %q, expected %q", c.name, result, c.expected)
+		}
+	}
+}
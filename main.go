@@ -6,16 +6,18 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
 	"math/rand"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
-	"unicode/utf8"
 
 	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/igrmk/go-smtpd/smtpd"
@@ -30,11 +32,14 @@ func checkErr(err error) {
 }
 
 type worker struct {
-	bot    *tg.BotAPI
-	db     *sql.DB
-	cfg    *config
-	client *http.Client
-	tls    *tls.Config
+	bot       *tg.BotAPI
+	db        *sql.DB
+	cfg       *config
+	client    *http.Client
+	tls       *tls.Config
+	resolver  resolver
+	scheduler *sendScheduler
+	dkim      map[string]*dkimSigner
 }
 
 func newWorker() *worker {
@@ -42,29 +47,50 @@ func newWorker() *worker {
 		panic("usage: boxt <config>")
 	}
 	cfg := readConfig(os.Args[1])
-	tls, err := loadTLS(cfg.Certificate, cfg.CertificateKey)
+	tls, err := loadTLS(cfg.Certificate, cfg.CertificateKey, cfg.HostCertificates)
 	checkErr(err)
 	client := &http.Client{Timeout: time.Second * time.Duration(cfg.TimeoutSeconds)}
-	bot, err := tg.NewBotAPIWithClient(cfg.BotToken, tg.APIEndpoint, client)
+	bot, err := newBot(cfg, client)
 	checkErr(err)
-	db, err := sql.Open("sqlite3", cfg.DBPath)
+	dkim, err := loadDKIMSigners(cfg.DKIMKeys)
+	checkErr(err)
+	db, err := openDatabase(cfg.DBPath)
 	checkErr(err)
 	w := &worker{
-		bot:    bot,
-		db:     db,
-		cfg:    cfg,
-		client: client,
-		tls:    tls,
+		bot:       bot,
+		db:        db,
+		cfg:       cfg,
+		client:    client,
+		tls:       tls,
+		resolver:  newResolver(cfg.DNSServer),
+		scheduler: newSendScheduler(),
+		dkim:      dkim,
 	}
 
 	return w
 }
 
+func openDatabase(path string) (*sql.DB, error) {
+	// deliveries and commands access the database concurrently
+	return sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=10000&_txlock=immediate")
+}
+
+// newBot connects to the Bot API, a local Bot API server or a stand-in can replace the official one
+func newBot(cfg *config, client *http.Client) (*tg.BotAPI, error) {
+	endpoint := cfg.BotAPIEndpoint
+	if endpoint == "" {
+		endpoint = tg.APIEndpoint
+	}
+	return tg.NewBotAPIWithClient(cfg.BotToken, endpoint, client)
+}
+
 type address struct {
 	chatID       int64
 	username     string
+	host         string
 	muted        bool
 	nextDelivery int64
+	catchAll     bool
 }
 
 var errorMuted = errors.New("Mailbox is muted")
@@ -79,117 +105,184 @@ func splitAddress(a string) (string, string) {
 	return parts[0], parts[1]
 }
 
-func (w *worker) deliver(e *env) error {
-	messageID := e.mime.GetHeader("Message-ID")
-	if messageID == "" {
-		return smtpd.SMTPError("501 Message-ID is not specified")
-	}
-
+// emailHeader returns the header lines shown above the email
+func emailHeader(e *env) []string {
 	subject := e.mime.GetHeader("Subject")
 	from := e.mime.GetHeader("From")
 	to := e.mime.GetHeader("To")
+	header := []string{"Subject: " + subject, "From: " + from, "To: " + to}
+	return append(header, e.authLines...)
+}
 
-	if !utf8.ValidString(subject) {
-		return smtpd.SMTPError("501 Subject is invalid")
-	}
-	if !utf8.ValidString(from) {
-		return smtpd.SMTPError("501 From is invalid")
-	}
-	if !utf8.ValidString(to) {
-		return smtpd.SMTPError("501 To is invalid")
-	}
-	if !utf8.ValidString(e.mime.Text) {
-		return smtpd.SMTPError("501 message is invalid")
-	}
-
-	text := fmt.Sprintf("Subject: %s\nFrom: %s\nTo: %s\n\n%s", subject, from, to, e.mime.Text)
+func (w *worker) deliver(e *env) error {
+	messageID := e.mime.GetHeader("Message-ID")
+	header := emailHeader(e)
 
 	delivered := true
-	for chatID := range e.chatIDs {
+	for chatID := range e.recipients {
 		duplicates := w.db.QueryRow("select count(*) from delivered_ids where chat_id=? and message_id=?", chatID, messageID)
-		if singleInt(duplicates) == 0 {
-			delivered = w.deliverToChat(chatID, messageID, text, e) && delivered
+		if singleInt(duplicates) != 0 {
+			continue
+		}
+		if username, host, ok := w.digestAddress(chatID, e.recipients[chatID]); ok {
+			// other spam actions apply when the digested email is expanded
+			if spam := w.spamCheck(chatID, w.emailSpamText(chatID, header, e)); spam.spam && spam.action == spamActionDrop {
+				linf("dropped spam for chat %d", chatID)
+				w.mustExec("insert into delivered_ids (chat_id, message_id) values (?,?)", chatID, messageID)
+				continue
+			}
+			if err := w.addToDigest(chatID, username, host, messageID, e); err != nil {
+				lerr("cannot add an email to the digest, %v", err)
+				delivered = false
+			}
+			continue
 		}
+		delivered = w.deliverToChat(chatID, messageID, header, e) && delivered
 	}
 	if !delivered {
-		return smtpd.SMTPError("450 mailbox unavailable")
+		return errorDeliveryFailed
 	}
 	return nil
 }
 
-func chunks(s string, chunkSize int) (chunks []string) {
-	if len(s) == 0 {
+func (w *worker) deliverToChat(chatID int64, messageID string, header []string, e *env) bool {
+	err := w.forwardToChat(chatID, messageID, header, e)
+	if isPermanentSendError(err) {
+		// retrying would fail the same way and hold later emails of the chat in the spool
+		lerr("dropping email %s for chat %d, %v", messageID, chatID, err)
+		err = nil
+	}
+	if err != nil {
+		return false
+	}
+	w.mustExec("insert into delivered_ids (chat_id, message_id) values (?,?)", chatID, messageID)
+	return true
+}
+
+// emailSpamText returns the text of the email the spam filter works on
+func (w *worker) emailSpamText(chatID int64, header []string, e *env) string {
+	header = append(header[:len(header):len(header)], w.subaddressLines(e.recipients[chatID])...)
+	return strings.Join(header, "\n") + "\n\n" + e.mime.Text
+}
+
+// forwardToChat sends the email to the chat without recording it as delivered
+func (w *worker) forwardToChat(chatID int64, messageID string, header []string, e *env) error {
+	now := time.Now()
+	spamText := w.emailSpamText(chatID, header, e)
+	spam := w.spamCheck(chatID, spamText)
+	notify := e.notify() && !w.isQuiet(chatID, now)
+	header = append(header[:len(header):len(header)], w.subaddressLines(e.recipients[chatID])...)
+	htmlHeader := html.EscapeString(strings.Join(header, "\n"))
+	text := htmlHeader + "\n\n" + e.formattedBody()
+	forwarded := w.forwardedEmail(chatID, e)
+	parent := w.threadParent(chatID, e)
+	first := true
+	textMessageID := 0
+	actionsID := int64(0)
+	var messageIDs []int
+	send := func(msg baseChattable) error {
+		if first && parent != 0 {
+			msg.baseChat().ReplyToMessageID = parent
+			msg.baseChat().AllowSendingWithoutReply = true
+		}
+		sent, err := w.sendMessage(msg, priorityDelivery)
+		if err != nil {
+			return err
+		}
+		if first {
+			w.rememberThread(chatID, messageID, sent.MessageID)
+			textMessageID = sent.MessageID
+			first = false
+		}
+		w.rememberForwarded(chatID, sent.MessageID, forwarded)
+		messageIDs = append(messageIDs, sent.MessageID)
 		return nil
 	}
-	runes := []rune(s)
-	i := 0
-	for i < len(runes)-chunkSize {
-		eol := i + chunkSize
-		for ; eol > i; eol-- {
-			if runes[eol] == '\n' {
-				break
+	withKeyboard := func(msg *messageConfig) *messageConfig {
+		if actionsID != 0 {
+			msg.ReplyMarkup = w.emailKeyboard(chatID, actionsID, false)
+		}
+		return msg
+	}
+	if spam.spam {
+		spamLine := fmt.Sprintf("SPAM: probability %.0f%%", spam.probability*100)
+		switch spam.action {
+		case spamActionDrop:
+			linf("dropped spam for chat %d", chatID)
+			return nil
+		case spamActionSummary:
+			text = htmlHeader + "\n" + spamLine
+			actionsID = w.newEmailActions(chatID, e, spamText)
+			if err := send(withKeyboard(textMessage(chatID, false, parseHTML, text))); err != nil {
+				return err
 			}
+			w.rememberActionMessages(actionsID, messageIDs)
+			return nil
+		case spamActionMute:
+			notify = false
+			text = htmlHeader + "\n" + spamLine + "\n\n" + e.formattedBody()
 		}
-		if eol == i {
-			chunks = append(chunks, string(runes[i:i+chunkSize]))
-			i += chunkSize
-		} else {
-			chunks = append(chunks, string(runes[i:eol]))
-			i = eol + 1
+	}
+	actionsID = w.newEmailActions(chatID, e, spamText)
+	chunks := chunkHTML(text, w.cfg.MaxTextChunkSize)
+	for i, c := range chunks {
+		msg := textMessage(chatID, notify, parseHTML, c)
+		if i == len(chunks)-1 {
+			msg = withKeyboard(msg)
+		}
+		if err := send(msg); err != nil {
+			return err
 		}
 	}
-	chunks = append(chunks, string(runes[i:]))
-	return
-}
-
-func (w *worker) deliverToChat(chatID int64, messageID string, text string, e *env) bool {
-	chunks := chunks(text, w.cfg.MaxTextChunkSize)
-	for _, c := range chunks {
-		if w.sendText(chatID, true, parseRaw, c) != nil {
-			return false
+	caption := mediaCaption(e.mime.GetHeader("Subject"))
+	files, large := w.oversizedMedia(emailMedia(e))
+	if len(large) > 0 {
+		links, err := w.downloadLinks(large)
+		if err != nil {
+			lerr("cannot store attachments, %v", err)
+			return err
+		}
+		msg := textMessage(chatID, notify, parseHTML, links)
+		msg.ReplyToMessageID = textMessageID
+		if err := send(msg); err != nil {
+			return err
 		}
 	}
-	for _, inline := range e.mime.Inlines {
-		b := tg.FileBytes{Name: inline.FileName, Bytes: inline.Content}
-		switch {
-		case strings.HasPrefix(inline.ContentType, "image/"):
-			msg := tg.NewPhoto(chatID, b)
-			if w.send(&photoConfig{msg}) != nil {
-				return false
-			}
-		case strings.HasPrefix(inline.ContentType, "video/"):
-			msg := tg.NewVideo(chatID, b)
-			if w.send(&videoConfig{msg}) != nil {
-				return false
-			}
-		case strings.HasPrefix(inline.ContentType, "audio/"):
-			msg := tg.NewAudio(chatID, b)
-			if w.send(&audioConfig{msg}) != nil {
-				return false
-			}
-		default:
-			msg := tg.NewDocument(chatID, b)
-			if w.send(&documentConfig{msg}) != nil {
-				return false
+	for _, group := range mediaGroups(files) {
+		if len(group) == 1 {
+			msg := singleMedia(chatID, group[0], caption)
+			msg.baseChat().DisableNotification = !notify
+			msg.baseChat().ReplyToMessageID = textMessageID
+			if err := send(msg); err != nil {
+				return err
 			}
+			continue
 		}
-	}
-	for _, inline := range e.mime.Attachments {
-		b := tg.FileBytes{Name: inline.FileName, Bytes: inline.Content}
-		msg := tg.NewDocument(chatID, b)
-		if w.send(&documentConfig{msg}) != nil {
-			return false
+		album := mediaGroup(chatID, group, caption)
+		album.DisableNotification = !notify
+		album.ReplyToMessageID = textMessageID
+		sent, err := w.sendMediaGroup(album, priorityDelivery)
+		if err != nil {
+			return err
+		}
+		for _, m := range sent {
+			w.rememberForwarded(chatID, m.MessageID, forwarded)
+			messageIDs = append(messageIDs, m.MessageID)
 		}
 	}
-	w.mustExec("insert into delivered_ids (chat_id, message_id) values (?,?)", chatID, messageID)
-	return true
+	w.rememberActionMessages(actionsID, messageIDs)
+	w.rememberQuietEmail(chatID, e, now)
+	return nil
 }
 
 func (w *worker) chatForUsername(u chatForUsernameArgs) (int64, error) {
-	address := w.addressForUsername(u.username)
+	address := w.addressForRecipient(u.username, u.host)
 	if address == nil || address.muted {
 		return 0, errorMuted
 	}
+	if err := w.checkSender(address.chatID, []string{u.username + "@" + u.host}, []string{u.sender}, false); err != nil {
+		return 0, err
+	}
 	now := time.Now().Unix()
 	if address.nextDelivery > now {
 		return 0, errorTooManyEmails
@@ -198,27 +291,72 @@ func (w *worker) chatForUsername(u chatForUsernameArgs) (int64, error) {
 	if now-int64(w.cfg.LimitWindowSeconds) > address.nextDelivery {
 		address.nextDelivery = now - int64(w.cfg.LimitWindowSeconds)
 	}
-	w.mustExec("update addresses set next_delivery=? where username=?", address.nextDelivery, u.username)
+	if address.catchAll {
+		w.mustExec("update domains set next_delivery=? where domain=?", address.nextDelivery, address.host)
+	} else {
+		w.mustExec(
+			"update addresses set next_delivery=? where username=? and host=?",
+			address.nextDelivery,
+			address.username,
+			address.host)
+	}
 	return address.chatID, nil
 }
 
-func envelopeFactory(deliverCh chan deliverArgs, chatForUsernameCh chan chatForUsernameArgs, host string, maxSize int) func(smtpd.Connection, smtpd.MailAddress, *int) (smtpd.Envelope, error) {
+func envelopeFactory(
+	spoolCh chan spoolArgs,
+	chatForUsernameCh chan chatForUsernameArgs,
+	greylistCh chan greylistArgs,
+	cfg *config,
+	resolver resolver,
+	dnsbl *dnsblChecker,
+) func(smtpd.Connection, smtpd.MailAddress, *int) (smtpd.Envelope, error) {
 	return func(c smtpd.Connection, from smtpd.MailAddress, size *int) (smtpd.Envelope, error) {
-		if size != nil && *size > maxSize {
+		if size != nil && *size > cfg.MaxSize {
 			return nil, smtpd.SMTPError("552 5.3.4 message too big")
 		}
+		ip := connectionIP(c)
+		var dnsblResult dnsblResult
+		if dnsbl != nil {
+			dnsblResult = dnsbl.check(ip)
+		}
 		return &env{
 			BasicEnvelope:     &smtpd.BasicEnvelope{},
 			from:              from,
-			deliverCh:         deliverCh,
+			spoolCh:           spoolCh,
 			chatForUsernameCh: chatForUsernameCh,
-			chatIDs:           make(map[int64]bool),
-			host:              host,
-			maxSize:           maxSize,
+			greylistCh:        greylistCh,
+			recipients:        make(map[int64][]string),
+			cfg:               cfg,
+			resolver:          resolver,
+			ip:                ip,
+			helo:              connectionHelo(c),
+			dnsbl:             dnsblResult,
 		}, nil
 	}
 }
 
+func connectionIP(c smtpd.Connection) net.IP {
+	if addr, ok := c.Addr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// connectionHelo returns the HELO or EHLO name of the client,
+// the SMTP library keeps it in the session without exposing it
+func connectionHelo(c smtpd.Connection) string {
+	v := reflect.ValueOf(c)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return ""
+	}
+	host := v.Elem().FieldByName("helloHost")
+	if host.Kind() != reflect.String {
+		return ""
+	}
+	return strings.ToLower(strings.TrimSuffix(host.String(), "."))
+}
+
 func (w *worker) logConfig() {
 	cfgString, err := json.MarshalIndent(w.cfg, "", "    ")
 	checkErr(err)
@@ -267,15 +405,18 @@ func randString(n int) string {
 	return string(b)
 }
 
-func (w *worker) newRandUsername() (username string) {
-	for {
-		username = randString(5)
-		exists := w.db.QueryRow("select count(*) from addresses where username=?", username)
-		if singleInt(exists) == 0 {
-			break
-		}
+// insertAddress creates the address unless it is taken, the unique index on addresses resolves races
+func (w *worker) insertAddress(chatID int64, username, host string) bool {
+	result, err := w.db.Exec("insert into addresses (chat_id, username, host) values (?,?,?) on conflict do nothing", chatID, username, host)
+	checkErr(err)
+	affected, err := result.RowsAffected()
+	checkErr(err)
+	return affected > 0
+}
+
+func (w *worker) newRandAddress(chatID int64, host string) {
+	for !w.insertAddress(chatID, randString(5), host) {
 	}
-	return
 }
 
 func (w *worker) newRandExternalID() (id string) {
@@ -295,9 +436,9 @@ func (w *worker) refer(referrer string) bool {
 		return false
 	}
 	for i := 0; i < w.cfg.ReferralBonus; i++ {
-		username := w.newRandExternalID()
-		w.mustExec("insert into addresses (chat_id, username) values (?,?)", *chatID, username)
+		w.newRandAddress(*chatID, w.newAddressHost(*chatID))
 	}
+	w.mustExec("update users set vanity_allowance=vanity_allowance+? where chat_id=?", w.cfg.VanityReferralBonus, *chatID)
 	return true
 }
 
@@ -333,16 +474,15 @@ func (w *worker) start(chatID int64, referrer string) {
 		if chatID > 0 && referrer != "" {
 			referOK = w.refer(referrer)
 		}
-		temp := w.newRandUsername()
+		temp := w.newRandExternalID()
 		externalID = &temp
-		w.mustExec("insert into users (chat_id, external_id) values (?, ?)", chatID, *externalID)
+		w.mustExec("insert into users (chat_id, external_id, vanity_allowance) values (?,?,?)", chatID, *externalID, w.cfg.VanityAllowance)
 		emails := w.cfg.FreeEmails
 		if referOK {
 			emails += w.cfg.FollowerBonus
 		}
 		for i := 0; i < emails; i++ {
-			username := w.newRandUsername()
-			w.mustExec("insert into addresses (chat_id, username) values (?,?)", chatID, username)
+			w.newRandAddress(chatID, w.newAddressHost(chatID))
 		}
 	}
 	if *externalID == referrer {
@@ -383,7 +523,7 @@ func (w *worker) broadcast(text string) {
 	}
 	chats := w.broadcastChats()
 	for _, chatID := range chats {
-		_ = w.sendText(chatID, true, parseRaw, text)
+		_ = w.sendTextWithPriority(chatID, true, parseRaw, text, priorityBroadcast)
 	}
 	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "OK")
 }
@@ -418,11 +558,17 @@ func (w *worker) addUsername(arguments string) {
 		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "First argument is invalid")
 		return
 	}
-	username := parts[1]
+	username, host := parts[1], w.cfg.Host
+	if strings.Contains(username, "@") {
+		username, host = splitAddress(username)
+	}
 	if username == "" {
 		return
 	}
-	w.mustExec("insert into addresses (chat_id, username) values (?,?)", chatID, username)
+	if !w.insertAddress(chatID, username, host) {
+		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Address already exists")
+		return
+	}
 	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "OK")
 }
 
@@ -432,8 +578,24 @@ func (w *worker) removeUser(arguments string) {
 		_ = w.sendText(w.cfg.AdminID, false, parseRaw, "Argument is invalid")
 		return
 	}
+	w.mustExec(`
+		delete from muted_tags where exists (
+			select 1 from addresses
+			where addresses.chat_id=? and addresses.username=muted_tags.username and addresses.host=muted_tags.host)`,
+		chatID)
 	w.mustExec("delete from addresses where chat_id=?", chatID)
+	w.mustExec("delete from domains where chat_id=?", chatID)
 	w.mustExec("delete from users where chat_id=?", chatID)
+	w.mustExec("delete from bayes_tokens where chat_id=?", chatID)
+	w.mustExec("delete from bayes_trained where chat_id=?", chatID)
+	w.mustExec("delete from sender_rules where chat_id=?", chatID)
+	w.mustExec("delete from forwarded_emails where chat_id=?", chatID)
+	w.mustExec("delete from drafts where chat_id=?", chatID)
+	w.mustExec("delete from threads where chat_id=?", chatID)
+	w.mustExec("delete from email_actions where chat_id=?", chatID)
+	w.mustExec("delete from digest_emails where chat_id=?", chatID)
+	w.mustExec("delete from chat_settings where chat_id=?", chatID)
+	w.mustExec("delete from quiet_emails where chat_id=?", chatID)
 	_ = w.sendText(w.cfg.AdminID, false, parseRaw, "OK")
 }
 
@@ -443,7 +605,8 @@ func (w *worker) processAdminMessage(chatID int64, command, arguments string) bo
 		w.stat()
 		return true
 	case "broadcast":
-		w.broadcast(arguments)
+		// broadcasting waits for rate limits, updates are processed meanwhile
+		go w.broadcast(arguments)
 		return true
 	case "direct":
 		w.direct(arguments)
@@ -458,7 +621,7 @@ func (w *worker) processAdminMessage(chatID int64, command, arguments string) bo
 	return false
 }
 
-func (w *worker) processIncomingCommand(chatID int64, command, arguments string) {
+func (w *worker) processIncomingCommand(chatID int64, command, arguments string, replyTo *tg.Message) {
 	command = strings.ToLower(command)
 	linf("chat: %d, command: %s %s", chatID, command, arguments)
 	if chatID == w.cfg.AdminID && w.processAdminMessage(chatID, command, arguments) {
@@ -477,6 +640,34 @@ func (w *worker) processIncomingCommand(chatID int64, command, arguments string)
 		w.unmute(chatID, arguments)
 	case "referral":
 		w.referralLink(chatID)
+	case "block":
+		w.addSenderRule(chatID, command, arguments, false)
+	case "unblock":
+		w.removeSenderRule(chatID, command, arguments, false)
+	case "allow":
+		w.addSenderRule(chatID, command, arguments, true)
+	case "disallow":
+		w.removeSenderRule(chatID, command, arguments, true)
+	case "blocklist":
+		w.blocklist(chatID, arguments)
+	case "domain":
+		w.domain(chatID, arguments)
+	case "host":
+		w.host(chatID, arguments)
+	case "spam":
+		w.trainSpam(chatID, replyTo, true)
+	case "notspam":
+		w.trainSpam(chatID, replyTo, false)
+	case "spam_filter":
+		w.spamFilter(chatID, arguments)
+	case "new":
+		w.newVanityAddress(chatID, arguments)
+	case "send":
+		w.startDraft(chatID, arguments)
+	case "digest":
+		w.digest(chatID, arguments)
+	case "quiet":
+		w.quiet(chatID, arguments)
 	case "source":
 		_ = w.sendText(chatID, false, parseRaw, "Source code: https://github.com/igrmk/boxt")
 	default:
@@ -495,6 +686,10 @@ func (w *worker) ourID() int64 {
 }
 
 func (w *worker) processTGUpdate(u tg.Update) {
+	if u.CallbackQuery != nil {
+		w.processCallbackQuery(u.CallbackQuery)
+		return
+	}
 	if u.Message != nil && u.Message.Chat != nil {
 		if newMembers := u.Message.NewChatMembers; len(newMembers) > 0 {
 			ourID := w.ourID()
@@ -505,7 +700,11 @@ func (w *worker) processTGUpdate(u tg.Update) {
 				}
 			}
 		} else if u.Message.IsCommand() {
-			w.processIncomingCommand(u.Message.Chat.ID, u.Message.Command(), u.Message.CommandArguments())
+			w.processIncomingCommand(u.Message.Chat.ID, u.Message.Command(), u.Message.CommandArguments(), u.Message.ReplyToMessage)
+		} else if f := w.repliedEmail(u.Message); f != nil {
+			w.replyToEmail(u.Message, f)
+		} else if o := w.messageDraft(u.Message); o != nil {
+			w.completeDraft(u.Message, o)
 		} else {
 			if u.Message.Text == "" {
 				return
@@ -514,7 +713,7 @@ func (w *worker) processTGUpdate(u tg.Update) {
 			for len(parts) < 2 {
 				parts = append(parts, "")
 			}
-			w.processIncomingCommand(u.Message.Chat.ID, parts[0], parts[1])
+			w.processIncomingCommand(u.Message.Chat.ID, parts[0], parts[1], u.Message.ReplyToMessage)
 		}
 	}
 }
@@ -534,17 +733,12 @@ func (w *worker) mute(chatID int64, address string) {
 		_ = w.sendText(chatID, false, parseRaw, "Command format: /mute <email@boxt.us>")
 		return
 	}
-	username, host := splitAddress(address)
-	if host != w.cfg.Host {
+	username, tag, host, ok := w.chatAddress(chatID, address)
+	if !ok {
 		_ = w.sendText(chatID, false, parseRaw, "Address not found")
 		return
 	}
-	exists := w.db.QueryRow("select count(*) from addresses where chat_id=? and username=?", chatID, username)
-	if singleInt(exists) == 0 {
-		_ = w.sendText(chatID, false, parseRaw, "Address not found")
-		return
-	}
-	w.mustExec("update addresses set muted=1 where username=?", username)
+	w.setMuted(chatID, username, tag, host, true)
 	_ = w.sendText(chatID, false, parseRaw, "OK")
 }
 
@@ -553,20 +747,29 @@ func (w *worker) unmute(chatID int64, address string) {
 		_ = w.sendText(chatID, false, parseRaw, "Command format: /unmute <email@boxt.us>")
 		return
 	}
-	username, host := splitAddress(address)
-	if host != w.cfg.Host {
-		_ = w.sendText(chatID, false, parseRaw, "Address not found")
-		return
-	}
-	exists := w.db.QueryRow("select count(*) from addresses where chat_id=? and username=?", chatID, username)
-	if singleInt(exists) == 0 {
+	username, tag, host, ok := w.chatAddress(chatID, address)
+	if !ok {
 		_ = w.sendText(chatID, false, parseRaw, "Address not found")
 		return
 	}
-	w.mustExec("update addresses set muted=0 where username=?", username)
+	w.setMuted(chatID, username, tag, host, false)
 	_ = w.sendText(chatID, false, parseRaw, "OK")
 }
 
+// setMuted mutes or unmutes the address of the chat or only its tagged variant
+func (w *worker) setMuted(chatID int64, username, tag, host string, muted bool) {
+	switch {
+	case tag != "" && muted:
+		w.mustExec("insert or ignore into muted_tags (username, host, tag) values (?,?,?)", username, host, tag)
+	case tag != "":
+		w.mustExec("delete from muted_tags where username=? and host=? and tag=?", username, host, tag)
+	default:
+		// an address of a catch-all domain is stored once the user changes it
+		w.insertAddress(chatID, username, host)
+		w.mustExec("update addresses set muted=? where username=? and host=?", muted, username, host)
+	}
+}
+
 func (w *worker) referralLink(chatID int64) {
 	if chatID < 0 {
 		_ = w.sendText(chatID, false, parseRaw, "Referral links don't work for group chats")
@@ -619,40 +822,104 @@ func (w *worker) stat() {
 }
 
 func (w *worker) sendText(chatID int64, notify bool, parse parseKind, text string) error {
+	return w.sendTextWithPriority(chatID, notify, parse, text, priorityCommand)
+}
+
+func (w *worker) sendTextWithPriority(chatID int64, notify bool, parse parseKind, text string, priority sendPriority) error {
+	return w.sendWithPriority(textMessage(chatID, notify, parse, text), priority)
+}
+
+func textMessage(chatID int64, notify bool, parse parseKind, text string) *messageConfig {
 	msg := tg.NewMessage(chatID, text)
 	msg.DisableNotification = !notify
 	switch parse {
 	case parseHTML, parseMarkdown:
 		msg.ParseMode = parse.String()
 	}
-	return w.send(&messageConfig{msg})
+	return &messageConfig{msg}
 }
 
 func (w *worker) send(msg baseChattable) error {
-	if _, err := w.bot.Send(msg); err != nil {
+	return w.sendWithPriority(msg, priorityCommand)
+}
+
+func (w *worker) sendWithPriority(msg baseChattable, priority sendPriority) error {
+	_, err := w.sendMessage(msg, priority)
+	return err
+}
+
+// sendMessage waits for Telegram rate limits and sends the message
+func (w *worker) sendMessage(msg baseChattable, priority sendPriority) (*tg.Message, error) {
+	var sent tg.Message
+	err := w.sendWithRetries(msg.baseChat().ChatID, priority, 1, func() (err error) {
+		sent, err = w.bot.Send(msg)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &sent, nil
+}
+
+// sendMediaGroup waits for Telegram rate limits and sends the album
+func (w *worker) sendMediaGroup(album tg.MediaGroupConfig, priority sendPriority) ([]tg.Message, error) {
+	var sent []tg.Message
+	err := w.sendWithRetries(album.ChatID, priority, len(album.Media), func() (err error) {
+		sent, err = w.bot.SendMediaGroup(album)
+		return
+	})
+	return sent, err
+}
+
+// isPermanentSendError returns true if Telegram rejected the message itself,
+// like a 400 for entities it cannot parse, rather than the chat or the bot
+func isPermanentSendError(err error) bool {
+	tgErr, ok := err.(*tg.Error)
+	if !ok || tgErr.Code < 400 || tgErr.Code >= 500 {
+		return false
+	}
+	switch tgErr.Code {
+	case 401, 403, 429:
+		return false
+	}
+	return true
+}
+
+// sendWithRetries calls send when rate limits allow, it retries when Telegram asks to
+func (w *worker) sendWithRetries(chatID int64, priority sendPriority, messages int, send func() error) error {
+	for attempt := 0; ; attempt++ {
+		w.scheduler.acquire(chatID, priority, messages)
+		err := send()
+		if err == nil {
+			return nil
+		}
 		switch err := err.(type) {
 		case *tg.Error:
-			lerr("cannot send a message to %d, %v", msg.baseChat().ChatID, err)
+			if err.Code == 429 && err.RetryAfter > 0 && attempt < sendMaxRetries {
+				linf("flood control for %d, retrying after %d seconds", chatID, err.RetryAfter)
+				w.scheduler.pause(chatID, time.Second*time.Duration(err.RetryAfter))
+				continue
+			}
+			lerr("cannot send a message to %d, %v", chatID, err)
 			if err.Code == 403 {
 				nextDelivery := time.Now().Unix() + int64(w.cfg.BlockedBackoffSeconds)
 				w.mustExec(
 					"update addresses set next_delivery=? where next_delivery<? and chat_id=?",
 					nextDelivery,
 					nextDelivery,
-					msg.baseChat().ChatID)
+					chatID)
 			}
 		default:
-			lerr("unexpected error type while sending a message to %d, %v", msg.baseChat().ChatID, err)
+			lerr("unexpected error type while sending a message to %d, %v", chatID, err)
 		}
 		return err
 	}
-	return nil
 }
 
 func (w *worker) addressStrings(addresses []address) []string {
 	result := make([]string, len(addresses))
 	for i, l := range addresses {
-		result[i] = l.username + "@" + w.cfg.Host
+		result[i] = l.username + "@" + l.host
 	}
 	return result
 }
@@ -668,17 +935,19 @@ func (w *worker) listAddresses(chatID int64) {
 			active = append(active, a)
 		}
 	}
+	mutedTags := w.mutedTagsForChat(chatID)
 	lines := []string{}
 	if len(active) > 0 {
 		lines = append(lines, "ACTIVE")
 		lines = append(lines, w.addressStrings(active)...)
 	}
-	if len(muted) > 0 {
+	if len(muted) > 0 || len(mutedTags) > 0 {
 		if len(active) > 0 {
 			lines = append(lines, "")
 		}
 		lines = append(lines, "MUTED")
 		lines = append(lines, w.addressStrings(muted)...)
+		lines = append(lines, mutedTags...)
 	}
 	externalID := w.externalID(chatID)
 	if externalID == nil {
@@ -693,15 +962,16 @@ func (w *worker) listAddresses(chatID int64) {
 	_ = w.sendText(chatID, false, parseRaw, strings.Join(lines, "\n"))
 }
 
-func (w *worker) addressForUsername(username string) *address {
+func (w *worker) addressForUsername(username string, host string) *address {
 	modelsQuery, err := w.db.Query(`
 		select chat_id, muted, next_delivery from addresses
-		where username=?`,
-		username)
+		where username=? and host=?`,
+		username,
+		host)
 	checkErr(err)
 	defer modelsQuery.Close()
 	if modelsQuery.Next() {
-		address := address{username: username}
+		address := address{username: username, host: host}
 		checkErr(modelsQuery.Scan(&address.chatID, &address.muted, &address.nextDelivery))
 		return &address
 	}
@@ -710,42 +980,50 @@ func (w *worker) addressForUsername(username string) *address {
 
 func (w *worker) usernamesForChat(chatID int64) (usernames []address) {
 	modelsQuery, err := w.db.Query(`
-		select username, muted from addresses
+		select username, host, muted from addresses
 		where chat_id=?
-		order by username`,
+		order by host, username`,
 		chatID)
 	checkErr(err)
 	defer modelsQuery.Close()
 	for modelsQuery.Next() {
 		address := address{chatID: chatID}
-		checkErr(modelsQuery.Scan(&address.username, &address.muted))
+		checkErr(modelsQuery.Scan(&address.username, &address.host, &address.muted))
 		usernames = append(usernames, address)
 	}
 	return
 }
 
-func loadTLS(certFile string, keyFile string) (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return nil, err
-	}
-	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
-}
-
 func main() {
 	rand.Seed(time.Now().UnixNano())
+	if len(os.Args) > 1 && os.Args[1] == "dkim-keygen" {
+		dkimKeygen(os.Args[2:])
+		return
+	}
 	w := newWorker()
 	w.logConfig()
 	w.setWebhook()
 	w.createDatabase()
 	incoming := w.bot.ListenForWebhook(w.cfg.Host + w.cfg.ListenPath)
+	if w.cfg.AttachmentLinkThreshold > 0 {
+		http.HandleFunc(w.cfg.Host+downloadPath, w.serveBlob)
+	}
 
-	deliverCh := make(chan deliverArgs)
+	spoolCh := make(chan spoolArgs)
 	chatForUsernameCh := make(chan chatForUsernameArgs)
+	greylistCh := make(chan greylistArgs)
+	var dnsbl *dnsblChecker
+	if len(w.cfg.DNSBLZones) > 0 {
+		dnsbl = newDNSBLChecker(
+			w.resolver,
+			w.cfg.DNSBLZones,
+			time.Second*time.Duration(w.cfg.DNSBLCacheSeconds),
+			time.Second*time.Duration(w.cfg.TimeoutSeconds))
+	}
 	smtp := &smtpd.Server{
 		Hostname:  w.cfg.Host,
 		Addr:      w.cfg.MailAddress,
-		OnNewMail: envelopeFactory(deliverCh, chatForUsernameCh, w.cfg.Host, w.cfg.MaxSize),
+		OnNewMail: envelopeFactory(spoolCh, chatForUsernameCh, greylistCh, w.cfg, w.resolver, dnsbl),
 		TLSConfig: w.tls,
 		MaxSize:   w.cfg.MaxSize,
 		Log:       lsmtpd,
@@ -758,21 +1036,83 @@ func main() {
 		err := http.ListenAndServe(w.cfg.ListenAddress, nil)
 		checkErr(err)
 	}()
+	var greylistPurge <-chan time.Time
+	if w.cfg.GreylistDelaySeconds > 0 {
+		greylistPurge = time.NewTicker(time.Hour).C
+	}
+	go func() {
+		for u := range incoming {
+			w.processTGUpdate(u)
+		}
+	}()
+	w.mustExec("update spool set leased=0")
+	pool := w.startDeliveryPool(w.cfg.DeliveryWorkers)
+	var blobsPurge <-chan time.Time
+	if w.cfg.AttachmentLinkThreshold > 0 {
+		blobsPurge = time.NewTicker(time.Hour).C
+	}
+	var actionsPurge <-chan time.Time
+	if w.cfg.ActionsExpirySeconds > 0 {
+		actionsPurge = time.NewTicker(time.Hour).C
+	}
+	scheduledTicker := time.NewTicker(time.Minute)
+	scheduledDone := make(chan struct{})
+	scheduledRunning := false
+	var digestPurge <-chan time.Time
+	if w.cfg.DigestSecret != "" {
+		digestPurge = time.NewTicker(time.Hour).C
+	}
+	var forwardedPurge <-chan time.Time
+	if w.cfg.ReplyRetentionSeconds > 0 {
+		forwardedPurge = time.NewTicker(time.Hour).C
+	}
+	var threadsPurge <-chan time.Time
+	if w.cfg.ThreadRetentionSeconds > 0 {
+		threadsPurge = time.NewTicker(time.Hour).C
+	}
+	spoolTicker := time.NewTicker(spoolPollInterval)
 	signals := make(chan os.Signal, 16)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 	for {
 		select {
-		case m := <-deliverCh:
-			err := w.deliver(m.env)
+		case m := <-spoolCh:
+			err := w.enqueue(m.env)
 			if err != nil {
-				linf("delivery failed: %v", err)
+				linf("email rejected: %v", err)
 			}
 			m.result <- err
+			w.dispatchSpool(pool)
+		case <-pool.done:
+			w.dispatchSpool(pool)
+		case <-spoolTicker.C:
+			w.dispatchSpool(pool)
 		case u := <-chatForUsernameCh:
 			chatID, err := w.chatForUsername(u)
 			u.result <- chatForUsernameResult{chatID: chatID, err: err}
-		case m := <-incoming:
-			w.processTGUpdate(m)
+		case g := <-greylistCh:
+			g.result <- w.greylist(g)
+		case <-greylistPurge:
+			w.purgeGreylist()
+		case <-forwardedPurge:
+			w.purgeForwarded()
+		case <-threadsPurge:
+			w.purgeThreads()
+		case <-blobsPurge:
+			w.purgeBlobs()
+		case <-actionsPurge:
+			w.purgeEmailActions()
+		case <-scheduledTicker.C:
+			if !scheduledRunning {
+				scheduledRunning = true
+				go func() {
+					w.sendScheduled()
+					scheduledDone <- struct{}{}
+				}()
+			}
+		case <-scheduledDone:
+			scheduledRunning = false
+		case <-digestPurge:
+			w.purgeDigests()
 		case s := <-signals:
 			linf("got signal %v", s)
 			w.removeWebhook()
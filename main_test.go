@@ -0,0 +1,162 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/igrmk/go-smtpd/smtpd"
+)
+
+const testHost = "boxt.us"
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(ioutil.Discard)
+	}
+	os.Exit(m.Run())
+}
+
+// newTestWorker returns a worker with a fresh database sending to the Bot API stand-in
+func newTestWorker(t testing.TB, f *fakeTelegram) *worker {
+	db, err := openDatabase(filepath.Join(t.TempDir(), "boxt.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &worker{
+		bot: newTestBot(t, f),
+		db:  db,
+		cfg: &config{
+			Host:                  testHost,
+			MaxSize:               1 << 20,
+			MaxTextChunkSize:      4096,
+			BotToken:              testBotToken,
+			SpamSecret:            "spam secret",
+			BlockedBackoffSeconds: 60,
+			SpoolRetrySeconds:     60,
+			SpoolExpirySeconds:    3600,
+			SpoolHoldSeconds:      600,
+			SpoolSecret:           "spool secret",
+			DeliveryWorkers:       4,
+		},
+		resolver:  newStubResolver(),
+		scheduler: newSendScheduler(),
+	}
+	w.createDatabase()
+	return w
+}
+
+// addTestAddresses creates the address user<n>@boxt.us for every chat from 1 to n
+func addTestAddresses(w *worker, n int) {
+	tx, err := w.db.Begin()
+	checkErr(err)
+	for chatID := 1; chatID <= n; chatID++ {
+		_, err := tx.Exec("insert into addresses (chat_id, username, host) values (?,?,?)", chatID, testUsername(chatID), testHost)
+		checkErr(err)
+	}
+	checkErr(tx.Commit())
+}
+
+func testUsername(chatID int) string {
+	return fmt.Sprintf("user%d", chatID)
+}
+
+func testEmail(to string, n int) []byte {
+	return []byte(fmt.Sprintf(
+		"From: sender@example.com\r\nTo: %s\r\nSubject: Test %d\r\nMessage-ID: <%d@example.com>\r\n\r\nHello %d\r\n",
+		to,
+		n,
+		n,
+		n))
+}
+
+// testEnv returns the parsed envelope of the test email to the chat
+func testEnv(w *worker, chatID int, n int) *env {
+	to := testUsername(chatID) + "@" + testHost
+	e := &env{
+		BasicEnvelope: &smtpd.BasicEnvelope{},
+		from:          mailAddress("sender@example.com"),
+		data:          testEmail(to, n),
+		cfg:           w.cfg,
+		recipients:    map[int64][]string{int64(chatID): {to}},
+	}
+	checkErr(e.parse())
+	return e
+}
+
+// serveTestMail runs an SMTP server and the part of the main loop accepting and delivering emails,
+// it returns the address of the SMTP server
+func serveTestMail(t testing.TB, w *worker) string {
+	spoolCh := make(chan spoolArgs)
+	chatForUsernameCh := make(chan chatForUsernameArgs)
+	greylistCh := make(chan greylistArgs)
+	stop := make(chan struct{})
+	pool := w.startDeliveryPool(w.cfg.DeliveryWorkers)
+	go func() {
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case m := <-spoolCh:
+				m.result <- w.enqueue(m.env)
+				w.dispatchSpool(pool)
+			case <-pool.done:
+				w.dispatchSpool(pool)
+			case <-ticker.C:
+				w.dispatchSpool(pool)
+			case u := <-chatForUsernameCh:
+				chatID, err := w.chatForUsername(u)
+				u.result <- chatForUsernameResult{chatID: chatID, err: err}
+			case g := <-greylistCh:
+				g.result <- w.greylist(g)
+			case <-stop:
+				return
+			}
+		}
+	}()
+	server := &smtpd.Server{
+		Hostname:  testHost,
+		OnNewMail: envelopeFactory(spoolCh, chatForUsernameCh, greylistCh, w.cfg, w.resolver, nil),
+		MaxSize:   w.cfg.MaxSize,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() {
+		_ = listener.Close()
+		close(stop)
+	})
+	return listener.Addr().String()
+}
+
+func sendTestEmail(t testing.TB, addr string, chatID int, n int) {
+	to := testUsername(chatID) + "@" + testHost
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{to}, testEmail(to, n)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitFor polls the condition until it holds or the timeout expires
+func waitFor(t testing.TB, timeout time.Duration, condition func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (w *worker) spoolSize() int {
+	return singleInt(w.db.QueryRow("select count(*) from spool"))
+}
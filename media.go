@@ -0,0 +1,129 @@
+package main
+
+import (
+	"html"
+	"strings"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// mediaGroupSize is the maximum number of items in a Telegram album
+const mediaGroupSize = 10
+
+// captionSize is the maximum caption length in UTF-16 code units
+const captionSize = 1024
+
+type mediaFile struct {
+	mediaType string
+	file      tg.FileBytes
+}
+
+// emailMedia returns inline files and attachments of the email in the order they are sent
+func emailMedia(e *env) (files []mediaFile) {
+	for _, inline := range e.mime.Inlines {
+		f := mediaFile{mediaType: "document", file: tg.FileBytes{Name: inline.FileName, Bytes: inline.Content}}
+		switch {
+		case strings.HasPrefix(inline.ContentType, "image/"):
+			f.mediaType = "photo"
+		case strings.HasPrefix(inline.ContentType, "video/"):
+			f.mediaType = "video"
+		case strings.HasPrefix(inline.ContentType, "audio/"):
+			f.mediaType = "audio"
+		}
+		files = append(files, f)
+	}
+	for _, a := range e.mime.Attachments {
+		files = append(files, mediaFile{mediaType: "document", file: tg.FileBytes{Name: a.FileName, Bytes: a.Content}})
+	}
+	return
+}
+
+// mediaGroups groups files into albums, Telegram allows mixing only photos and videos
+func mediaGroups(files []mediaFile) (groups [][]mediaFile) {
+	var order []string
+	buckets := make(map[string][]mediaFile)
+	for _, f := range files {
+		key := f.mediaType
+		if key == "video" {
+			key = "photo"
+		}
+		if _, ok := buckets[key]; !ok {
+			order = append(order, key)
+		}
+		buckets[key] = append(buckets[key], f)
+	}
+	for _, key := range order {
+		bucket := buckets[key]
+		for len(bucket) > mediaGroupSize {
+			groups = append(groups, bucket[:mediaGroupSize])
+			bucket = bucket[mediaGroupSize:]
+		}
+		groups = append(groups, bucket)
+	}
+	return
+}
+
+// mediaCaption returns the caption referencing the email subject
+func mediaCaption(subject string) string {
+	caption := "Attachments: " + subject
+	runes := []rune(caption)
+	for utf16Length(string(runes)) > captionSize {
+		runes = runes[:len(runes)-1]
+	}
+	return html.EscapeString(string(runes))
+}
+
+func inputMedia(f mediaFile, caption string) interface{} {
+	switch f.mediaType {
+	case "photo":
+		m := tg.NewInputMediaPhoto(f.file)
+		m.Caption, m.ParseMode = caption, parseHTML.String()
+		return m
+	case "video":
+		m := tg.NewInputMediaVideo(f.file)
+		m.Caption, m.ParseMode = caption, parseHTML.String()
+		return m
+	case "audio":
+		m := tg.NewInputMediaAudio(f.file)
+		m.Caption, m.ParseMode = caption, parseHTML.String()
+		return m
+	default:
+		m := tg.NewInputMediaDocument(f.file)
+		m.Caption, m.ParseMode = caption, parseHTML.String()
+		return m
+	}
+}
+
+func singleMedia(chatID int64, f mediaFile, caption string) baseChattable {
+	switch f.mediaType {
+	case "photo":
+		msg := tg.NewPhoto(chatID, f.file)
+		msg.Caption, msg.ParseMode = caption, parseHTML.String()
+		return &photoConfig{msg}
+	case "video":
+		msg := tg.NewVideo(chatID, f.file)
+		msg.Caption, msg.ParseMode = caption, parseHTML.String()
+		return &videoConfig{msg}
+	case "audio":
+		msg := tg.NewAudio(chatID, f.file)
+		msg.Caption, msg.ParseMode = caption, parseHTML.String()
+		return &audioConfig{msg}
+	default:
+		msg := tg.NewDocument(chatID, f.file)
+		msg.Caption, msg.ParseMode = caption, parseHTML.String()
+		return &documentConfig{msg}
+	}
+}
+
+// mediaGroup returns the album config for the files, the caption is put on the first item
+func mediaGroup(chatID int64, files []mediaFile, caption string) tg.MediaGroupConfig {
+	var media []interface{}
+	for i, f := range files {
+		if i == 0 {
+			media = append(media, inputMedia(f, caption))
+		} else {
+			media = append(media, inputMedia(f, ""))
+		}
+	}
+	return tg.NewMediaGroup(chatID, media)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func testMediaFiles(types ...string) (files []mediaFile) {
+	for i, t := range types {
+		files = append(files, mediaFile{mediaType: t, file: tg.FileBytes{Name: fmt.Sprintf("%s%d", t, i)}})
+	}
+	return
+}
+
+func mediaGroupNames(groups [][]mediaFile) (names [][]string) {
+	for _, g := range groups {
+		var group []string
+		for _, f := range g {
+			group = append(group, f.file.Name)
+		}
+		names = append(names, group)
+	}
+	return
+}
+
+func TestMediaGroups(t *testing.T) {
+	groups := mediaGroupNames(mediaGroups(testMediaFiles("document", "photo", "video", "audio", "photo", "document")))
+	expected := [][]string{{"document0", "document5"}, {"photo1", "video2", "photo4"}, {"audio3"}}
+	if fmt.Sprint(groups) != fmt.Sprint(expected) {
+		t.Errorf("expected photos and videos to be mixed and other types grouped apart, got %v", groups)
+	}
+	var photos []string
+	for i := 0; i < 2*mediaGroupSize+1; i++ {
+		photos = append(photos, "photo")
+	}
+	groups = mediaGroupNames(mediaGroups(testMediaFiles(photos...)))
+	if len(groups) != 3 || len(groups[0]) != mediaGroupSize || len(groups[1]) != mediaGroupSize || len(groups[2]) != 1 {
+		t.Errorf("expected albums of at most %d items, got %v", mediaGroupSize, groups)
+	}
+	if groups := mediaGroups(nil); len(groups) != 0 {
+		t.Errorf("expected no albums without files, got %v", groups)
+	}
+}
+
+func TestMediaCaption(t *testing.T) {
+	if caption := mediaCaption("<Report>"); caption != "Attachments: &lt;Report&gt;" {
+		t.Errorf("expected the subject to be escaped, got %q", caption)
+	}
+	caption := mediaCaption(strings.Repeat("😀", captionSize))
+	if n := utf16Length(caption); n > captionSize || n < captionSize-1 {
+		t.Errorf("expected the caption to be cut to %d UTF-16 units, got %d", captionSize, n)
+	}
+}
+
+// testEmailWithImages returns an email with inline images and a document attached
+func testEmailWithImages(to string, images int) []byte {
+	boundary := "boundary"
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: sender@example.com\r\nTo: %s\r\nSubject: Photos\r\nMessage-ID: <photos@example.com>\r\n", to)
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=%s\r\n\r\n", boundary)
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: text/plain\r\n\r\nLook\r\n", boundary)
+	content := base64.StdEncoding.EncodeToString([]byte("not really an image"))
+	for i := 0; i < images; i++ {
+		fmt.Fprintf(&b, "--%s\r\nContent-Type: image/png\r\nContent-Disposition: inline; filename=\"%d.png\"\r\n", boundary, i)
+		fmt.Fprintf(&b, "Content-Transfer-Encoding: base64\r\n\r\n%s\r\n", content)
+	}
+	fmt.Fprintf(&b, "--%s\r\nContent-Type: application/pdf\r\nContent-Disposition: attachment; filename=\"doc.pdf\"\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Transfer-Encoding: base64\r\n\r\n%s\r\n--%s--\r\n", content, boundary)
+	return []byte(b.String())
+}
+
+// liftChatLimit lets tests send many messages to the chat at once
+func liftChatLimit(w *worker, chatID int64) {
+	w.scheduler.mutex.Lock()
+	w.scheduler.chats[chatID] = &chatLimits{perSecond: newTokenBucket(1e9, 1e9, time.Now())}
+	w.scheduler.mutex.Unlock()
+}
+
+func TestMediaDelivery(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	addTestAddresses(w, 1)
+	liftChatLimit(w, 1)
+	addr := serveTestMail(t, w)
+	to := testUsername(1) + "@" + testHost
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{to}, testEmailWithImages(to, mediaGroupSize+2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return w.spoolSize() == 0 })
+	albums := f.sent("sendMediaGroup")
+	if len(albums) != 2 {
+		t.Fatalf("expected two albums, got %d", len(albums))
+	}
+	for i, size := range []int{mediaGroupSize, 2} {
+		if n := strings.Count(albums[i].form.Get("media"), `"type":"photo"`); n != size {
+			t.Errorf("album %d: expected %d photos, got %d", i, size, n)
+		}
+		if replyTo := albums[i].form.Get("reply_to_message_id"); replyTo != "1" {
+			t.Errorf("album %d: expected a reply to the text of the email, got %q", i, replyTo)
+		}
+	}
+	if !strings.Contains(albums[0].form.Get("media"), "Attachments: Photos") {
+		t.Error("expected the caption on the first album")
+	}
+	if n := len(f.sent("sendDocument")); n != 1 {
+		t.Errorf("expected the document to be sent alone, got %d", n)
+	}
+}
@@ -1,6 +1,12 @@
 package main
 
-import "database/sql"
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 var migrations = []func(w *worker){
 	func(w *worker) {
@@ -25,6 +31,283 @@ var migrations = []func(w *worker){
 	func(w *worker) {
 		w.mustExec("alter table addresses add next_delivery integer not null default 0")
 	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists greylist (
+				network text not null,
+				sender text not null,
+				recipient text not null,
+				first_seen integer not null,
+				last_seen integer not null,
+				passed integer not null default 0,
+				primary key (network, sender, recipient));`)
+		w.mustExec(`
+			create table if not exists greylist_whitelist (
+				network text not null,
+				sender_domain text not null,
+				last_seen integer not null,
+				primary key (network, sender_domain));`)
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists bayes_tokens (
+				chat_id integer not null,
+				token text not null,
+				spam integer not null default 0,
+				ham integer not null default 0,
+				primary key (chat_id, token));`)
+		w.mustExec(`
+			create table if not exists bayes_trained (
+				chat_id integer not null,
+				message_id integer not null,
+				spam integer not null,
+				primary key (chat_id, message_id));`)
+		w.mustExec("alter table users add spam_count integer not null default 0")
+		w.mustExec("alter table users add ham_count integer not null default 0")
+		w.mustExec("alter table users add spam_action text not null default 'mute'")
+		w.mustExec("alter table users add spam_threshold real not null default 0.9")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists sender_rules (
+				chat_id integer not null,
+				username text not null default '',
+				sender text not null,
+				allow integer not null default 0);`)
+		w.mustExec("create index if not exists sender_rules_chat_id on sender_rules (chat_id)")
+		w.mustExec("alter table users add block_action text not null default 'reject'")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists muted_tags (
+				username text not null,
+				tag text not null,
+				primary key (username, tag));`)
+	},
+	func(w *worker) {
+		w.mustExec("alter table addresses add host text not null default ''")
+		w.mustExec("update addresses set host=?", w.cfg.Host)
+		w.mustExec("create index if not exists addresses_username_host on addresses (username, host)")
+		w.mustExec(`
+			create table muted_tags_new (
+				username text not null,
+				host text not null,
+				tag text not null,
+				primary key (username, host, tag));`)
+		w.mustExec("insert into muted_tags_new (username, host, tag) select username, ?, tag from muted_tags", w.cfg.Host)
+		w.mustExec("drop table muted_tags")
+		w.mustExec("alter table muted_tags_new rename to muted_tags")
+		w.mustExec("alter table sender_rules add host text not null default ''")
+		w.mustExec("update sender_rules set host=? where username!=''", w.cfg.Host)
+		w.mustExec(`
+			create table if not exists domains (
+				domain text primary key,
+				chat_id integer not null,
+				token text not null,
+				verified integer not null default 0,
+				catch_all integer not null default 0);`)
+	},
+	func(w *worker) {
+		w.mustExec("alter table users add preferred_host text not null default ''")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists spool (
+				id integer primary key,
+				data blob not null,
+				mail_from text not null,
+				ip text not null,
+				recipients text not null,
+				auth_lines text not null,
+				dmarc_action text not null,
+				attempts integer not null default 0,
+				created integer not null,
+				next_attempt integer not null);`)
+	},
+	func(w *worker) {
+		w.mustExec("alter table spool add chat_id integer not null default 0")
+		w.mustExec("alter table spool add leased integer not null default 0")
+		query, err := w.db.Query("select id, recipients from spool")
+		checkErr(err)
+		split := make(map[int64]map[int64][]string)
+		for query.Next() {
+			var id int64
+			var recipientsJSON string
+			checkErr(query.Scan(&id, &recipientsJSON))
+			var recipients map[int64][]string
+			checkErr(json.Unmarshal([]byte(recipientsJSON), &recipients))
+			split[id] = recipients
+		}
+		checkErr(query.Close())
+		for id, recipients := range split {
+			for chatID, addresses := range recipients {
+				recipientsJSON, err := json.Marshal(map[int64][]string{chatID: addresses})
+				checkErr(err)
+				w.mustExec(`
+					insert into spool (chat_id, data, mail_from, ip, recipients, auth_lines, dmarc_action, attempts, created, next_attempt)
+					select ?, data, mail_from, ip, ?, auth_lines, dmarc_action, attempts, created, next_attempt from spool where id=?`,
+					chatID,
+					string(recipientsJSON),
+					id)
+			}
+			w.mustExec("delete from spool where id=?", id)
+		}
+		w.mustExec("create index if not exists spool_chat_id on spool (chat_id, id)")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists forwarded_emails (
+				chat_id integer not null,
+				telegram_message_id integer not null,
+				message_id text not null,
+				sender text not null,
+				address text not null,
+				subject text not null,
+				refs text not null,
+				created integer not null,
+				primary key (chat_id, telegram_message_id));`)
+	},
+	func(w *worker) {
+		w.mustExec("alter table users add next_send integer not null default 0")
+		w.mustExec(`
+			create table if not exists drafts (
+				chat_id integer primary key,
+				sender text not null,
+				recipient text not null,
+				subject text not null,
+				created integer not null);`)
+		w.mustExec(`
+			create table if not exists outbound_log (
+				id integer primary key,
+				chat_id integer not null,
+				sender text not null,
+				recipient text not null,
+				message_id text not null,
+				size integer not null,
+				status text not null,
+				created integer not null);`)
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists threads (
+				chat_id integer not null,
+				message_id text not null,
+				telegram_message_id integer not null,
+				created integer not null,
+				primary key (chat_id, message_id));`)
+		w.mustExec("create index if not exists threads_created on threads (created)")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists blobs (
+				id text primary key,
+				file_name text not null,
+				size integer not null,
+				expires integer not null);`)
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists email_actions (
+				id integer primary key autoincrement,
+				chat_id integer not null,
+				address text not null,
+				sender text not null,
+				headers text not null,
+				message_ids text not null,
+				created integer not null);`)
+		w.mustExec("create index if not exists email_actions_created on email_actions (created);")
+	},
+	func(w *worker) {
+		w.mustExec("alter table addresses add digest text not null default ''")
+		w.mustExec("alter table addresses add next_digest integer not null default 0")
+		w.mustExec(`
+			create table if not exists digest_emails (
+				id integer primary key autoincrement,
+				chat_id integer not null,
+				username text not null,
+				host text not null,
+				data blob not null,
+				created integer not null,
+				sent integer not null);`)
+		w.mustExec("create index if not exists digest_emails_address on digest_emails (username, host, sent);")
+	},
+	func(w *worker) {
+		w.mustExec(`
+			create table if not exists chat_settings (
+				chat_id integer primary key,
+				quiet_start integer not null default 0,
+				quiet_end integer not null default 0,
+				time_zone text not null default '',
+				quiet_summary integer not null default 0,
+				next_summary integer not null default 0);`)
+		w.mustExec(`
+			create table if not exists quiet_emails (
+				chat_id integer not null,
+				subject text not null,
+				sender text not null,
+				created integer not null);`)
+		w.mustExec("create index if not exists quiet_emails_chat_id on quiet_emails (chat_id);")
+	},
+	func(w *worker) {
+		// the check goes first so that the migration can run again once duplicates are resolved
+		w.checkDuplicateAddresses()
+		w.mustExec("alter table users add vanity_allowance integer not null default 0")
+		w.mustExec("update users set vanity_allowance=?", w.cfg.VanityAllowance)
+		w.mustExec("drop index if exists addresses_username_host")
+		w.mustExec("create unique index if not exists addresses_username_host_unique on addresses (username, host)")
+	},
+	func(w *worker) {
+		w.mustExec("create index if not exists forwarded_emails_created on forwarded_emails (created)")
+	},
+	func(w *worker) {
+		w.mustExec("alter table email_actions add tokens text not null default '[]'")
+	},
+	func(w *worker) {
+		// words were hashed without a secret, statistics of such hashes cannot be kept
+		w.mustExec("delete from bayes_tokens")
+		w.mustExec("delete from bayes_trained")
+		w.mustExec("update users set spam_count=0, ham_count=0")
+		w.mustExec("update email_actions set tokens='[]'")
+		w.mustExec("alter table bayes_trained add tokens text not null default '[]'")
+	},
+	func(w *worker) {
+		query, err := w.db.Query("select id, chat_id, data from spool")
+		checkErr(err)
+		sealed := make(map[int64][]byte)
+		for query.Next() {
+			var id, chatID int64
+			var data []byte
+			checkErr(query.Scan(&id, &chatID, &data))
+			sealed[id], err = seal(w.spoolCipher(), data, []byte(strconv.FormatInt(chatID, 10)))
+			checkErr(err)
+		}
+		checkErr(query.Close())
+		for id, data := range sealed {
+			w.mustExec("update spool set data=? where id=?", data, id)
+		}
+	},
+	func(w *worker) {
+		w.mustExec("alter table domains add next_delivery integer not null default 0")
+	},
+}
+
+// checkDuplicateAddresses fails listing duplicate addresses,
+// duplicates could only appear by races and it is up to the admin which chat keeps the address
+func (w *worker) checkDuplicateAddresses() {
+	query, err := w.db.Query(`
+		select username, host, group_concat(chat_id, ', ') from addresses
+		group by username, host having count(*)>1`)
+	checkErr(err)
+	var duplicates []string
+	for query.Next() {
+		var username, host, chats string
+		checkErr(query.Scan(&username, &host, &chats))
+		duplicates = append(duplicates, fmt.Sprintf("%s@%s of chats %s", username, host, chats))
+	}
+	checkErr(query.Close())
+	if len(duplicates) > 0 {
+		checkErr(fmt.Errorf("duplicate addresses, remove all but one of each and restart: %s", strings.Join(duplicates, "; ")))
+	}
 }
 
 func (w *worker) applyMigrations() {
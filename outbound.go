@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/jhillyerd/enmime"
+)
+
+// draftExpirySeconds is how long /send waits for the body of the email
+const draftExpirySeconds = 3600
+
+var errorRelayPlaintext = errors.New("the SMTP relay does not offer STARTTLS")
+
+type attachment struct {
+	data        []byte
+	contentType string
+	fileName    string
+}
+
+type outgoingEmail struct {
+	chatID      int64
+	from        string
+	to          string
+	subject     string
+	inReplyTo   string
+	references  string
+	text        string
+	attachments []attachment
+}
+
+// buildEmail encodes the email and returns it along with its Message-ID
+func buildEmail(o outgoingEmail) (data []byte, messageID string, err error) {
+	_, host := splitAddress(o.from)
+	messageID = fmt.Sprintf("<%s@%s>", randString(32), host)
+	builder := enmime.Builder().
+		From("", o.from).
+		To("", o.to).
+		Subject(o.subject).
+		Header("Message-ID", messageID).
+		Text([]byte(o.text))
+	if o.inReplyTo != "" {
+		builder = builder.Header("In-Reply-To", o.inReplyTo)
+	}
+	if o.references != "" {
+		builder = builder.Header("References", o.references)
+	}
+	for _, a := range o.attachments {
+		builder = builder.AddAttachment(a.data, a.contentType, a.fileName)
+	}
+	root, err := builder.Build()
+	if err != nil {
+		return nil, "", err
+	}
+	var b bytes.Buffer
+	if err := root.Encode(&b); err != nil {
+		return nil, "", err
+	}
+	return b.Bytes(), messageID, nil
+}
+
+// takeOutboundQuota returns false if the chat sends emails too often,
+// the limit works the same way as the limit for incoming emails
+func (w *worker) takeOutboundQuota(chatID int64) bool {
+	query, err := w.db.Query("select next_send from users where chat_id=?", chatID)
+	checkErr(err)
+	var nextSend int64
+	if query.Next() {
+		checkErr(query.Scan(&nextSend))
+	}
+	checkErr(query.Close())
+	now := time.Now().Unix()
+	if nextSend > now {
+		return false
+	}
+	nextSend += int64(w.cfg.LimitIntervalSeconds)
+	if now-int64(w.cfg.LimitWindowSeconds) > nextSend {
+		nextSend = now - int64(w.cfg.LimitWindowSeconds)
+	}
+	w.mustExec("update users set next_send=? where chat_id=?", nextSend, chatID)
+	return true
+}
+
+func (w *worker) logOutbound(o outgoingEmail, messageID string, size int, status string) {
+	w.mustExec(
+		"insert into outbound_log (chat_id, sender, recipient, message_id, size, status, created) values (?,?,?,?,?,?,?)",
+		o.chatID,
+		o.from,
+		o.to,
+		messageID,
+		size,
+		status,
+		time.Now().Unix())
+}
+
+// sendOutgoing sends the email of the chat and reports the result to the chat
+func (w *worker) sendOutgoing(o outgoingEmail) {
+	if !w.takeOutboundQuota(o.chatID) {
+		_ = w.sendText(o.chatID, false, parseRaw, "You send emails too often, please try again later")
+		return
+	}
+	data, messageID, err := buildEmail(o)
+	if err != nil {
+		_ = w.sendText(o.chatID, false, parseRaw, "Cannot build the email, "+err.Error())
+		return
+	}
+	if err := w.sendEmail(o.from, []string{o.to}, data); err != nil {
+		lerr("cannot send an email from %s, %v", o.from, err)
+		w.logOutbound(o, messageID, len(data), "failed: "+err.Error())
+		_ = w.sendText(o.chatID, false, parseRaw, "Cannot send the email, please try again later")
+		return
+	}
+	w.logOutbound(o, messageID, len(data), "sent")
+	_ = w.sendText(o.chatID, false, parseRaw, "Sent to "+o.to)
+}
+
+// sendEmail signs the email with DKIM and sends it through the SMTP relay
+func (w *worker) sendEmail(from string, to []string, data []byte) error {
+	data, err := w.signDKIM(from, data)
+	if err != nil {
+		return err
+	}
+	timeout := time.Second * time.Duration(w.cfg.TimeoutSeconds)
+	conn, err := net.DialTimeout("tcp", w.cfg.SMTPRelay, timeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	host, _, err := net.SplitHostPort(w.cfg.SMTPRelay)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello(w.cfg.Host); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	} else if !w.cfg.SMTPRelayAllowPlaintext {
+		return errorRelayPlaintext
+	}
+	if w.cfg.SMTPRelayUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", w.cfg.SMTPRelayUsername, w.cfg.SMTPRelayPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := wc.Write(data); err != nil {
+		return err
+	}
+	if err := wc.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+const sendUsage = "Command format: /send <your-boxt-address> <to> <subject>"
+
+// startDraft remembers the envelope of a new email, the next message of the chat becomes its body
+func (w *worker) startDraft(chatID int64, arguments string) {
+	if w.cfg.SMTPRelay == "" {
+		_ = w.sendText(chatID, false, parseRaw, "Sending emails is disabled")
+		return
+	}
+	parts := strings.SplitN(strings.TrimSpace(arguments), " ", 3)
+	if len(parts) < 3 || strings.TrimSpace(parts[2]) == "" {
+		_ = w.sendText(chatID, false, parseRaw, sendUsage)
+		return
+	}
+	from := strings.ToLower(parts[0])
+	if _, _, _, ok := w.chatAddress(chatID, from); !ok {
+		_ = w.sendText(chatID, false, parseRaw, "Address not found")
+		return
+	}
+	to, err := mail.ParseAddress(parts[1])
+	if err != nil {
+		_ = w.sendText(chatID, false, parseRaw, "Recipient is invalid")
+		return
+	}
+	w.mustExec(
+		"insert or replace into drafts (chat_id, sender, recipient, subject, created) values (?,?,?,?,?)",
+		chatID,
+		from,
+		to.Address,
+		strings.TrimSpace(parts[2]),
+		time.Now().Unix())
+	_ = w.sendText(chatID, false, parseRaw, "Send the body of the email, you can attach a photo or a document")
+}
+
+func (w *worker) draft(chatID int64) *outgoingEmail {
+	query, err := w.db.Query(
+		"select sender, recipient, subject from drafts where chat_id=? and created>=?",
+		chatID,
+		time.Now().Unix()-draftExpirySeconds)
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return nil
+	}
+	o := outgoingEmail{chatID: chatID}
+	checkErr(query.Scan(&o.from, &o.to, &o.subject))
+	return &o
+}
+
+// messageDraft returns the draft the message completes if the chat started an email with /send
+func (w *worker) messageDraft(m *tg.Message) *outgoingEmail {
+	if m.IsCommand() {
+		return nil
+	}
+	return w.draft(m.Chat.ID)
+}
+
+// completeDraft sends the draft with the message as its body,
+// the draft is passed in as it can expire or be deleted after it was looked up
+func (w *worker) completeDraft(m *tg.Message, o *outgoingEmail) {
+	chatID := m.Chat.ID
+	o.text = m.Text + m.Caption
+	var fileID, fileName, contentType string
+	if m.Document != nil {
+		fileID, fileName, contentType = m.Document.FileID, m.Document.FileName, m.Document.MimeType
+	} else if len(m.Photo) > 0 {
+		fileID, fileName, contentType = m.Photo[len(m.Photo)-1].FileID, "photo.jpg", "image/jpeg"
+	}
+	if strings.TrimSpace(o.text) == "" && fileID == "" {
+		_ = w.sendText(chatID, false, parseRaw, "Send text, a photo or a document as the body of the email")
+		return
+	}
+	w.mustExec("delete from drafts where chat_id=?", chatID)
+	if fileID != "" {
+		data, err := w.downloadFile(fileID)
+		if err != nil {
+			lerr("cannot download a file, %v", err)
+			_ = w.sendText(chatID, false, parseRaw, "Cannot download the attachment")
+			return
+		}
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		o.attachments = append(o.attachments, attachment{data: data, contentType: contentType, fileName: fileName})
+	}
+	w.sendOutgoing(*o)
+}
+
+func (w *worker) downloadFile(fileID string) ([]byte, error) {
+	url, err := w.bot.GetFileDirectURL(fileID)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
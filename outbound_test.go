@@ -0,0 +1,102 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCompleteDraftWithoutBody(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	relay, relayed := serveTestRelay(t)
+	w.cfg.SMTPRelay = relay
+	w.cfg.SMTPRelayAllowPlaintext = true
+	w.cfg.TimeoutSeconds = 10
+	w.cfg.LimitIntervalSeconds = 60
+	w.cfg.LimitWindowSeconds = 3600
+	addTestAddresses(w, 1)
+	w.processIncomingCommand(1, "send", testUsername(1)+"@"+testHost+" bob@example.com Lunch", nil)
+	sticker := &tg.Message{Chat: &tg.Chat{ID: 1}, Sticker: &tg.Sticker{FileID: "sticker"}}
+	if o := w.messageDraft(sticker); o == nil {
+		t.Fatal("expected a draft")
+	} else {
+		w.completeDraft(sticker, o)
+	}
+	select {
+	case <-relayed:
+		t.Fatal("expected an email without a body not to be sent")
+	default:
+	}
+	sent := f.sent("sendMessage")
+	if text := sent[len(sent)-1].form.Get("text"); !strings.HasPrefix(text, "Send text") {
+		t.Errorf("expected the body to be requested again, got %q", text)
+	}
+	text := &tg.Message{Chat: &tg.Chat{ID: 1}, Text: "At noon"}
+	o := w.messageDraft(text)
+	if o == nil {
+		t.Fatal("expected the draft to be kept")
+	}
+	w.completeDraft(text, o)
+	select {
+	case e := <-relayed:
+		if len(e.recipients) != 1 || e.recipients[0] != "bob@example.com" {
+			t.Errorf("expected the email to bob@example.com, got %v", e.recipients)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay received no email")
+	}
+	if w.draft(1) != nil {
+		t.Error("expected the draft to be deleted once sent")
+	}
+}
+
+func TestSendEmailRequiresTLS(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	relay, relayed := serveTestRelay(t)
+	w.cfg.SMTPRelay = relay
+	w.cfg.TimeoutSeconds = 10
+	from := testUsername(1) + "@" + testHost
+	if err := w.sendEmail(from, []string{"bob@example.com"}, testEmail("bob@example.com", 1)); err != errorRelayPlaintext {
+		t.Fatalf("expected the relay without STARTTLS to be refused, got %v", err)
+	}
+	w.cfg.SMTPRelayAllowPlaintext = true
+	if err := w.sendEmail(from, []string{"bob@example.com"}, testEmail("bob@example.com", 1)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay received no email")
+	}
+	select {
+	case <-relayed:
+		t.Error("expected the refused email not to reach the relay")
+	default:
+	}
+}
+
+func TestOutboundQuota(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.LimitIntervalSeconds = 60
+	w.cfg.LimitWindowSeconds = 120
+	w.mustExec("insert into users (chat_id) values (1), (2)")
+	taken := 0
+	for i := 0; i < 10; i++ {
+		if w.takeOutboundQuota(1) {
+			taken++
+		}
+	}
+	if taken != 4 {
+		t.Errorf("expected 4 emails within the window, got %d", taken)
+	}
+	if !w.takeOutboundQuota(2) {
+		t.Error("expected the quota to be per chat")
+	}
+	w.mustExec("update users set next_send=? where chat_id=1", time.Now().Unix()-1)
+	if !w.takeOutboundQuota(1) || w.takeOutboundQuota(1) {
+		t.Error("expected one email per interval after the burst")
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+// deliveryQueueSize is the number of emails waiting for every delivery worker
+const deliveryQueueSize = 64
+
+// deliveryPool delivers spooled emails concurrently,
+// emails of a chat always go to the same worker so they keep their order
+type deliveryPool struct {
+	queues []chan spooledEmail
+	done   chan struct{}
+}
+
+func (w *worker) startDeliveryPool(workers int) *deliveryPool {
+	p := &deliveryPool{done: make(chan struct{}, 1)}
+	for i := 0; i < workers; i++ {
+		queue := make(chan spooledEmail, deliveryQueueSize)
+		p.queues = append(p.queues, queue)
+		go func() {
+			for s := range queue {
+				w.deliverSpooled(s)
+				p.notifyDone()
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch queues the email to the worker of its chat, it returns false if the queue is full
+func (p *deliveryPool) dispatch(s spooledEmail) bool {
+	select {
+	case p.queues[uint64(s.chatID)%uint64(len(p.queues))] <- s:
+		return true
+	default:
+		return false
+	}
+}
+
+// notifyDone tells the main loop that the next emails can be dispatched
+func (p *deliveryPool) notifyDone() {
+	select {
+	case p.done <- struct{}{}:
+	default:
+	}
+}
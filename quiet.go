@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const quietUsage = "Command format: /quiet <HH:MM-HH:MM> <time-zone> [summary] or /quiet off"
+
+// quietHours are the hours when emails are delivered without notifications,
+// start and end are minutes of the day in the time zone of the chat
+type quietHours struct {
+	start    int
+	end      int
+	location *time.Location
+	summary  bool
+}
+
+// contains returns true if the time is within quiet hours, the window may wrap around midnight
+func (q *quietHours) contains(t time.Time) bool {
+	t = t.In(q.location)
+	m := t.Hour()*60 + t.Minute()
+	if q.start <= q.end {
+		return m >= q.start && m < q.end
+	}
+	return m >= q.start || m < q.end
+}
+
+// endAfter returns the end of quiet hours following the time
+func (q *quietHours) endAfter(t time.Time) time.Time {
+	t = t.In(q.location)
+	end := time.Date(t.Year(), t.Month(), t.Day(), q.end/60, q.end%60, 0, 0, q.location)
+	if !end.After(t) {
+		end = end.AddDate(0, 0, 1)
+	}
+	return end
+}
+
+func formatMinutes(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+// parseMinutes parses HH:MM into minutes of the day
+func parseMinutes(s string) (int, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, false
+	}
+	h, err := strconv.Atoi(parts[0])
+	if err != nil || h < 0 || h > 23 {
+		return 0, false
+	}
+	m, err := strconv.Atoi(parts[1])
+	if err != nil || m < 0 || m > 59 {
+		return 0, false
+	}
+	return h*60 + m, true
+}
+
+func (w *worker) quietHours(chatID int64) *quietHours {
+	query, err := w.db.Query(
+		"select quiet_start, quiet_end, time_zone, quiet_summary from chat_settings where chat_id=? and quiet_start<>quiet_end",
+		chatID)
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return nil
+	}
+	var q quietHours
+	var timeZone string
+	checkErr(query.Scan(&q.start, &q.end, &timeZone, &q.summary))
+	if q.location, err = time.LoadLocation(timeZone); err != nil {
+		lerr("cannot load time zone %s, %v", timeZone, err)
+		return nil
+	}
+	return &q
+}
+
+// chatLocation returns the time zone of the chat set with /quiet or UTC if it is not set
+func (w *worker) chatLocation(chatID int64) *time.Location {
+	query, err := w.db.Query("select time_zone from chat_settings where chat_id=?", chatID)
+	checkErr(err)
+	defer query.Close()
+	var timeZone string
+	if query.Next() {
+		checkErr(query.Scan(&timeZone))
+	}
+	if timeZone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		lerr("cannot load time zone %s, %v", timeZone, err)
+		return time.UTC
+	}
+	return location
+}
+
+// isQuiet returns true if the chat is within quiet hours
+func (w *worker) isQuiet(chatID int64, now time.Time) bool {
+	q := w.quietHours(chatID)
+	return q != nil && q.contains(now)
+}
+
+// rememberQuietEmail remembers the email for the summary if it arrived within quiet hours
+func (w *worker) rememberQuietEmail(chatID int64, e *env, now time.Time) {
+	q := w.quietHours(chatID)
+	if q == nil || !q.summary || !q.contains(now) {
+		return
+	}
+	w.mustExec(
+		"insert into quiet_emails (chat_id, subject, sender, created) values (?,?,?,?)",
+		chatID,
+		e.mime.GetHeader("Subject"),
+		e.mime.GetHeader("From"),
+		now.Unix())
+	w.mustExec(
+		"update chat_settings set next_summary=? where chat_id=? and next_summary=0",
+		q.endAfter(now).Unix(),
+		chatID)
+}
+
+// sendScheduled sends due digests and summaries of quiet hours
+func (w *worker) sendScheduled() {
+	if w.cfg.DigestSecret != "" {
+		w.sendDigests()
+	}
+	w.sendQuietSummaries()
+}
+
+// sendQuietSummaries lists emails that arrived within quiet hours once they are over
+func (w *worker) sendQuietSummaries() {
+	query, err := w.db.Query("select chat_id from chat_settings where next_summary>0 and next_summary<=?", time.Now().Unix())
+	checkErr(err)
+	var chats []int64
+	for query.Next() {
+		var chatID int64
+		checkErr(query.Scan(&chatID))
+		chats = append(chats, chatID)
+	}
+	checkErr(query.Close())
+	for _, chatID := range chats {
+		w.sendQuietSummary(chatID)
+	}
+}
+
+func (w *worker) sendQuietSummary(chatID int64) {
+	query, err := w.db.Query("select subject, sender from quiet_emails where chat_id=? order by created", chatID)
+	checkErr(err)
+	var lines []string
+	for query.Next() {
+		var subject, sender string
+		checkErr(query.Scan(&subject, &sender))
+		lines = append(lines, fmt.Sprintf(
+			"• <b>%s</b>\n%s",
+			html.EscapeString(truncateField(subject)),
+			html.EscapeString(truncateField(sender))))
+	}
+	checkErr(query.Close())
+	if len(lines) > 0 {
+		text := fmt.Sprintf("<b>While you were away</b>\nEmails: %d\n\n", len(lines)) + strings.Join(lines, "\n\n")
+		for _, c := range chunkHTML(text, w.cfg.MaxTextChunkSize) {
+			if err := w.sendTextWithPriority(chatID, true, parseHTML, c, priorityDelivery); err != nil {
+				return
+			}
+		}
+	}
+	w.mustExec("delete from quiet_emails where chat_id=?", chatID)
+	w.mustExec("update chat_settings set next_summary=0 where chat_id=?", chatID)
+}
+
+// quiet shows or sets quiet hours of the chat
+func (w *worker) quiet(chatID int64, arguments string) {
+	parts := strings.Fields(arguments)
+	switch {
+	case len(parts) == 0:
+		q := w.quietHours(chatID)
+		if q == nil {
+			_ = w.sendText(chatID, false, parseRaw, "Quiet hours are off")
+			return
+		}
+		text := fmt.Sprintf("Quiet hours: %s-%s %s", formatMinutes(q.start), formatMinutes(q.end), q.location)
+		if q.summary {
+			text += ", with a summary"
+		}
+		_ = w.sendText(chatID, false, parseRaw, text)
+		return
+	case len(parts) == 1 && strings.ToLower(parts[0]) == "off":
+		w.mustExec("update chat_settings set quiet_start=0, quiet_end=0, quiet_summary=0, next_summary=0 where chat_id=?", chatID)
+		w.mustExec("delete from quiet_emails where chat_id=?", chatID)
+		_ = w.sendText(chatID, false, parseRaw, "OK")
+		return
+	case len(parts) < 2 || len(parts) > 3 || len(parts) == 3 && strings.ToLower(parts[2]) != "summary":
+		_ = w.sendText(chatID, false, parseRaw, quietUsage)
+		return
+	}
+	window := strings.Split(parts[0], "-")
+	if len(window) != 2 {
+		_ = w.sendText(chatID, false, parseRaw, quietUsage)
+		return
+	}
+	start, okStart := parseMinutes(window[0])
+	end, okEnd := parseMinutes(window[1])
+	if !okStart || !okEnd || start == end {
+		_ = w.sendText(chatID, false, parseRaw, "Quiet hours are invalid")
+		return
+	}
+	location, err := time.LoadLocation(parts[1])
+	if err != nil || parts[1] == "" || parts[1] == "Local" {
+		_ = w.sendText(chatID, false, parseRaw, "Time zone is invalid, use a name like Europe/Berlin")
+		return
+	}
+	summary := len(parts) == 3
+	w.mustExec("insert or ignore into chat_settings (chat_id) values (?)", chatID)
+	w.mustExec(
+		"update chat_settings set quiet_start=?, quiet_end=?, time_zone=?, quiet_summary=? where chat_id=?",
+		start,
+		end,
+		location.String(),
+		summary,
+		chatID)
+	if !summary {
+		w.mustExec("update chat_settings set next_summary=0 where chat_id=?", chatID)
+		w.mustExec("delete from quiet_emails where chat_id=?", chatID)
+	}
+	// digests follow the time zone of the chat
+	w.rescheduleDigests(chatID, location)
+	_ = w.sendText(chatID, false, parseRaw, "OK")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHoursAcrossMidnight(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &quietHours{start: 23 * 60, end: 8 * 60, location: berlin}
+	for _, c := range []struct {
+		time  string
+		quiet bool
+	}{
+		{"2024-05-10T22:59:00+02:00", false},
+		{"2024-05-10T23:00:00+02:00", true},
+		{"2024-05-11T00:30:00+02:00", true},
+		{"2024-05-11T07:59:00+02:00", true},
+		{"2024-05-11T08:00:00+02:00", false},
+		{"2024-05-11T12:00:00+02:00", false},
+		// the same instant in UTC is within quiet hours in Berlin
+		{"2024-05-10T21:30:00Z", true},
+	} {
+		now, _ := time.Parse(time.RFC3339, c.time)
+		if quiet := q.contains(now); quiet != c.quiet {
+			t.Errorf("%s: got %v, expected %v", c.time, quiet, c.quiet)
+		}
+	}
+	for _, c := range []struct {
+		time string
+		end  string
+	}{
+		{"2024-05-10T23:30:00+02:00", "2024-05-11T08:00:00+02:00"},
+		{"2024-05-11T07:00:00+02:00", "2024-05-11T08:00:00+02:00"},
+		{"2024-05-11T08:00:00+02:00", "2024-05-12T08:00:00+02:00"},
+	} {
+		now, _ := time.Parse(time.RFC3339, c.time)
+		end, _ := time.Parse(time.RFC3339, c.end)
+		if e := q.endAfter(now); !e.Equal(end) {
+			t.Errorf("end after %s: got %s, expected %s", c.time, e, c.end)
+		}
+	}
+	day := &quietHours{start: 13 * 60, end: 14 * 60, location: time.UTC}
+	for at, quiet := range map[time.Time]bool{
+		time.Date(2024, 5, 10, 12, 59, 0, 0, time.UTC): false,
+		time.Date(2024, 5, 10, 13, 30, 0, 0, time.UTC): true,
+		time.Date(2024, 5, 10, 14, 0, 0, 0, time.UTC):  false,
+	} {
+		if day.contains(at) != quiet {
+			t.Errorf("%s: expected %v within a window inside a day", at, quiet)
+		}
+	}
+}
+
+func TestQuietCommand(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	liftChatLimit(w, 1)
+	reply := func(arguments string) string {
+		w.quiet(1, arguments)
+		sent := f.sent("sendMessage")
+		return sent[len(sent)-1].form.Get("text")
+	}
+	for _, arguments := range []string{"23:00-08:00", "25:00-08:00 UTC", "23:00-23:00 UTC", "23:00-08:00 Mars/Base", "23:00-08:00 Local", "2300-0800 UTC"} {
+		if text := reply(arguments); text == "OK" {
+			t.Errorf("expected %q to be refused", arguments)
+		}
+	}
+	if w.quietHours(1) != nil {
+		t.Fatal("expected no quiet hours after invalid commands")
+	}
+	if text := reply("23:00-08:00 Europe/Berlin summary"); text != "OK" {
+		t.Fatalf("expected quiet hours to be set, got %q", text)
+	}
+	q := w.quietHours(1)
+	if q == nil || q.start != 23*60 || q.end != 8*60 || q.location.String() != "Europe/Berlin" || !q.summary {
+		t.Fatalf("unexpected quiet hours %+v", q)
+	}
+	if text := reply(""); !strings.Contains(text, "23:00-08:00 Europe/Berlin, with a summary") {
+		t.Errorf("unexpected quiet hours shown %q", text)
+	}
+	if text := reply("off"); text != "OK" || w.quietHours(1) != nil {
+		t.Errorf("expected quiet hours to be turned off, got %q", text)
+	}
+}
+
+func TestQuietSummary(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.mustExec("insert into chat_settings (chat_id, quiet_start, quiet_end, time_zone, quiet_summary) values (1, 0, 1439, 'UTC', 1)")
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+	w.rememberQuietEmail(1, testEnv(w, 1, 1), now)
+	w.rememberQuietEmail(1, testEnv(w, 1, 2), now)
+	w.rememberQuietEmail(1, testEnv(w, 1, 3), time.Date(2024, 5, 10, 23, 59, 30, 0, time.UTC))
+	if n := singleInt(w.db.QueryRow("select count(*) from quiet_emails")); n != 2 {
+		t.Fatalf("expected emails within quiet hours to be remembered, got %d", n)
+	}
+	next := int64(singleInt(w.db.QueryRow("select next_summary from chat_settings")))
+	if end := time.Date(2024, 5, 10, 23, 59, 0, 0, time.UTC).Unix(); next != end {
+		t.Errorf("expected the summary at the end of quiet hours, got %v", time.Unix(next, 0).UTC())
+	}
+	w.sendQuietSummaries()
+	sent := f.sent("sendMessage")
+	if len(sent) != 1 || !strings.Contains(sent[0].form.Get("text"), "Emails: 2") {
+		t.Fatalf("expected a summary of two emails, got %d messages", len(sent))
+	}
+	if sent[0].form.Get("disable_notification") == "true" {
+		t.Error("expected the summary to notify")
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from quiet_emails")); n != 0 {
+		t.Errorf("expected the summary to forget the emails, %d left", n)
+	}
+}
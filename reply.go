@@ -0,0 +1,114 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// forwardedEmail is what we need to reply to a delivered email
+type forwardedEmail struct {
+	messageID  string
+	sender     string
+	address    string
+	subject    string
+	references string
+}
+
+// forwardedEmail returns the reply information of the email for the chat
+func (w *worker) forwardedEmail(chatID int64, e *env) *forwardedEmail {
+	if w.cfg.SMTPRelay == "" || len(e.recipients[chatID]) == 0 {
+		return nil
+	}
+	sender := e.from.Email()
+	for _, header := range []string{"Reply-To", "From"} {
+		if addresses, err := e.mime.AddressList(header); err == nil && len(addresses) > 0 {
+			sender = addresses[0].Address
+			break
+		}
+	}
+	if sender == "" {
+		return nil
+	}
+	return &forwardedEmail{
+		messageID:  e.mime.GetHeader("Message-ID"),
+		sender:     sender,
+		address:    e.recipients[chatID][0],
+		subject:    e.mime.GetHeader("Subject"),
+		references: e.mime.GetHeader("References"),
+	}
+}
+
+func (w *worker) rememberForwarded(chatID int64, telegramMessageID int, f *forwardedEmail) {
+	if f == nil {
+		return
+	}
+	w.mustExec(`
+		insert or replace into forwarded_emails (chat_id, telegram_message_id, message_id, sender, address, subject, refs, created)
+		values (?,?,?,?,?,?,?,?)`,
+		chatID,
+		telegramMessageID,
+		f.messageID,
+		f.sender,
+		f.address,
+		f.subject,
+		f.references,
+		time.Now().Unix())
+}
+
+// purgeForwarded forgets delivered emails that cannot be replied to anymore
+func (w *worker) purgeForwarded() {
+	w.mustExec("delete from forwarded_emails where created<?", time.Now().Unix()-int64(w.cfg.ReplyRetentionSeconds))
+}
+
+func (w *worker) forwardedForMessage(chatID int64, telegramMessageID int) *forwardedEmail {
+	query, err := w.db.Query(
+		"select message_id, sender, address, subject, refs from forwarded_emails where chat_id=? and telegram_message_id=? and created>=?",
+		chatID,
+		telegramMessageID,
+		time.Now().Unix()-int64(w.cfg.ReplyRetentionSeconds))
+	checkErr(err)
+	defer query.Close()
+	if !query.Next() {
+		return nil
+	}
+	var f forwardedEmail
+	checkErr(query.Scan(&f.messageID, &f.sender, &f.address, &f.subject, &f.references))
+	return &f
+}
+
+// repliedEmail returns the delivered email the message is a text reply to
+func (w *worker) repliedEmail(m *tg.Message) *forwardedEmail {
+	if w.cfg.SMTPRelay == "" || m.IsCommand() || m.Text == "" {
+		return nil
+	}
+	replyTo := m.ReplyToMessage
+	if replyTo == nil || replyTo.From == nil || replyTo.From.ID != w.ourID() {
+		return nil
+	}
+	return w.forwardedForMessage(m.Chat.ID, replyTo.MessageID)
+}
+
+// replyToEmail sends the message as an email reply from the address that received the original email,
+// the email is passed in as it can expire after it was looked up
+func (w *worker) replyToEmail(m *tg.Message, f *forwardedEmail) {
+	chatID := m.Chat.ID
+	if _, _, _, ok := w.chatAddress(chatID, f.address); !ok {
+		_ = w.sendText(chatID, false, parseRaw, "Address not found")
+		return
+	}
+	subject := f.subject
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	w.sendOutgoing(outgoingEmail{
+		chatID:     chatID,
+		from:       f.address,
+		to:         f.sender,
+		subject:    subject,
+		inReplyTo:  f.messageID,
+		references: strings.TrimSpace(f.references + " " + f.messageID),
+		text:       m.Text,
+	})
+}
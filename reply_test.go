@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/igrmk/go-smtpd/smtpd"
+	"github.com/jhillyerd/enmime"
+)
+
+// relayedEmail is an email received by the SMTP relay stand-in
+type relayedEmail struct {
+	from       string
+	recipients []string
+	data       bytes.Buffer
+	received   chan<- *relayedEmail
+}
+
+func (e *relayedEmail) AddRecipient(rcpt smtpd.MailAddress) error {
+	e.recipients = append(e.recipients, rcpt.Email())
+	return nil
+}
+
+func (e *relayedEmail) BeginData() error { return nil }
+
+func (e *relayedEmail) Write(line []byte) error {
+	e.data.Write(line)
+	return nil
+}
+
+func (e *relayedEmail) Close() error {
+	e.received <- e
+	return nil
+}
+
+// serveTestRelay runs an SMTP relay stand-in and returns its address and the emails it receives
+func serveTestRelay(t testing.TB) (string, <-chan *relayedEmail) {
+	received := make(chan *relayedEmail, 16)
+	server := &smtpd.Server{
+		Hostname: "relay.example.com",
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress, size *int) (smtpd.Envelope, error) {
+			return &relayedEmail{from: from.Email(), received: received}, nil
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+	t.Cleanup(func() { _ = listener.Close() })
+	return listener.Addr().String(), received
+}
+
+func TestReplyHeaders(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	relay, relayed := serveTestRelay(t)
+	w.cfg.SMTPRelay = relay
+	w.cfg.SMTPRelayAllowPlaintext = true
+	w.cfg.ReplyRetentionSeconds = 3600
+	w.cfg.TimeoutSeconds = 10
+	addTestAddresses(w, 1)
+	addr := serveTestMail(t, w)
+	to := testUsername(1) + "@" + testHost
+	original := "From: Alice <alice@example.com>\r\n" +
+		"Reply-To: alice.replies@example.com\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: Lunch\r\n" +
+		"Message-ID: <second@example.com>\r\n" +
+		"In-Reply-To: <first@example.com>\r\n" +
+		"References: <first@example.com>\r\n" +
+		"\r\n" +
+		"Shall we meet at noon?\r\n"
+	if err := smtp.SendMail(addr, nil, "alice@example.com", []string{to}, []byte(original)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return w.spoolSize() == 0 && len(f.sent("sendMessage")) == 1 })
+	if chatID := f.sent("sendMessage")[0].form.Get("chat_id"); chatID != "1" {
+		t.Fatalf("expected the email to be delivered to chat 1, got %s", chatID)
+	}
+	// the stand-in numbers messages from 1
+	w.processTGUpdate(tg.Update{Message: &tg.Message{
+		MessageID:      100,
+		Chat:           &tg.Chat{ID: 1},
+		Text:           "Sure",
+		ReplyToMessage: &tg.Message{MessageID: 1, From: &tg.User{ID: 1}, Chat: &tg.Chat{ID: 1}},
+	}})
+	var reply *relayedEmail
+	select {
+	case reply = <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the relay received no reply")
+	}
+	if reply.from != to || len(reply.recipients) != 1 || reply.recipients[0] != "alice.replies@example.com" {
+		t.Errorf("expected a reply from %s to alice.replies@example.com, got %s to %v", to, reply.from, reply.recipients)
+	}
+	e, err := enmime.ReadEnvelope(&reply.data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, expected := range map[string]string{
+		"Subject":     "Re: Lunch",
+		"In-Reply-To": "<second@example.com>",
+		"References":  "<first@example.com> <second@example.com>",
+	} {
+		if value := e.GetHeader(header); value != expected {
+			t.Errorf("%s is %q, expected %q", header, value, expected)
+		}
+	}
+	if text := strings.TrimSpace(e.Text); text != "Sure" {
+		t.Errorf("expected the text of the Telegram message, got %q", text)
+	}
+}
+
+func TestReplyRetention(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	addTestAddresses(w, 1)
+	relay, relayed := serveTestRelay(t)
+	w.cfg.SMTPRelay = relay
+	w.cfg.SMTPRelayAllowPlaintext = true
+	w.cfg.ReplyRetentionSeconds = 3600
+	w.cfg.TimeoutSeconds = 10
+	f := &forwardedEmail{messageID: "<1@example.com>", sender: "alice@example.com", address: "user1@boxt.us", subject: "Lunch"}
+	w.rememberForwarded(1, 10, f)
+	w.rememberForwarded(1, 11, f)
+	w.mustExec("update forwarded_emails set created=? where telegram_message_id=10", time.Now().Unix()-3601)
+	reply := func(messageID int) *tg.Message {
+		return &tg.Message{
+			Chat:           &tg.Chat{ID: 1},
+			Text:           "Sure",
+			ReplyToMessage: &tg.Message{MessageID: messageID, From: &tg.User{ID: 1}},
+		}
+	}
+	if w.repliedEmail(reply(10)) != nil || w.repliedEmail(reply(11)) == nil {
+		t.Error("expected only the recent email to accept replies")
+	}
+	w.purgeForwarded()
+	if n := singleInt(w.db.QueryRow("select count(*) from forwarded_emails")); n != 1 {
+		t.Errorf("expected the expired email to be purged, %d left", n)
+	}
+	// the email can expire after it was looked up
+	f = w.repliedEmail(reply(11))
+	w.mustExec("delete from forwarded_emails")
+	w.replyToEmail(reply(11), f)
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Error("the relay received no reply")
+	}
+}
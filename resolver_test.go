@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+)
+
+// stubResolver serves DNS records from maps, names are case-insensitive
+type stubResolver struct {
+	mu      sync.Mutex
+	txt     map[string][]string
+	ip      map[string][]string
+	mx      map[string][]*net.MX
+	ptr     map[string][]string
+	fail    map[string]bool
+	queries map[string]int
+}
+
+func newStubResolver() *stubResolver {
+	return &stubResolver{
+		txt:     map[string][]string{},
+		ip:      map[string][]string{},
+		mx:      map[string][]*net.MX{},
+		ptr:     map[string][]string{},
+		fail:    map[string]bool{},
+		queries: map[string]int{},
+	}
+}
+
+func (r *stubResolver) lookup(name string) (key string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key = strings.TrimSuffix(strings.ToLower(name), ".")
+	r.queries[key]++
+	if r.fail[key] {
+		return key, &net.DNSError{Err: "server failure", Name: name, IsTemporary: true}
+	}
+	return key, nil
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *stubResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if txts, ok := r.txt[key]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *stubResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	key, err := r.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	ips, ok := r.ip[key]
+	if !ok {
+		return nil, notFound(host)
+	}
+	var addrs []net.IPAddr
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func (r *stubResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if mx, ok := r.mx[key]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	key, err := r.lookup(addr)
+	if err != nil {
+		return nil, err
+	}
+	if names, ok := r.ptr[key]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+func (r *stubResolver) count(name string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queries[strings.ToLower(name)]
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// sendPriority orders messages waiting for Telegram rate limits
+type sendPriority int
+
+const (
+	priorityCommand sendPriority = iota
+	priorityDelivery
+	priorityBroadcast
+	priorityCount
+)
+
+// Telegram limits, see https://core.telegram.org/bots/faq#my-bot-is-hitting-limits-how-do-i-avoid-this
+const (
+	globalMessagesPerSecond = 30
+	chatMessagesPerSecond   = 1
+	groupMessagesPerMinute  = 20
+)
+
+// sendMaxRetries is the number of retries after Telegram asks to retry later
+const sendMaxRetries = 3
+
+// chatLimitsSweepInterval is how often limits of idle chats are forgotten
+const chatLimitsSweepInterval = time.Minute
+
+// tokenBucket is a rate limiter allowing bursts up to its capacity
+type tokenBucket struct {
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(capacity, perSecond float64, now time.Time) *tokenBucket {
+	return &tokenBucket{capacity: capacity, rate: perSecond, tokens: capacity, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// readyAt returns the time when a token is available
+func (b *tokenBucket) readyAt(now time.Time) time.Time {
+	b.refill(now)
+	if b.tokens >= 1 {
+		return now
+	}
+	return now.Add(time.Duration((1 - b.tokens) / b.rate * float64(time.Second)))
+}
+
+// take spends tokens, it can leave the bucket in debt so that a burst larger than the capacity
+// delays the following messages
+func (b *tokenBucket) take(now time.Time, n int) {
+	b.refill(now)
+	b.tokens -= float64(n)
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.capacity
+}
+
+type chatLimits struct {
+	perSecond   *tokenBucket
+	perMinute   *tokenBucket
+	pausedUntil time.Time
+}
+
+type sendPermit struct {
+	chatID   int64
+	messages int
+	ready    chan struct{}
+}
+
+// sendScheduler grants permits to send messages according to the global and per-chat limits,
+// waiting messages of higher priority go first
+type sendScheduler struct {
+	mutex     sync.Mutex
+	wake      chan struct{}
+	pending   [priorityCount][]sendPermit
+	global    *tokenBucket
+	chats     map[int64]*chatLimits
+	lastSweep time.Time
+}
+
+func newSendScheduler() *sendScheduler {
+	now := time.Now()
+	s := &sendScheduler{
+		wake:      make(chan struct{}, 1),
+		global:    newTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond, now),
+		chats:     make(map[int64]*chatLimits),
+		lastSweep: now,
+	}
+	go s.run()
+	return s
+}
+
+// acquire blocks until the messages to the chat can be sent, an album counts as its number of messages
+func (s *sendScheduler) acquire(chatID int64, priority sendPriority, messages int) {
+	ready := make(chan struct{})
+	s.mutex.Lock()
+	s.pending[priority] = append(s.pending[priority], sendPermit{chatID: chatID, messages: messages, ready: ready})
+	s.mutex.Unlock()
+	s.notify()
+	<-ready
+}
+
+// pause stops sending to the chat as requested by Telegram's retry_after
+func (s *sendScheduler) pause(chatID int64, d time.Duration) {
+	s.mutex.Lock()
+	now := time.Now()
+	limits := s.chatLimits(chatID, now)
+	if until := now.Add(d); until.After(limits.pausedUntil) {
+		limits.pausedUntil = until
+	}
+	s.mutex.Unlock()
+	s.notify()
+}
+
+func (s *sendScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sendScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		s.mutex.Lock()
+		wait := s.grant(time.Now())
+		s.mutex.Unlock()
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-s.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// chatLimits returns the limits of the chat, groups have negative IDs and an additional per-minute limit
+func (s *sendScheduler) chatLimits(chatID int64, now time.Time) *chatLimits {
+	limits := s.chats[chatID]
+	if limits == nil {
+		limits = &chatLimits{perSecond: newTokenBucket(chatMessagesPerSecond, chatMessagesPerSecond, now)}
+		if chatID < 0 {
+			limits.perMinute = newTokenBucket(groupMessagesPerMinute, groupMessagesPerMinute/60., now)
+		}
+		s.chats[chatID] = limits
+	}
+	return limits
+}
+
+// readyAt returns the time when a message to the chat can be sent
+func (s *sendScheduler) readyAt(chatID int64, now time.Time) time.Time {
+	limits := s.chatLimits(chatID, now)
+	ready := s.global.readyAt(now)
+	if t := limits.perSecond.readyAt(now); t.After(ready) {
+		ready = t
+	}
+	if limits.perMinute != nil {
+		if t := limits.perMinute.readyAt(now); t.After(ready) {
+			ready = t
+		}
+	}
+	if limits.pausedUntil.After(ready) {
+		ready = limits.pausedUntil
+	}
+	return ready
+}
+
+// grant releases all permits that are ready and returns the time to wait for the next one
+func (s *sendScheduler) grant(now time.Time) time.Duration {
+	wait := time.Hour
+	for priority := range s.pending {
+		kept := s.pending[priority][:0]
+		for _, p := range s.pending[priority] {
+			ready := s.readyAt(p.chatID, now)
+			if ready.After(now) {
+				if d := ready.Sub(now); d < wait {
+					wait = d
+				}
+				kept = append(kept, p)
+				continue
+			}
+			limits := s.chats[p.chatID]
+			s.global.take(now, p.messages)
+			limits.perSecond.take(now, p.messages)
+			if limits.perMinute != nil {
+				limits.perMinute.take(now, p.messages)
+			}
+			close(p.ready)
+		}
+		s.pending[priority] = kept
+	}
+	if now.Sub(s.lastSweep) > chatLimitsSweepInterval {
+		s.sweep(now)
+	}
+	return wait
+}
+
+// sweep forgets limits of chats that are not limited anymore
+func (s *sendScheduler) sweep(now time.Time) {
+	s.lastSweep = now
+	for chatID, limits := range s.chats {
+		if limits.pausedUntil.After(now) || !limits.perSecond.full(now) {
+			continue
+		}
+		if limits.perMinute != nil && !limits.perMinute.full(now) {
+			continue
+		}
+		delete(s.chats, chatID)
+	}
+}
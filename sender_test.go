@@ -0,0 +1,235 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestScheduler returns a scheduler driven by the test calling grant
+func newTestScheduler(now time.Time) *sendScheduler {
+	return &sendScheduler{
+		wake:      make(chan struct{}, 1),
+		global:    newTokenBucket(globalMessagesPerSecond, globalMessagesPerSecond, now),
+		chats:     make(map[int64]*chatLimits),
+		lastSweep: now,
+	}
+}
+
+func (s *sendScheduler) enqueue(chatID int64, priority sendPriority) chan struct{} {
+	return s.enqueueMessages(chatID, priority, 1)
+}
+
+func (s *sendScheduler) enqueueMessages(chatID int64, priority sendPriority, messages int) chan struct{} {
+	ready := make(chan struct{})
+	s.pending[priority] = append(s.pending[priority], sendPermit{chatID: chatID, messages: messages, ready: ready})
+	return ready
+}
+
+func granted(ready chan struct{}) bool {
+	select {
+	case <-ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// grantedWithin counts permits to the chat granted within the duration when they are always waiting
+func grantedWithin(chatID int64, d time.Duration) int {
+	start := time.Unix(0, 0)
+	s := newTestScheduler(start)
+	count := 0
+	ready := s.enqueue(chatID, priorityDelivery)
+	for now := start; !now.After(start.Add(d)); {
+		wait := s.grant(now)
+		if granted(ready) {
+			count++
+			ready = s.enqueue(chatID, priorityDelivery)
+			continue
+		}
+		now = now.Add(wait)
+	}
+	return count
+}
+
+func TestSchedulerChatLimit(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := newTestScheduler(start)
+	first := s.enqueue(1, priorityDelivery)
+	second := s.enqueue(1, priorityDelivery)
+	other := s.enqueue(2, priorityDelivery)
+	if wait := s.grant(start); wait != time.Second {
+		t.Errorf("expected to wait a second, got %v", wait)
+	}
+	if !granted(first) || granted(second) || !granted(other) {
+		t.Fatal("expected one message to every chat at once")
+	}
+	s.grant(start.Add(time.Second / 2))
+	if granted(second) {
+		t.Fatal("the second message is sent within a second")
+	}
+	s.grant(start.Add(time.Second))
+	if !granted(second) {
+		t.Fatal("the second message is not sent after a second")
+	}
+}
+
+func TestSchedulerGroupLimit(t *testing.T) {
+	if n := grantedWithin(1, time.Minute); n != 61 {
+		t.Errorf("expected 61 messages to a private chat within a minute, got %d", n)
+	}
+	// a burst of 20 messages and then one every 3 seconds
+	if n := grantedWithin(-1, time.Minute); n != 40 {
+		t.Errorf("expected 40 messages to a group within a minute, got %d", n)
+	}
+}
+
+func TestSchedulerGlobalLimit(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := newTestScheduler(start)
+	var permits []chan struct{}
+	for chatID := int64(1); chatID <= 2*globalMessagesPerSecond; chatID++ {
+		permits = append(permits, s.enqueue(chatID, priorityDelivery))
+	}
+	s.grant(start)
+	count := 0
+	for _, p := range permits {
+		if granted(p) {
+			count++
+		}
+	}
+	if count != globalMessagesPerSecond {
+		t.Errorf("expected %d messages at once, got %d", globalMessagesPerSecond, count)
+	}
+}
+
+func TestSchedulerCommandPriority(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := newTestScheduler(start)
+	s.enqueue(1, priorityDelivery)
+	s.grant(start)
+	delivery := s.enqueue(1, priorityDelivery)
+	broadcast := s.enqueue(1, priorityBroadcast)
+	command := s.enqueue(1, priorityCommand)
+	s.grant(start.Add(time.Second))
+	if !granted(command) || granted(delivery) || granted(broadcast) {
+		t.Fatal("expected a command to go before waiting deliveries")
+	}
+	s.grant(start.Add(2 * time.Second))
+	if !granted(delivery) || granted(broadcast) {
+		t.Fatal("expected a delivery to go before waiting broadcasts")
+	}
+}
+
+func TestSchedulerAlbum(t *testing.T) {
+	start := time.Unix(0, 0)
+	s := newTestScheduler(start)
+	album := s.enqueueMessages(1, priorityDelivery, 10)
+	s.grant(start)
+	if !granted(album) {
+		t.Fatal("expected the album to be sent at once")
+	}
+	if tokens := s.global.tokens; tokens != globalMessagesPerSecond-10 {
+		t.Errorf("expected the album to take 10 global tokens, %g left", tokens)
+	}
+	next := s.enqueue(1, priorityDelivery)
+	if wait := s.grant(start); wait != 10*time.Second {
+		t.Errorf("expected the next message to wait for every message of the album, got %v", wait)
+	}
+	s.grant(start.Add(10 * time.Second))
+	if !granted(next) {
+		t.Error("expected the next message after the wait")
+	}
+}
+
+// TestBroadcastPriority checks that a broadcast does not hold commands of users
+func TestBroadcastPriority(t *testing.T) {
+	const chats = 60
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.AdminID = 1000
+	for chatID := 1; chatID <= chats; chatID++ {
+		w.mustExec("insert into users (chat_id, external_id) values (?,?)", chatID, testUsername(chatID))
+	}
+	addTestAddresses(w, chats)
+	start := time.Now()
+	w.processIncomingCommand(w.cfg.AdminID, "broadcast", "news", nil)
+	w.processIncomingCommand(chats, "addresses", "", nil)
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected updates to be processed while broadcasting, took %v", d)
+	}
+	waitFor(t, 10*time.Second, func() bool {
+		for _, r := range f.sent("sendMessage") {
+			if r.form.Get("chat_id") == "1000" {
+				return true
+			}
+		}
+		return false
+	})
+	broadcasts := 0
+	for _, r := range f.sent("sendMessage") {
+		if r.form.Get("text") == "news" {
+			broadcasts++
+		} else if r.form.Get("chat_id") == strconv.Itoa(chats) && broadcasts == chats {
+			t.Error("expected the command to be answered before the broadcast finished")
+		}
+	}
+	if broadcasts != chats {
+		t.Errorf("expected %d broadcast messages, got %d", chats, broadcasts)
+	}
+}
+
+func TestSchedulerPause(t *testing.T) {
+	start := time.Now()
+	s := newTestScheduler(start)
+	s.pause(1, 5*time.Second)
+	ready := s.enqueue(1, priorityCommand)
+	if wait := s.grant(start.Add(time.Second)); wait <= 3*time.Second || granted(ready) {
+		t.Fatal("expected the chat to be paused")
+	}
+	s.grant(start.Add(6 * time.Second))
+	if !granted(ready) {
+		t.Fatal("expected the chat to resume after the pause")
+	}
+}
+
+func TestSendRetryAfter(t *testing.T) {
+	f := newFakeTelegram(t)
+	f.reply = func(n int, r telegramRequest) string {
+		if n == 0 {
+			return telegramError(429, "Too Many Requests: retry after 1", 1)
+		}
+		return ""
+	}
+	w := &worker{bot: newTestBot(t, f), cfg: &config{}, scheduler: newSendScheduler()}
+	sent, err := w.sendMessage(textMessage(1, false, parseRaw, "hello"), priorityDelivery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := f.sent("sendMessage")
+	if len(requests) != 2 || sent.MessageID != 1 {
+		t.Fatalf("expected the message to be sent on the second request, got %d requests", len(requests))
+	}
+	if d := requests[1].time.Sub(requests[0].time); d < time.Second {
+		t.Errorf("expected to retry after a second, retried after %v", d)
+	}
+	if text := requests[1].form.Get("text"); text != "hello" {
+		t.Errorf("expected the same message, got %q", text)
+	}
+}
+
+func TestSendPermanentError(t *testing.T) {
+	f := newFakeTelegram(t)
+	f.reply = func(n int, r telegramRequest) string {
+		return telegramError(400, "Bad Request: can't parse entities", 0)
+	}
+	w := &worker{bot: newTestBot(t, f), cfg: &config{}, scheduler: newSendScheduler()}
+	_, err := w.sendMessage(textMessage(1, false, parseHTML, "<b>"), priorityDelivery)
+	if !isPermanentSendError(err) {
+		t.Errorf("expected a permanent error, got %v", err)
+	}
+	if n := len(f.sent("sendMessage")); n != 1 {
+		t.Errorf("expected no retries, got %d requests", n)
+	}
+}
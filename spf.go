@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// spfResult is a result of the SPF check as defined in RFC 7208
+type spfResult int
+
+const (
+	spfNone spfResult = iota
+	spfNeutral
+	spfPass
+	spfFail
+	spfSoftFail
+	spfTempError
+	spfPermError
+)
+
+func (r spfResult) String() string {
+	switch r {
+	case spfNone:
+		return "none"
+	case spfNeutral:
+		return "neutral"
+	case spfPass:
+		return "pass"
+	case spfFail:
+		return "fail"
+	case spfSoftFail:
+		return "softfail"
+	case spfTempError:
+		return "temperror"
+	case spfPermError:
+		return "permerror"
+	}
+	return "unknown"
+}
+
+const (
+	spfPolicyAnnotate = "annotate"
+	spfPolicyTag      = "tag"
+	spfPolicyReject   = "reject"
+)
+
+const spfMaxLookups = 10
+const spfMaxVoidLookups = 2
+
+var errorSPFPerm = errors.New("SPF permanent error")
+var errorSPFTemp = errors.New("SPF temporary error")
+
+type spfChecker struct {
+	resolver    resolver
+	ip          net.IP
+	sender      string
+	helo        string
+	lookups     int
+	voidLookups int
+}
+
+// checkSPF evaluates the SPF policy of the sender domain for the client IP,
+// a null sender is checked as postmaster of the HELO name as RFC 7208 section 2.4 says
+func checkSPF(ctx context.Context, r resolver, ip net.IP, sender string, helo string) spfResult {
+	if ip == nil {
+		return spfNone
+	}
+	sender = spfSender(sender, helo)
+	local, domain := splitAddress(sender)
+	if local == "" || domain == "" {
+		return spfNone
+	}
+	c := &spfChecker{resolver: r, ip: ip, sender: sender, helo: helo}
+	return c.checkHost(ctx, domain)
+}
+
+// spfSender returns the identity SPF checks
+func spfSender(sender string, helo string) string {
+	if sender == "" {
+		return "postmaster@" + helo
+	}
+	return sender
+}
+
+func (c *spfChecker) checkHost(ctx context.Context, domain string) spfResult {
+	if !validDomain(domain) {
+		return spfNone
+	}
+	record, result := c.record(ctx, domain)
+	if record == "" {
+		return result
+	}
+	var redirect string
+	terms := strings.Fields(record)[1:]
+	for _, term := range terms {
+		if name, value, ok := spfModifier(term); ok {
+			if name == "redirect" {
+				if redirect != "" {
+					return spfPermError
+				}
+				redirect = value
+			}
+			continue
+		}
+		qualifier := spfPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier = spfFail
+			term = term[1:]
+		case '~':
+			qualifier = spfSoftFail
+			term = term[1:]
+		case '?':
+			qualifier = spfNeutral
+			term = term[1:]
+		}
+		match, err := c.mechanism(ctx, domain, term)
+		switch {
+		case err == errorSPFTemp:
+			return spfTempError
+		case err != nil:
+			return spfPermError
+		case match:
+			return qualifier
+		}
+	}
+	if redirect != "" {
+		if !c.countLookup() {
+			return spfPermError
+		}
+		target, err := c.expand(redirect, domain)
+		if err != nil {
+			return spfPermError
+		}
+		result := c.checkHost(ctx, target)
+		if result == spfNone {
+			return spfPermError
+		}
+		return result
+	}
+	return spfNeutral
+}
+
+// record returns the single SPF record of the domain or the result to return if there is no such record
+func (c *spfChecker) record(ctx context.Context, domain string) (string, spfResult) {
+	txts, err := c.resolver.LookupTXT(ctx, domain)
+	if isNotFound(err) {
+		return "", spfNone
+	}
+	if err != nil {
+		return "", spfTempError
+	}
+	var records []string
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return "", spfNone
+	case 1:
+		return records[0], spfNone
+	}
+	return "", spfPermError
+}
+
+func spfModifier(term string) (name, value string, ok bool) {
+	idx := strings.IndexAny(term, "=:/")
+	if idx <= 0 || term[idx] != '=' {
+		return "", "", false
+	}
+	return strings.ToLower(term[:idx]), term[idx+1:], true
+}
+
+func (c *spfChecker) countLookup() bool {
+	c.lookups++
+	return c.lookups <= spfMaxLookups
+}
+
+func (c *spfChecker) countVoid(n int, err error) error {
+	if n > 0 {
+		return nil
+	}
+	if err != nil && !isNotFound(err) {
+		return errorSPFTemp
+	}
+	c.voidLookups++
+	if c.voidLookups > spfMaxVoidLookups {
+		return errorSPFPerm
+	}
+	return nil
+}
+
+func (c *spfChecker) mechanism(ctx context.Context, domain string, term string) (bool, error) {
+	name := term
+	arg := ""
+	if idx := strings.IndexAny(term, ":/"); idx != -1 {
+		name = term[:idx]
+		arg = term[idx:]
+	}
+	switch strings.ToLower(name) {
+	case "all":
+		if arg != "" {
+			return false, errorSPFPerm
+		}
+		return true, nil
+	case "include":
+		if !c.countLookup() {
+			return false, errorSPFPerm
+		}
+		target, err := c.domainArg(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		switch c.checkHost(ctx, target) {
+		case spfPass:
+			return true, nil
+		case spfTempError:
+			return false, errorSPFTemp
+		case spfPermError, spfNone:
+			return false, errorSPFPerm
+		}
+		return false, nil
+	case "a":
+		if !c.countLookup() {
+			return false, errorSPFPerm
+		}
+		spec, mask4, mask6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := c.domainArg(spec, domain, false)
+		if err != nil {
+			return false, err
+		}
+		return c.matchHost(ctx, target, mask4, mask6)
+	case "mx":
+		if !c.countLookup() {
+			return false, errorSPFPerm
+		}
+		spec, mask4, mask6, err := splitCIDR(arg)
+		if err != nil {
+			return false, err
+		}
+		target, err := c.domainArg(spec, domain, false)
+		if err != nil {
+			return false, err
+		}
+		mxs, err := c.resolver.LookupMX(ctx, target)
+		if err := c.countVoid(len(mxs), err); err != nil {
+			return false, err
+		}
+		if len(mxs) > spfMaxLookups {
+			return false, errorSPFPerm
+		}
+		for _, mx := range mxs {
+			match, err := c.matchHost(ctx, strings.TrimSuffix(mx.Host, "."), mask4, mask6)
+			if err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case "ptr":
+		if !c.countLookup() {
+			return false, errorSPFPerm
+		}
+		target, err := c.domainArg(arg, domain, false)
+		if err != nil {
+			return false, err
+		}
+		return c.matchPTR(ctx, target), nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errorSPFPerm
+		}
+		spec := arg[1:]
+		if !strings.Contains(spec, "/") {
+			if strings.ToLower(name) == "ip4" {
+				spec += "/32"
+			} else {
+				spec += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(spec)
+		if err != nil {
+			return false, errorSPFPerm
+		}
+		return network.Contains(c.ip), nil
+	case "exists":
+		if !c.countLookup() {
+			return false, errorSPFPerm
+		}
+		target, err := c.domainArg(arg, domain, true)
+		if err != nil {
+			return false, err
+		}
+		addrs, err := c.resolver.LookupIPAddr(ctx, target)
+		if err := c.countVoid(len(addrs), err); err != nil {
+			return false, err
+		}
+		return len(addrs) > 0, nil
+	}
+	return false, errorSPFPerm
+}
+
+// domainArg expands the ":domain-spec" argument of a mechanism
+func (c *spfChecker) domainArg(arg string, domain string, required bool) (string, error) {
+	if arg == "" {
+		if required {
+			return "", errorSPFPerm
+		}
+		return domain, nil
+	}
+	if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+		return "", errorSPFPerm
+	}
+	return c.expand(arg[1:], domain)
+}
+
+// splitCIDR splits "[:domain-spec][/ip4-cidr-length][//ip6-cidr-length]"
+func splitCIDR(arg string) (spec string, mask4 int, mask6 int, err error) {
+	mask4, mask6 = 32, 128
+	if idx := strings.Index(arg, "//"); idx != -1 {
+		mask6, err = strconv.Atoi(arg[idx+2:])
+		if err != nil || mask6 < 0 || mask6 > 128 {
+			return "", 0, 0, errorSPFPerm
+		}
+		arg = arg[:idx]
+	}
+	if idx := strings.Index(arg, "/"); idx != -1 {
+		mask4, err = strconv.Atoi(arg[idx+1:])
+		if err != nil || mask4 < 0 || mask4 > 32 {
+			return "", 0, 0, errorSPFPerm
+		}
+		arg = arg[:idx]
+	}
+	return arg, mask4, mask6, nil
+}
+
+func (c *spfChecker) matchHost(ctx context.Context, host string, mask4, mask6 int) (bool, error) {
+	addrs, err := c.resolver.LookupIPAddr(ctx, host)
+	if err := c.countVoid(len(addrs), err); err != nil {
+		return false, err
+	}
+	for _, a := range addrs {
+		if matchIP(c.ip, a.IP, mask4, mask6) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *spfChecker) matchPTR(ctx context.Context, domain string) bool {
+	names, err := c.resolver.LookupAddr(ctx, c.ip.String())
+	if err != nil {
+		return false
+	}
+	if len(names) > spfMaxLookups {
+		names = names[:spfMaxLookups]
+	}
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if name != domain && !strings.HasSuffix(name, "."+domain) {
+			continue
+		}
+		addrs, err := c.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(c.ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchIP(ip net.IP, candidate net.IP, mask4, mask6 int) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		candidate = candidate.To4()
+		if candidate == nil {
+			return false
+		}
+		mask := net.CIDRMask(mask4, 32)
+		return ip4.Mask(mask).Equal(candidate.Mask(mask))
+	}
+	if candidate.To4() != nil {
+		return false
+	}
+	mask := net.CIDRMask(mask6, 128)
+	return ip.Mask(mask).Equal(candidate.Mask(mask))
+}
+
+// expand expands the macros of a domain-spec as defined in RFC 7208 section 7
+func (c *spfChecker) expand(spec string, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		i++
+		if i == len(spec) {
+			return "", errorSPFPerm
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+		case '_':
+			b.WriteByte(' ')
+		case '-':
+			b.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end == -1 {
+				return "", errorSPFPerm
+			}
+			value, err := c.macro(spec[i+1:i+end], domain)
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(value)
+			i += end
+		default:
+			return "", errorSPFPerm
+		}
+	}
+	return strings.TrimSuffix(b.String(), "."), nil
+}
+
+func (c *spfChecker) macro(m string, domain string) (string, error) {
+	if m == "" {
+		return "", errorSPFPerm
+	}
+	local, senderDomain := splitAddress(c.sender)
+	var value string
+	switch m[0] {
+	case 's', 'S':
+		value = c.sender
+	case 'l', 'L':
+		value = local
+	case 'o', 'O':
+		value = senderDomain
+	case 'd', 'D':
+		value = domain
+	case 'i', 'I':
+		value = dottedIP(c.ip)
+	case 'v', 'V':
+		value = "ip6"
+		if c.ip.To4() != nil {
+			value = "in-addr"
+		}
+	case 'h', 'H':
+		value = c.helo
+	case 'p', 'P':
+		value = "unknown"
+	default:
+		return "", errorSPFPerm
+	}
+	m = m[1:]
+	digits := 0
+	for len(m) > 0 && m[0] >= '0' && m[0] <= '9' {
+		digits = digits*10 + int(m[0]-'0')
+		m = m[1:]
+	}
+	reverse := false
+	if len(m) > 0 && (m[0] == 'r' || m[0] == 'R') {
+		reverse = true
+		m = m[1:]
+	}
+	delimiters := "."
+	if m != "" {
+		if strings.Trim(m, ".-+,/_=") != "" {
+			return "", errorSPFPerm
+		}
+		delimiters = m
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool { return strings.ContainsRune(delimiters, r) })
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if digits > 0 && digits < len(parts) {
+		parts = parts[len(parts)-digits:]
+	}
+	return strings.Join(parts, "."), nil
+}
+
+// dottedIP returns the IP address in the form used by the "i" macro
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, fmt.Sprintf("%x", b>>4), fmt.Sprintf("%x", b&0xf))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// validDomain performs a basic syntax check of a domain name
+func validDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// spfLines returns the lines describing the SPF check result for the forwarded email
+func (e *env) spfLines() []string {
+	if e.cfg.SPFPolicy == "" {
+		return nil
+	}
+	lines := []string{fmt.Sprintf("SPF: %v", e.spf)}
+	if e.cfg.SPFPolicy != spfPolicyAnnotate && (e.spf == spfFail || e.spf == spfSoftFail) {
+		lines = append(lines, "WARNING: the sender is not authorized to send mail for this domain")
+	}
+	return lines
+}
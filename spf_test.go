@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/igrmk/go-smtpd/smtpd"
+)
+
+func TestCheckSPF(t *testing.T) {
+	cases := []struct {
+		name   string
+		txt    map[string]string // records of a name are separated by "|"
+		ip     map[string][]string
+		fail   []string
+		client string
+		result spfResult
+	}{
+		{name: "no record", client: "192.0.2.1", result: spfNone},
+		{name: "other records", txt: map[string]string{"example.com": "google-site-verification=x"}, client: "192.0.2.1", result: spfNone},
+		{name: "two records", txt: map[string]string{"example.com": "v=spf1 -all|v=spf1 +all"}, client: "192.0.2.1", result: spfPermError},
+		{name: "ip4 pass", txt: map[string]string{"example.com": "v=spf1 ip4:192.0.2.0/24 -all"}, client: "192.0.2.1", result: spfPass},
+		{name: "ip4 fail", txt: map[string]string{"example.com": "v=spf1 ip4:192.0.2.0/24 -all"}, client: "198.51.100.1", result: spfFail},
+		{name: "softfail", txt: map[string]string{"example.com": "v=spf1 ~all"}, client: "192.0.2.1", result: spfSoftFail},
+		{name: "neutral", txt: map[string]string{"example.com": "v=spf1 ?all"}, client: "192.0.2.1", result: spfNeutral},
+		{name: "no match", txt: map[string]string{"example.com": "v=spf1 ip4:192.0.2.0/24"}, client: "198.51.100.1", result: spfNeutral},
+		{name: "ip6 pass", txt: map[string]string{"example.com": "v=spf1 ip6:2001:db8::/32 -all"}, client: "2001:db8::1", result: spfPass},
+		{name: "unknown mechanism", txt: map[string]string{"example.com": "v=spf1 foo -all"}, client: "192.0.2.1", result: spfPermError},
+		{
+			name:   "a with cidr",
+			txt:    map[string]string{"example.com": "v=spf1 a/24 -all"},
+			ip:     map[string][]string{"example.com": {"192.0.2.200"}},
+			client: "192.0.2.1",
+			result: spfPass,
+		},
+		{
+			name:   "include pass",
+			txt:    map[string]string{"example.com": "v=spf1 include:_spf.example.net -all", "_spf.example.net": "v=spf1 ip4:192.0.2.1 -all"},
+			client: "192.0.2.1",
+			result: spfPass,
+		},
+		{
+			name:   "include fail does not match",
+			txt:    map[string]string{"example.com": "v=spf1 include:_spf.example.net ?all", "_spf.example.net": "v=spf1 -all"},
+			client: "192.0.2.1",
+			result: spfNeutral,
+		},
+		{
+			name:   "include without record",
+			txt:    map[string]string{"example.com": "v=spf1 include:_spf.example.net -all"},
+			client: "192.0.2.1",
+			result: spfPermError,
+		},
+		{
+			name:   "include temporary failure",
+			txt:    map[string]string{"example.com": "v=spf1 include:_spf.example.net -all"},
+			fail:   []string{"_spf.example.net"},
+			client: "192.0.2.1",
+			result: spfTempError,
+		},
+		{
+			name:   "redirect",
+			txt:    map[string]string{"example.com": "v=spf1 redirect=_spf.example.net", "_spf.example.net": "v=spf1 ip4:192.0.2.1 ~all"},
+			client: "198.51.100.1",
+			result: spfSoftFail,
+		},
+		{
+			name:   "redirect after a match is ignored",
+			txt:    map[string]string{"example.com": "v=spf1 ip4:192.0.2.1 redirect=_spf.example.net", "_spf.example.net": "v=spf1 -all"},
+			client: "192.0.2.1",
+			result: spfPass,
+		},
+		{
+			name:   "redirect without record",
+			txt:    map[string]string{"example.com": "v=spf1 redirect=_spf.example.net"},
+			client: "192.0.2.1",
+			result: spfPermError,
+		},
+		{
+			name:   "two redirects",
+			txt:    map[string]string{"example.com": "v=spf1 redirect=a.example.net redirect=b.example.net"},
+			client: "192.0.2.1",
+			result: spfPermError,
+		},
+		{
+			name:   "void lookups within the limit",
+			txt:    map[string]string{"example.com": "v=spf1 a:a.example.net a:b.example.net ip4:192.0.2.1 -all"},
+			client: "192.0.2.1",
+			result: spfPass,
+		},
+		{
+			name:   "too many void lookups",
+			txt:    map[string]string{"example.com": "v=spf1 a:a.example.net a:b.example.net a:c.example.net ip4:192.0.2.1 -all"},
+			client: "192.0.2.1",
+			result: spfPermError,
+		},
+		{
+			name:   "exists with macros",
+			txt:    map[string]string{"example.com": "v=spf1 exists:%{ir}.%{l1r-}._spf.%{d} -all"},
+			ip:     map[string][]string{"1.2.0.192.mail._spf.example.com": {"127.0.0.2"}},
+			client: "192.0.2.1",
+			result: spfPass,
+		},
+		{
+			name:   "invalid macro",
+			txt:    map[string]string{"example.com": "v=spf1 exists:%{x}.example.com -all"},
+			client: "192.0.2.1",
+			result: spfPermError,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := newStubResolver()
+			for name, records := range c.txt {
+				r.txt[name] = strings.Split(records, "|")
+			}
+			for name, ips := range c.ip {
+				r.ip[name] = ips
+			}
+			for _, name := range c.fail {
+				r.fail[name] = true
+			}
+			result := checkSPF(context.Background(), r, net.ParseIP(c.client), "mail-sender@example.com", "mx.example.org")
+			if result != c.result {
+				t.Errorf("got %v, expected %v", result, c.result)
+			}
+		})
+	}
+}
+
+// TestCheckSPFLookupLimit chains includes, the limit of 10 DNS lookups covers the whole evaluation
+func TestCheckSPFLookupLimit(t *testing.T) {
+	for _, c := range []struct {
+		includes int
+		result   spfResult
+	}{
+		{spfMaxLookups, spfPass},
+		{spfMaxLookups + 1, spfPermError},
+	} {
+		r := newStubResolver()
+		r.txt["example.com"] = []string{"v=spf1 include:i1.example.com -all"}
+		for i := 1; i < c.includes; i++ {
+			r.txt[fmt.Sprintf("i%d.example.com", i)] = []string{fmt.Sprintf("v=spf1 include:i%d.example.com -all", i+1)}
+		}
+		r.txt[fmt.Sprintf("i%d.example.com", c.includes)] = []string{"v=spf1 ip4:192.0.2.1 -all"}
+		result := checkSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "sender@example.com", "mx.example.org")
+		if result != c.result {
+			t.Errorf("%d includes: got %v, expected %v", c.includes, result, c.result)
+		}
+		if n := r.count(fmt.Sprintf("i%d.example.com", spfMaxLookups+1)); n != 0 {
+			t.Errorf("%d includes: queried past the limit", c.includes)
+		}
+	}
+}
+
+// TestSPFMacros checks the examples of RFC 7208 section 7.4
+func TestSPFMacros(t *testing.T) {
+	cases := []struct {
+		ip       string
+		spec     string
+		expanded string
+	}{
+		{"192.0.2.3", "%{s}", "strong-bad@email.example.com"},
+		{"192.0.2.3", "%{o}", "email.example.com"},
+		{"192.0.2.3", "%{d}", "email.example.com"},
+		{"192.0.2.3", "%{d4}", "email.example.com"},
+		{"192.0.2.3", "%{d3}", "email.example.com"},
+		{"192.0.2.3", "%{d2}", "example.com"},
+		{"192.0.2.3", "%{d1}", "com"},
+		{"192.0.2.3", "%{dr}", "com.example.email"},
+		{"192.0.2.3", "%{d2r}", "example.email"},
+		{"192.0.2.3", "%{l}", "strong-bad"},
+		{"192.0.2.3", "%{l-}", "strong.bad"},
+		{"192.0.2.3", "%{lr}", "strong-bad"},
+		{"192.0.2.3", "%{lr-}", "bad.strong"},
+		{"192.0.2.3", "%{l1r-}", "strong"},
+		{"192.0.2.3", "%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"192.0.2.3", "%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"192.0.2.3", "%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+		{"2001:db8::cb01", "%{ir}.%{v}._spf.%{d2}", "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"},
+		{"192.0.2.3", "a%%b%_c%-d", "a%b c%20d"},
+		{"192.0.2.3", "%{h}", "mx.example.org"},
+		{"192.0.2.3", "%{h2}", "example.org"},
+	}
+	for _, c := range cases {
+		checker := &spfChecker{ip: net.ParseIP(c.ip), sender: "strong-bad@email.example.com", helo: "mx.example.org"}
+		expanded, err := checker.expand(c.spec, "email.example.com")
+		if err != nil || expanded != c.expanded {
+			t.Errorf("%s expanded to %q, %v, expected %q", c.spec, expanded, err, c.expanded)
+		}
+	}
+	for _, spec := range []string{"%", "%{", "%{}", "%{x}", "%{d2x}", "%a"} {
+		checker := &spfChecker{ip: net.ParseIP("192.0.2.3"), sender: "strong-bad@email.example.com"}
+		if _, err := checker.expand(spec, "email.example.com"); err == nil {
+			t.Errorf("%s expanded without an error", spec)
+		}
+	}
+}
+
+// TestCheckSPFNullSender checks that a bounce is checked against the HELO name
+func TestCheckSPFNullSender(t *testing.T) {
+	r := newStubResolver()
+	r.txt["mx.example.org"] = []string{"v=spf1 exists:%{l}.%{h} -all"}
+	r.ip["postmaster.mx.example.org"] = []string{"127.0.0.2"}
+	if result := checkSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "", "mx.example.org"); result != spfPass {
+		t.Errorf("got %v, expected %v", result, spfPass)
+	}
+	if result := checkSPF(context.Background(), r, net.ParseIP("192.0.2.1"), "", ""); result != spfNone {
+		t.Errorf("got %v for no HELO name, expected %v", result, spfNone)
+	}
+}
+
+func TestConnectionHelo(t *testing.T) {
+	helo := make(chan string, 1)
+	server := &smtpd.Server{
+		Hostname: testHost,
+		OnNewMail: func(c smtpd.Connection, from smtpd.MailAddress, size *int) (smtpd.Envelope, error) {
+			helo <- connectionHelo(c)
+			return &smtpd.BasicEnvelope{}, nil
+		},
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = listener.Close() }()
+	go func() { _ = server.Serve(listener) }()
+	client, err := smtp.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = client.Close() }()
+	if err := client.Hello("MX.example.org."); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Mail(""); err != nil {
+		t.Fatal(err)
+	}
+	if h := <-helo; h != "mx.example.org" {
+		t.Errorf("expected the EHLO name, got %q", h)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/cipher"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/igrmk/go-smtpd/smtpd"
+)
+
+// spoolPollInterval is how often the spool is checked for due emails
+const spoolPollInterval = 10 * time.Second
+
+// spoolMaxBackoffShift limits the exponential backoff
+const spoolMaxBackoffShift = 10
+
+var errorDeliveryFailed = errors.New("Delivery failed")
+
+type spoolArgs struct {
+	result chan error
+	env    *env
+}
+
+// mailAddress implements smtpd.MailAddress for spooled emails
+type mailAddress string
+
+func (a mailAddress) Email() string { return string(a) }
+
+func (a mailAddress) Hostname() string {
+	_, host := splitAddress(string(a))
+	return host
+}
+
+// validate checks the headers of an email before accepting it
+func validate(e *env) error {
+	if e.mime.GetHeader("Message-ID") == "" {
+		return smtpd.SMTPError("501 Message-ID is not specified")
+	}
+	if !utf8.ValidString(e.mime.GetHeader("Subject")) {
+		return smtpd.SMTPError("501 Subject is invalid")
+	}
+	if !utf8.ValidString(e.mime.GetHeader("From")) {
+		return smtpd.SMTPError("501 From is invalid")
+	}
+	if !utf8.ValidString(e.mime.GetHeader("To")) {
+		return smtpd.SMTPError("501 To is invalid")
+	}
+	if !utf8.ValidString(e.mime.Text) {
+		return smtpd.SMTPError("501 message is invalid")
+	}
+	return nil
+}
+
+func (w *worker) spoolCipher() cipher.AEAD {
+	return newAEAD(secretKey(w.cfg.SpoolSecret, "spool"))
+}
+
+// enqueue checks the email and stores it encrypted in the spool for delivery
+func (w *worker) enqueue(e *env) error {
+	if err := validate(e); err != nil {
+		return err
+	}
+
+	var headerFrom string
+	if addresses, err := e.mime.AddressList("From"); err == nil && len(addresses) == 1 {
+		headerFrom = addresses[0].Address
+	}
+	senders := []string{e.from.Email(), headerFrom}
+
+	recipients := make(map[int64][]string)
+	rejected := 0
+	for chatID, addresses := range e.recipients {
+		switch w.checkSender(chatID, addresses, senders, true) {
+		case errorBlocked:
+			rejected++
+		case errorDiscarded:
+		default:
+			recipients[chatID] = addresses
+		}
+	}
+	if rejected == len(e.recipients) {
+		return smtpd.SMTPError("550 5.7.1 sender is blocked")
+	}
+	w.learnGreylistWhitelist(e)
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	authLinesJSON, err := json.Marshal(e.authLines)
+	checkErr(err)
+	ip := ""
+	if e.ip != nil {
+		ip = e.ip.String()
+	}
+	sealed := make(map[int64][]byte)
+	for chatID := range recipients {
+		data, err := seal(w.spoolCipher(), e.data, []byte(strconv.FormatInt(chatID, 10)))
+		if err != nil {
+			return err
+		}
+		sealed[chatID] = data
+	}
+	now := time.Now().Unix()
+	for chatID, addresses := range recipients {
+		recipientsJSON, err := json.Marshal(map[int64][]string{chatID: addresses})
+		checkErr(err)
+		w.mustExec(`
+			insert into spool (chat_id, data, mail_from, ip, recipients, auth_lines, dmarc_action, created, next_attempt)
+			values (?,?,?,?,?,?,?,?,?)`,
+			chatID,
+			sealed[chatID],
+			e.from.Email(),
+			ip,
+			string(recipientsJSON),
+			string(authLinesJSON),
+			e.dmarcAction,
+			now,
+			now)
+	}
+	return nil
+}
+
+type spooledEmail struct {
+	id          int64
+	chatID      int64
+	data        []byte
+	from        string
+	ip          string
+	recipients  string
+	authLines   string
+	dmarcAction string
+	attempts    int
+	created     int64
+}
+
+// dueEmails returns the oldest email of every chat if it is due,
+// later emails of a chat wait so that the chat receives them in order,
+// an email failing for longer than the hold time stops holding them
+func (w *worker) dueEmails(now int64) (emails []spooledEmail) {
+	query, err := w.db.Query(`
+		select id, chat_id, data, mail_from, ip, recipients, auth_lines, dmarc_action, attempts, created from spool s
+		where leased=0 and next_attempt<=?
+		and not exists (select 1 from spool p where p.chat_id=s.chat_id and p.id<s.id and p.created>=?)
+		order by id`,
+		now,
+		now-int64(w.cfg.SpoolHoldSeconds))
+	checkErr(err)
+	defer query.Close()
+	for query.Next() {
+		var s spooledEmail
+		checkErr(query.Scan(
+			&s.id,
+			&s.chatID,
+			&s.data,
+			&s.from,
+			&s.ip,
+			&s.recipients,
+			&s.authLines,
+			&s.dmarcAction,
+			&s.attempts,
+			&s.created))
+		emails = append(emails, s)
+	}
+	return
+}
+
+// restore decrypts and recreates the envelope of a spooled email
+func (w *worker) restore(s spooledEmail) (*env, error) {
+	data, err := unseal(w.spoolCipher(), s.data, []byte(strconv.FormatInt(s.chatID, 10)))
+	if err != nil {
+		return nil, err
+	}
+	s.data = data
+	return w.restoreEnvelope(s)
+}
+
+// restoreEnvelope recreates the envelope of a decrypted email
+func (w *worker) restoreEnvelope(s spooledEmail) (*env, error) {
+	e := &env{
+		BasicEnvelope: &smtpd.BasicEnvelope{},
+		from:          mailAddress(s.from),
+		data:          s.data,
+		cfg:           w.cfg,
+		ip:            net.ParseIP(s.ip),
+		dmarcAction:   s.dmarcAction,
+	}
+	if err := json.Unmarshal([]byte(s.recipients), &e.recipients); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(s.authLines), &e.authLines); err != nil {
+		return nil, err
+	}
+	if err := e.parse(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// dispatchSpool leases due emails to the delivery pool,
+// an email stays in the spool if the queue of its worker is full
+func (w *worker) dispatchSpool(pool *deliveryPool) {
+	for _, s := range w.dueEmails(time.Now().Unix()) {
+		w.mustExec("update spool set leased=1 where id=?", s.id)
+		if !pool.dispatch(s) {
+			w.mustExec("update spool set leased=0 where id=?", s.id)
+		}
+	}
+}
+
+// deliverSpooled delivers the email, reschedules it with exponential backoff on failure
+// and drops it when it expires
+func (w *worker) deliverSpooled(s spooledEmail) {
+	e, err := w.restore(s)
+	if err != nil {
+		lerr("cannot restore spooled email %d, %v", s.id, err)
+		w.mustExec("delete from spool where id=?", s.id)
+		return
+	}
+	if err := w.deliver(e); err == nil {
+		w.mustExec("delete from spool where id=?", s.id)
+		return
+	}
+	now := time.Now().Unix()
+	if now-s.created > int64(w.cfg.SpoolExpirySeconds) {
+		linf("spooled email %d expired after %d attempts", s.id, s.attempts+1)
+		w.mustExec("delete from spool where id=?", s.id)
+		return
+	}
+	shift := s.attempts
+	if shift > spoolMaxBackoffShift {
+		shift = spoolMaxBackoffShift
+	}
+	nextAttempt := now + int64(w.cfg.SpoolRetrySeconds)<<uint(shift)
+	w.mustExec("update spool set attempts=attempts+1, next_attempt=?, leased=0 where id=?", nextAttempt, s.id)
+}
+
+// spool asks the main loop to store the email in the spool
+func (e *env) spool() error {
+	result := make(chan error)
+	defer close(result)
+	e.spoolCh <- spoolArgs{result: result, env: e}
+	return <-result
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSpoolDelivery(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	addTestAddresses(w, 2)
+	addr := serveTestMail(t, w)
+	sendTestEmail(t, addr, 1, 1)
+	sendTestEmail(t, addr, 2, 2)
+	sendTestEmail(t, addr, 1, 3)
+	waitFor(t, 5*time.Second, func() bool { return w.spoolSize() == 0 })
+	var chat1 []string
+	for _, r := range f.sent("sendMessage") {
+		if r.form.Get("chat_id") == "1" {
+			chat1 = append(chat1, r.form.Get("text"))
+		}
+	}
+	if len(chat1) != 2 || !strings.Contains(chat1[0], "Test 1") || !strings.Contains(chat1[1], "Test 3") {
+		t.Fatalf("expected two emails to chat 1 in order, got %q", chat1)
+	}
+}
+
+func TestSpoolPermanentError(t *testing.T) {
+	f := newFakeTelegram(t)
+	f.reply = func(n int, r telegramRequest) string {
+		if n == 0 {
+			return telegramError(400, "Bad Request: can't parse entities", 0)
+		}
+		return ""
+	}
+	w := newTestWorker(t, f)
+	addTestAddresses(w, 1)
+	addr := serveTestMail(t, w)
+	sendTestEmail(t, addr, 1, 1)
+	sendTestEmail(t, addr, 1, 2)
+	waitFor(t, 5*time.Second, func() bool { return w.spoolSize() == 0 })
+	if n := len(f.sent("sendMessage")); n != 2 {
+		t.Errorf("expected the rejected email to be dropped and the next one delivered, got %d requests", n)
+	}
+}
+
+func TestSpoolTemporaryError(t *testing.T) {
+	f := newFakeTelegram(t)
+	f.reply = func(n int, r telegramRequest) string {
+		return telegramError(500, "Internal Server Error", 0)
+	}
+	w := newTestWorker(t, f)
+	addTestAddresses(w, 1)
+	addr := serveTestMail(t, w)
+	sendTestEmail(t, addr, 1, 1)
+	sendTestEmail(t, addr, 1, 2)
+	waitFor(t, 5*time.Second, func() bool {
+		return singleInt(w.db.QueryRow("select count(*) from spool where attempts>0")) > 0
+	})
+	time.Sleep(100 * time.Millisecond)
+	if n := len(f.sent("sendMessage")); n != 1 {
+		t.Errorf("expected the failed email to hold the next one, got %d requests", n)
+	}
+	if n := w.spoolSize(); n != 2 {
+		t.Errorf("expected both emails to stay in the spool, got %d", n)
+	}
+}
+
+// spoolTestEmail stores the email to the chat in the spool as enqueue does
+func spoolTestEmail(w *worker, chatID int, n int, created int64) {
+	to := testUsername(chatID) + "@" + testHost
+	data, err := seal(w.spoolCipher(), testEmail(to, n), []byte(strconv.Itoa(chatID)))
+	checkErr(err)
+	w.mustExec(`
+		insert into spool (chat_id, data, mail_from, ip, recipients, auth_lines, dmarc_action, created, next_attempt)
+		values (?,?,'sender@example.com','',?,'[]','',?,?)`,
+		chatID,
+		data,
+		fmt.Sprintf(`{"%d":["%s"]}`, chatID, to),
+		created,
+		created)
+}
+
+func TestSpoolEncrypted(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	if err := w.enqueue(testEnv(w, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from spool where instr(data, 'Hello 1')>0")); n != 0 {
+		t.Error("expected the spooled email to be encrypted")
+	}
+	emails := w.dueEmails(time.Now().Unix())
+	if len(emails) != 1 {
+		t.Fatalf("expected a due email, got %d", len(emails))
+	}
+	e, err := w.restore(emails[0])
+	if err != nil || !strings.Contains(e.mime.Text, "Hello 1") {
+		t.Fatalf("expected the email to be restored, got %v", err)
+	}
+	emails[0].chatID = 2
+	if _, err := w.restore(emails[0]); err == nil {
+		t.Error("expected the email not to be restored for another chat")
+	}
+}
+
+// TestDigestedRestore checks that emails waiting for a digest, which are not sealed as spooled ones, are restored
+func TestDigestedRestore(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.DigestSecret = "digest secret"
+	if err := w.addToDigest(1, testUsername(1), testHost, "<1@example.com>", testEnv(w, 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	var data []byte
+	checkErr(w.db.QueryRow("select data from digest_emails").Scan(&data))
+	e, err := w.digestedEnv(1, data)
+	if err != nil || !strings.Contains(e.mime.Text, "Hello 1") {
+		t.Fatalf("expected the digested email to be restored, got %v", err)
+	}
+}
+
+func TestSpoolBackoff(t *testing.T) {
+	f := newFakeTelegram(t)
+	f.reply = func(n int, r telegramRequest) string {
+		return telegramError(500, "Internal Server Error", 0)
+	}
+	w := newTestWorker(t, f)
+	w.cfg.SpoolRetrySeconds = 60
+	now := time.Now().Unix()
+	spoolTestEmail(w, 1, 1, now)
+	for attempt := 0; attempt < 3; attempt++ {
+		w.mustExec("update spool set next_attempt=0")
+		emails := w.dueEmails(time.Now().Unix())
+		if len(emails) != 1 {
+			t.Fatalf("attempt %d: expected a due email, got %d", attempt, len(emails))
+		}
+		w.deliverSpooled(emails[0])
+		delay := singleInt(w.db.QueryRow("select next_attempt-? from spool", time.Now().Unix()))
+		if expected := 60 << uint(attempt); delay < expected-2 || delay > expected {
+			t.Errorf("attempt %d: expected a retry in %d seconds, got %d", attempt, expected, delay)
+		}
+	}
+	if n := singleInt(w.db.QueryRow("select attempts from spool")); n != 3 {
+		t.Errorf("expected 3 attempts, got %d", n)
+	}
+	w.mustExec("update spool set next_attempt=0, created=?", now-int64(w.cfg.SpoolExpirySeconds)-1)
+	w.deliverSpooled(w.dueEmails(time.Now().Unix())[0])
+	if n := w.spoolSize(); n != 0 {
+		t.Errorf("expected the expired email to be dropped, %d left", n)
+	}
+}
+
+func TestSpoolHold(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	now := time.Now().Unix()
+	spoolTestEmail(w, 1, 1, now)
+	spoolTestEmail(w, 1, 2, now)
+	w.mustExec("update spool set next_attempt=? where id=1", now+3600)
+	if emails := w.dueEmails(now); len(emails) != 0 {
+		t.Errorf("expected a failing email to hold the next one, got %d due", len(emails))
+	}
+	w.mustExec("update spool set created=? where id=1", now-int64(w.cfg.SpoolHoldSeconds)-1)
+	if emails := w.dueEmails(now); len(emails) != 1 || emails[0].id != 2 {
+		t.Errorf("expected the next email to be due after the hold time, got %+v", emails)
+	}
+}
+
+// liftGlobalLimit lets benchmarks measure the spool rather than Telegram limits
+func liftGlobalLimit(w *worker) {
+	w.scheduler.mutex.Lock()
+	w.scheduler.global = newTokenBucket(1e9, 1e9, time.Now())
+	w.scheduler.mutex.Unlock()
+}
+
+// BenchmarkSMTPDelivery measures emails accepted over concurrent SMTP sessions and delivered to Telegram,
+// every email goes to another chat so that per-chat limits do not apply
+func BenchmarkSMTPDelivery(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			f := newFakeTelegram(b)
+			w := newTestWorker(b, f)
+			w.cfg.DeliveryWorkers = workers
+			liftGlobalLimit(w)
+			addTestAddresses(w, b.N)
+			addr := serveTestMail(b, w)
+			var next int64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					n := int(atomic.AddInt64(&next, 1))
+					sendTestEmail(b, addr, n, n)
+				}
+			})
+			waitFor(b, time.Minute, func() bool { return len(f.sent("sendMessage")) == b.N })
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "emails/s")
+		})
+	}
+}
+
+// BenchmarkSpoolDrain measures the delivery pool working off a filled spool
+func BenchmarkSpoolDrain(b *testing.B) {
+	for _, workers := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			f := newFakeTelegram(b)
+			w := newTestWorker(b, f)
+			liftGlobalLimit(w)
+			now := time.Now().Unix()
+			for chatID := 1; chatID <= b.N; chatID++ {
+				spoolTestEmail(w, chatID, chatID, now)
+			}
+			pool := w.startDeliveryPool(workers)
+			b.ResetTimer()
+			w.dispatchSpool(pool)
+			for w.spoolSize() > 0 {
+				select {
+				case <-pool.done:
+				case <-time.After(10 * time.Millisecond):
+				}
+				w.dispatchSpool(pool)
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "emails/s")
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "strings"
+
+// splitSubaddress splits the local part into the username and the tag as defined in RFC 5233
+func splitSubaddress(localPart string, separator string) (username string, tag string) {
+	if separator == "" {
+		return localPart, ""
+	}
+	if idx := strings.Index(localPart, separator); idx > 0 {
+		return localPart[:idx], localPart[idx+len(separator):]
+	}
+	return localPart, ""
+}
+
+func (w *worker) mutedTagsForChat(chatID int64) (addresses []string) {
+	query, err := w.db.Query(`
+		select muted_tags.username, muted_tags.host, muted_tags.tag from muted_tags
+		join addresses on addresses.username=muted_tags.username and addresses.host=muted_tags.host
+		where addresses.chat_id=?
+		order by muted_tags.host, muted_tags.username, muted_tags.tag`,
+		chatID)
+	checkErr(err)
+	defer query.Close()
+	for query.Next() {
+		var username, host, tag string
+		checkErr(query.Scan(&username, &host, &tag))
+		addresses = append(addresses, username+w.cfg.SubaddressSeparator+tag+"@"+host)
+	}
+	return
+}
+
+// subaddressLines returns the line with the tags the email was sent to
+func (w *worker) subaddressLines(recipients []string) []string {
+	var tags []string
+	seen := make(map[string]bool)
+	for _, r := range recipients {
+		localPart, _ := splitAddress(r)
+		if _, tag := splitSubaddress(localPart, w.cfg.SubaddressSeparator); tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return []string{"Tag: " + strings.Join(tags, ", ")}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitSubaddress(t *testing.T) {
+	for _, c := range []struct {
+		localPart string
+		separator string
+		username  string
+		tag       string
+	}{
+		{"user+shop", "+", "user", "shop"},
+		{"user+shop+extra", "+", "user", "shop+extra"},
+		{"user+", "+", "user", ""},
+		{"+shop", "+", "+shop", ""},
+		{"user-shop", "-", "user", "shop"},
+		{"user-shop", "+", "user-shop", ""},
+		{"user+shop", "", "user+shop", ""},
+		{"user", "+", "user", ""},
+	} {
+		username, tag := splitSubaddress(c.localPart, c.separator)
+		if username != c.username || tag != c.tag {
+			t.Errorf("%s with %q: got %q and %q, expected %q and %q", c.localPart, c.separator, username, tag, c.username, c.tag)
+		}
+	}
+}
+
+func TestSubaddressRecipient(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.SubaddressSeparator = "+"
+	addTestAddresses(w, 1)
+	username := testUsername(1)
+	if a := w.addressForRecipient(username+"+shop", testHost); a == nil || a.chatID != 1 || a.muted {
+		t.Fatalf("expected the tagged address to resolve to chat 1, got %+v", a)
+	}
+	if a := w.addressForRecipient("unknown+shop", testHost); a != nil {
+		t.Errorf("expected a tag of an unknown address not to resolve, got %+v", a)
+	}
+	w.setMuted(1, username, "shop", testHost, true)
+	if a := w.addressForRecipient(username+"+shop", testHost); a == nil || !a.muted {
+		t.Error("expected the tag to be muted")
+	}
+	if a := w.addressForRecipient(username+"+news", testHost); a == nil || a.muted {
+		t.Error("expected other tags not to be muted")
+	}
+	if a := w.addressForRecipient(username, testHost); a == nil || a.muted {
+		t.Error("expected the address without a tag not to be muted")
+	}
+	w.setMuted(1, username, "", testHost, true)
+	if a := w.addressForRecipient(username+"+news", testHost); a == nil || !a.muted {
+		t.Error("expected muting the address to mute its tags")
+	}
+	w.setMuted(1, username, "", testHost, false)
+	w.setMuted(1, username, "shop", testHost, false)
+	if a := w.addressForRecipient(username+"+shop", testHost); a == nil || a.muted {
+		t.Error("expected the tag to be unmuted")
+	}
+	w.cfg.SubaddressSeparator = ""
+	if a := w.addressForRecipient(username+"+shop", testHost); a != nil {
+		t.Error("expected tags not to resolve when subaddressing is disabled")
+	}
+}
+
+func TestSubaddressDelivery(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.SubaddressSeparator = "+"
+	addTestAddresses(w, 1)
+	addr := serveTestMail(t, w)
+	sendTestEmail(t, addr, 1, 1)
+	to := testUsername(1) + "+shop@" + testHost
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{to}, testEmail(to, 2)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return len(f.sent("sendMessage")) == 2 })
+	sent := f.sent("sendMessage")
+	if text := sent[0].form.Get("text"); strings.Contains(text, "Tag:") {
+		t.Errorf("expected no tag line for an untagged address, got %q", text)
+	}
+	if text := sent[1].form.Get("text"); !strings.Contains(text, "Tag: shop") {
+		t.Errorf("expected the tag line, got %q", text)
+	}
+}
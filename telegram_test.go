@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const testBotToken = "1:test"
+
+type telegramRequest struct {
+	method string
+	form   url.Values
+	time   time.Time
+}
+
+// fakeTelegram is a Bot API stand-in recording requests,
+// reply returns an error response for a request or an empty string to accept it
+type fakeTelegram struct {
+	server    *httptest.Server
+	mu        sync.Mutex
+	requests  []telegramRequest
+	messageID int
+	reply     func(n int, r telegramRequest) string
+}
+
+func newFakeTelegram(t testing.TB) *fakeTelegram {
+	f := &fakeTelegram{}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeTelegram) serve(rw http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/bot"+testBotToken+"/")
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if method == "getMe" {
+		_, _ = fmt.Fprint(rw, `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"boxt","username":"boxt_bot"}}`)
+		return
+	}
+	req := telegramRequest{method: method, form: r.Form, time: time.Now()}
+	f.mu.Lock()
+	n := len(f.requests)
+	f.requests = append(f.requests, req)
+	reply := f.reply
+	f.mu.Unlock()
+	if reply != nil {
+		if response := reply(n, req); response != "" {
+			_, _ = fmt.Fprint(rw, response)
+			return
+		}
+	}
+	// an album is answered with a message for every item
+	items := 1
+	if method == "sendMediaGroup" {
+		var media []json.RawMessage
+		if json.Unmarshal([]byte(req.form.Get("media")), &media) == nil && len(media) > 0 {
+			items = len(media)
+		}
+	}
+	var messages []string
+	f.mu.Lock()
+	for i := 0; i < items; i++ {
+		f.messageID++
+		messages = append(messages, fmt.Sprintf(`{"message_id":%d,"date":0,"chat":{"id":%s}}`, f.messageID, req.form.Get("chat_id")))
+	}
+	f.mu.Unlock()
+	result := messages[0]
+	if method == "sendMediaGroup" {
+		result = "[" + strings.Join(messages, ",") + "]"
+	}
+	_, _ = fmt.Fprintf(rw, `{"ok":true,"result":%s}`, result)
+}
+
+// sent returns the requests of the method
+func (f *fakeTelegram) sent(method string) []telegramRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var result []telegramRequest
+	for _, r := range f.requests {
+		if r.method == method {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func telegramError(code int, description string, retryAfter int) string {
+	return fmt.Sprintf(
+		`{"ok":false,"error_code":%d,"description":%q,"parameters":{"retry_after":%d}}`,
+		code,
+		description,
+		retryAfter)
+}
+
+// newTestBot connects to the stand-in through the configurable endpoint
+func newTestBot(t testing.TB, f *fakeTelegram) *tg.BotAPI {
+	cfg := &config{BotToken: testBotToken, BotAPIEndpoint: f.server.URL + "/bot%s/%s"}
+	bot, err := newBot(cfg, f.server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"time"
+)
+
+var messageIDPattern = regexp.MustCompile(`<[^<>\s]+>`)
+
+// threadParent returns the Telegram message of the closest known email the email replies to
+func (w *worker) threadParent(chatID int64, e *env) int {
+	if w.cfg.ThreadRetentionSeconds == 0 {
+		return 0
+	}
+	ids := messageIDPattern.FindAllString(e.mime.GetHeader("In-Reply-To"), -1)
+	references := messageIDPattern.FindAllString(e.mime.GetHeader("References"), -1)
+	for i := len(references) - 1; i >= 0; i-- {
+		ids = append(ids, references[i])
+	}
+	for _, id := range ids {
+		query, err := w.db.Query("select telegram_message_id from threads where chat_id=? and message_id=?", chatID, id)
+		checkErr(err)
+		var telegramMessageID int
+		found := query.Next()
+		if found {
+			checkErr(query.Scan(&telegramMessageID))
+		}
+		checkErr(query.Close())
+		if found {
+			return telegramMessageID
+		}
+	}
+	return 0
+}
+
+// rememberThread remembers the first Telegram message of the email
+func (w *worker) rememberThread(chatID int64, messageID string, telegramMessageID int) {
+	if w.cfg.ThreadRetentionSeconds == 0 {
+		return
+	}
+	w.mustExec(
+		"insert or replace into threads (chat_id, message_id, telegram_message_id, created) values (?,?,?,?)",
+		chatID,
+		messageID,
+		telegramMessageID,
+		time.Now().Unix())
+}
+
+// purgeThreads forgets emails older than the retention period
+func (w *worker) purgeThreads() {
+	w.mustExec("delete from threads where created<?", time.Now().Unix()-int64(w.cfg.ThreadRetentionSeconds))
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/smtp"
+	"testing"
+	"time"
+
+	"github.com/igrmk/go-smtpd/smtpd"
+)
+
+// threadTestEnv returns an email to chat 1 with the threading headers
+func threadTestEnv(w *worker, headers string) *env {
+	e := &env{
+		BasicEnvelope: &smtpd.BasicEnvelope{},
+		from:          mailAddress("sender@example.com"),
+		data:          []byte("From: sender@example.com\r\nTo: user1@boxt.us\r\nSubject: Re\r\n" + headers + "\r\nHello\r\n"),
+		cfg:           w.cfg,
+	}
+	checkErr(e.parse())
+	return e
+}
+
+func TestThreadParent(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.cfg.ThreadRetentionSeconds = 3600
+	w.rememberThread(1, "<root@example.com>", 10)
+	w.rememberThread(1, "<second@example.com>", 20)
+	w.rememberThread(2, "<other@example.com>", 30)
+	for _, c := range []struct {
+		headers string
+		parent  int
+	}{
+		{"In-Reply-To: <second@example.com>\r\n", 20},
+		{"In-Reply-To: <unknown@example.com>\r\nReferences: <root@example.com> <second@example.com> <unknown@example.com>\r\n", 20},
+		{"References: <root@example.com> <missing@example.com>\r\n", 10},
+		{"In-Reply-To: <other@example.com>\r\n", 0},
+		{"In-Reply-To: Alice's message of Monday <second@example.com>\r\n", 20},
+		{"", 0},
+	} {
+		if parent := w.threadParent(1, threadTestEnv(w, c.headers)); parent != c.parent {
+			t.Errorf("%q: got %d, expected %d", c.headers, parent, c.parent)
+		}
+	}
+	w.mustExec("update threads set created=? where message_id='<second@example.com>'", time.Now().Unix()-3601)
+	w.purgeThreads()
+	if parent := w.threadParent(1, threadTestEnv(w, "References: <root@example.com> <second@example.com>\r\n")); parent != 10 {
+		t.Errorf("expected the expired email to be forgotten, got %d", parent)
+	}
+	w.cfg.ThreadRetentionSeconds = 0
+	if parent := w.threadParent(1, threadTestEnv(w, "In-Reply-To: <root@example.com>\r\n")); parent != 0 {
+		t.Errorf("expected threading to be disabled, got %d", parent)
+	}
+}
+
+func TestThreadDelivery(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.ThreadRetentionSeconds = 3600
+	addTestAddresses(w, 1)
+	addr := serveTestMail(t, w)
+	to := testUsername(1) + "@" + testHost
+	sendTestEmail(t, addr, 1, 1)
+	waitFor(t, 5*time.Second, func() bool { return len(f.sent("sendMessage")) == 1 })
+	reply := "From: sender@example.com\r\nTo: " + to + "\r\nSubject: Re: Test 1\r\n" +
+		"Message-ID: <reply@example.com>\r\nIn-Reply-To: <1@example.com>\r\n\r\nReply\r\n"
+	if err := smtp.SendMail(addr, nil, "sender@example.com", []string{to}, []byte(reply)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, func() bool { return len(f.sent("sendMessage")) == 2 })
+	sent := f.sent("sendMessage")
+	if replyTo := sent[1].form.Get("reply_to_message_id"); replyTo != "1" {
+		t.Errorf("expected the reply to be threaded under the first message, got %q", replyTo)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// vanityMinLength is the minimum length of a chosen name
+const vanityMinLength = 3
+
+// maxLocalPartLength is the limit of RFC 5321
+const maxLocalPartLength = 64
+
+// vanitySuggestions is the number of names suggested when the name is taken
+const vanitySuggestions = 3
+
+// atext lists characters allowed in an atom besides letters and digits as defined in RFC 5322
+const atext = "!#$%&'*+-/=?^_`{|}~"
+
+// reservedNames cannot be chosen as they are used by mail administration or can mislead recipients
+var reservedNames = map[string]bool{
+	"abuse":         true,
+	"admin":         true,
+	"administrator": true,
+	"billing":       true,
+	"help":          true,
+	"hostmaster":    true,
+	"info":          true,
+	"mailer-daemon": true,
+	"no-reply":      true,
+	"nobody":        true,
+	"noreply":       true,
+	"postmaster":    true,
+	"root":          true,
+	"security":      true,
+	"support":       true,
+	"webmaster":     true,
+	"www":           true,
+}
+
+// validLocalPart checks that the local part is a dot-string of RFC 5321,
+// quoted strings are not allowed
+func validLocalPart(s string) bool {
+	if s == "" || len(s) > maxLocalPartLength {
+		return false
+	}
+	for _, atom := range strings.Split(s, ".") {
+		if atom == "" {
+			return false
+		}
+		for _, c := range atom {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune(atext, c)) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkVanityName returns the reason why the name cannot be chosen or an empty string
+func (w *worker) checkVanityName(name string) string {
+	switch {
+	case !validLocalPart(name):
+		return "Name is invalid, use letters, digits, dots and !#$%&'*+-/=?^_`{|}~"
+	case len(name) < vanityMinLength:
+		return fmt.Sprintf("Name should be at least %d characters long", vanityMinLength)
+	case w.cfg.SubaddressSeparator != "" && strings.Contains(name, w.cfg.SubaddressSeparator):
+		return fmt.Sprintf("Name cannot contain %s, it separates tags", w.cfg.SubaddressSeparator)
+	case reservedNames[name]:
+		return "Name is reserved"
+	}
+	return ""
+}
+
+func (w *worker) vanityAllowance(chatID int64) int {
+	return singleInt(w.db.QueryRow("select coalesce(max(vanity_allowance), 0) from users where chat_id=?", chatID))
+}
+
+// vanitySuggestions returns free addresses similar to the taken one
+func (w *worker) vanitySuggestions(name string, host string) (suggestions []string) {
+	free := func(username, host string) bool {
+		return w.checkVanityName(username) == "" && w.addressForUsername(username, host) == nil
+	}
+	for _, h := range w.systemHosts() {
+		if h != host && free(name, h) {
+			suggestions = append(suggestions, name+"@"+h)
+		}
+	}
+	for i := 0; i < 100 && len(suggestions) < vanitySuggestions; i++ {
+		username := fmt.Sprintf("%s%d", name, 1+rand.Intn(99))
+		if i >= 50 {
+			username = name + "." + randString(3)
+		}
+		if free(username, host) && !contains(suggestions, username+"@"+host) {
+			suggestions = append(suggestions, username+"@"+host)
+		}
+	}
+	if len(suggestions) > vanitySuggestions {
+		suggestions = suggestions[:vanitySuggestions]
+	}
+	return
+}
+
+func contains(xs []string, x string) bool {
+	for _, y := range xs {
+		if x == y {
+			return true
+		}
+	}
+	return false
+}
+
+// claimVanityAddress creates the address and takes one from the allowance of the chat,
+// the unique index on addresses resolves races between chats claiming the same name
+func (w *worker) claimVanityAddress(chatID int64, username string, host string) (created bool, allowed bool) {
+	tx, err := w.db.Begin()
+	checkErr(err)
+	defer func() { _ = tx.Rollback() }()
+	result, err := tx.Exec("update users set vanity_allowance=vanity_allowance-1 where chat_id=? and vanity_allowance>0", chatID)
+	checkErr(err)
+	affected, err := result.RowsAffected()
+	checkErr(err)
+	if affected == 0 {
+		return false, false
+	}
+	_, err = tx.Exec("insert into addresses (chat_id, username, host) values (?,?,?)", chatID, username, host)
+	if isUniqueViolation(err) {
+		return false, true
+	}
+	checkErr(err)
+	checkErr(tx.Commit())
+	return true, true
+}
+
+func isUniqueViolation(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// newVanityAddress creates an address with the name chosen by the user
+func (w *worker) newVanityAddress(chatID int64, arguments string) {
+	if w.cfg.VanityAllowance == 0 {
+		_ = w.sendText(chatID, false, parseRaw, "Choosing names is disabled")
+		return
+	}
+	parts := strings.Fields(strings.ToLower(arguments))
+	if len(parts) != 1 {
+		_ = w.sendText(chatID, false, parseRaw, "Command format: /new <name> or /new <name@host>")
+		return
+	}
+	name, host := parts[0], ""
+	if strings.Contains(name, "@") {
+		name, host = splitAddress(name)
+		if !w.isOurHost(host) {
+			_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf("Unknown host, available hosts are %s", strings.Join(w.systemHosts(), ", ")))
+			return
+		}
+	}
+	if reason := w.checkVanityName(name); reason != "" {
+		_ = w.sendText(chatID, false, parseRaw, reason)
+		return
+	}
+	if w.vanityAllowance(chatID) == 0 {
+		_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf(
+			"You have no names left to choose\nYou will get %d more for every new user registered by your referral link, see /referral",
+			w.cfg.VanityReferralBonus))
+		return
+	}
+	if host == "" {
+		host = w.newAddressHost(chatID)
+	}
+	created, allowed := false, true
+	if w.addressForUsername(name, host) == nil {
+		created, allowed = w.claimVanityAddress(chatID, name, host)
+	}
+	if !allowed {
+		_ = w.sendText(chatID, false, parseRaw, "You have no names left to choose")
+		return
+	}
+	if !created {
+		lines := []string{name + "@" + host + " is taken"}
+		if suggestions := w.vanitySuggestions(name, host); len(suggestions) > 0 {
+			lines = append(lines, "", "Available:")
+			lines = append(lines, suggestions...)
+		}
+		_ = w.sendText(chatID, false, parseRaw, strings.Join(lines, "\n"))
+		return
+	}
+	_ = w.sendText(chatID, false, parseRaw, fmt.Sprintf(
+		"Created %s@%s\nNames left to choose: %d",
+		name,
+		host,
+		w.vanityAllowance(chatID)))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckVanityName(t *testing.T) {
+	w := &worker{cfg: &config{SubaddressSeparator: "+"}}
+	for name, ok := range map[string]bool{
+		"alice":       true,
+		"alice.smith": true,
+		"a!b#c":       true,
+		"al":          false,
+		"alice..b":    false,
+		".alice":      false,
+		"alice+news":  false,
+		"al ice":      false,
+		"postmaster":  false,
+		strings.Repeat("a", maxLocalPartLength+1): false,
+	} {
+		if reason := w.checkVanityName(name); (reason == "") != ok {
+			t.Errorf("%q: got %q", name, reason)
+		}
+	}
+}
+
+func TestVanityUniqueness(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.VanityAllowance = 1
+	for chatID := int64(1); chatID <= 2; chatID++ {
+		w.mustExec("insert into users (chat_id, external_id, vanity_allowance) values (?,?,1)", chatID, testUsername(int(chatID)))
+	}
+	w.newVanityAddress(1, "alice@"+testHost)
+	w.newVanityAddress(2, "alice@"+testHost)
+	sent := f.sent("sendMessage")
+	if len(sent) != 2 || !strings.HasPrefix(sent[0].form.Get("text"), "Created") || !strings.Contains(sent[1].form.Get("text"), "is taken") {
+		t.Fatalf("expected the second chat to be told the name is taken, got %v", sent)
+	}
+	if a := w.addressForUsername("alice", testHost); a == nil || a.chatID != 1 {
+		t.Errorf("expected the address to stay with chat 1, got %+v", a)
+	}
+	// a chat losing the race to the unique index keeps its allowance
+	if created, allowed := w.claimVanityAddress(2, "alice", testHost); created || !allowed {
+		t.Errorf("expected a taken name not to be created, got created=%v allowed=%v", created, allowed)
+	}
+	if n := w.vanityAllowance(2); n != 1 {
+		t.Errorf("expected chat 2 to keep its allowance, got %d", n)
+	}
+	if n := w.vanityAllowance(1); n != 0 {
+		t.Errorf("expected chat 1 to spend its allowance, got %d", n)
+	}
+}
+
+func TestInsertAddress(t *testing.T) {
+	f := newFakeTelegram(t)
+	w := newTestWorker(t, f)
+	w.cfg.AdminID = 100
+	if !w.insertAddress(1, "alice", testHost) {
+		t.Fatal("expected a new address to be created")
+	}
+	if w.insertAddress(2, "alice", testHost) {
+		t.Error("expected a taken address not to be created")
+	}
+	w.addUsername("3 alice@" + testHost)
+	if sent := f.sent("sendMessage"); len(sent) != 1 || sent[0].form.Get("text") != "Address already exists" {
+		t.Errorf("expected the admin to be told the address exists, got %v", sent)
+	}
+	if n := singleInt(w.db.QueryRow("select count(*) from addresses")); n != 1 {
+		t.Errorf("expected one address, got %d", n)
+	}
+}
+
+func TestCheckDuplicateAddresses(t *testing.T) {
+	w := newTestWorker(t, newFakeTelegram(t))
+	w.mustExec("drop index addresses_username_host_unique")
+	w.mustExec("insert into addresses (chat_id, username, host) values (1,'alice',?), (2,'alice',?), (1,'bob',?)", testHost, testHost, testHost)
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			if err == nil || !strings.Contains(err.Error(), "alice@"+testHost+" of chats 1, 2") || strings.Contains(err.Error(), "bob") {
+				t.Errorf("expected the check to fail listing the duplicate, got %v", err)
+			}
+		}()
+		w.checkDuplicateAddresses()
+	}()
+	if n := singleInt(w.db.QueryRow("select count(*) from addresses")); n != 3 {
+		t.Errorf("expected the duplicates to be kept, got %d addresses", n)
+	}
+	w.mustExec("delete from addresses where chat_id=2")
+	w.checkDuplicateAddresses()
+}